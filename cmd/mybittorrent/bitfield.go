@@ -0,0 +1,27 @@
+package main
+
+// bitfield tracks which pieces a peer has, the high bit of the first byte is piece 0
+type bitfield []byte
+
+func newBitfield(numPieces int) bitfield {
+	return make(bitfield, (numPieces+7)/8)
+}
+
+func (bf bitfield) Has(index int) bool {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return false
+	}
+
+	return bf[byteIndex]>>(7-index%8)&1 != 0
+}
+
+// Set marks the piece as available, indexes past the end are ignored so the size stays the one of the torrent
+func (bf bitfield) Set(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+
+	bf[byteIndex] |= 1 << (7 - index%8)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// connections a torrent keeps to the peers it downloads from
+	defaultMaxPeers = 50
+
+	// connections being set up at the same time, most dials to dead peers only fail after a timeout
+	defaultMaxDials = 8
+
+	// a peer that failed is dialed again after a backoff that doubles with every failure in a row
+	initialPeerBackoff = 5 * time.Second
+	maxPeerBackoff     = 5 * time.Minute
+
+	// a peer that failed that many times in a row is forgotten until it's found again
+	maxDialFailures = 5
+
+	// blocks proven wrong before a peer is banned, one could be a bit flip on the way
+	smartBanStrikes = 2
+)
+
+var (
+	errPeerBanned    = errors.New("peer is banned")
+	errDuplicatePeer = errors.New("already connected to this peer")
+)
+
+// connManager decides which peers of a torrent are dialed. Peers are known by their address, from
+// wherever they came, and the same peer is never connected twice even under two addresses. Peers that
+// fail are dialed again after a backoff, and peers sending data that fails the hash checks are banned.
+type connManager struct {
+	// connections of the torrent, zero for no limit. The limit across the session is the connSlots of the downloader.
+	maxPeers int
+
+	mu         sync.Mutex
+	candidates map[netip.AddrPort]*candidate
+
+	// the order the candidates were found in, the oldest are dialed first
+	order []netip.AddrPort
+
+	// the ids of the connected peers
+	connectedIDs map[string]bool
+
+	// the blocks of the pieces that failed their hash, by who sent them, until the piece is downloaded again
+	failedPieces map[int][]blockRecord
+
+	// signaled when candidates are added, or announced again while they may be dialed
+	added chan struct{}
+}
+
+type candidate struct {
+	peer *Peer
+
+	// the id the peer introduced itself with, once it was connected
+	peerID string
+
+	connected bool
+	banned    bool
+
+	failures    int
+	nextAttempt time.Time
+
+	// blocks proven wrong
+	strikes int
+}
+
+type blockRecord struct {
+	addr  netip.AddrPort
+	begin int
+	hash  [sha1.Size]byte
+}
+
+func newConnManager(maxPeers int) *connManager {
+	return &connManager{
+		maxPeers:     maxPeers,
+		candidates:   make(map[netip.AddrPort]*candidate),
+		connectedIDs: make(map[string]bool),
+		failedPieces: make(map[int][]blockRecord),
+		added:        make(chan struct{}, 1),
+	}
+}
+
+// Add makes the peers candidates, the ones already known keep their state
+func (m *connManager) Add(peers []*Peer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var added bool
+	for _, peer := range peers {
+		// a peer that keeps being announced keeps its backoff, only the forgotten ones start over.
+		// A run waiting for peers is still woken up, it dials the peer once the backoff is over.
+		if c, ok := m.candidates[peer.addr]; ok {
+			if !c.banned && !c.connected {
+				added = true
+			}
+			continue
+		}
+
+		m.candidates[peer.addr] = &candidate{peer: peer}
+		m.order = append(m.order, peer.addr)
+		added = true
+	}
+
+	if added {
+		select {
+		case m.added <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// dialable tells if a candidate may be dialed now or after its backoff
+func (m *connManager) dialable() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range m.candidates {
+		if !c.banned && !c.connected {
+			return true
+		}
+	}
+
+	return false
+}
+
+// next returns a candidate to dial, or how long until one may be dialed. The wait is negative when
+// there is no candidate to wait for, or when the torrent has all the connections it may have.
+func (m *connManager) next(now time.Time, connected int) (*Peer, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.maxPeers > 0 && connected >= m.maxPeers {
+		return nil, -1
+	}
+
+	wait := time.Duration(-1)
+
+	// the order is compacted on the way, forgotten candidates are dropped from it
+	order := m.order[:0]
+	var picked *candidate
+	for _, addr := range m.order {
+		c, ok := m.candidates[addr]
+		if !ok {
+			continue
+		}
+		order = append(order, addr)
+
+		if picked != nil || c.banned || c.connected {
+			continue
+		}
+
+		// the same peer under another address
+		if c.peerID != "" && m.connectedIDs[c.peerID] {
+			continue
+		}
+
+		if until := c.nextAttempt.Sub(now); until > 0 {
+			if wait < 0 || until < wait {
+				wait = until
+			}
+			continue
+		}
+
+		picked = c
+	}
+	m.order = order
+
+	if picked == nil {
+		return nil, wait
+	}
+
+	picked.connected = true
+
+	// the peer of a previous attempt can't be dialed again
+	picked.peer = NewPeer(picked.peer.addr)
+
+	return picked.peer, 0
+}
+
+// connected records the id of a peer after its handshake, it fails when the peer is already connected
+func (m *connManager) connected(peer *Peer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := string(peer.handshake.PeerID)
+
+	c := m.candidates[peer.addr]
+	if c != nil {
+		c.peerID = id
+	}
+
+	if m.connectedIDs[id] {
+		return errDuplicatePeer
+	}
+
+	m.connectedIDs[id] = true
+	return nil
+}
+
+// disconnected records how the connection to the peer ended, err is nil when it ended well
+func (m *connManager) disconnected(peer *Peer, err error, wasConnected bool, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := m.candidates[peer.addr]
+	if c == nil {
+		return
+	}
+
+	c.connected = false
+	if wasConnected {
+		delete(m.connectedIDs, c.peerID)
+	}
+
+	switch {
+	case err == nil, errors.Is(err, errDuplicatePeer):
+		c.failures = 0
+		c.nextAttempt = now.Add(initialPeerBackoff)
+
+	// a peer that sends nothing but bad pieces won't get better, neither will we stop being ourselves
+	case errors.Is(err, errHashMismatch), errors.Is(err, errSelfConnection), errors.Is(err, errPeerBanned):
+		c.banned = true
+
+	default:
+		// a peer that worked for a while starts over
+		if wasConnected {
+			c.failures = 0
+		}
+
+		c.failures++
+		if c.failures >= maxDialFailures {
+			m.forget(peer.addr)
+			return
+		}
+
+		c.nextAttempt = now.Add(peerBackoff(c.failures))
+	}
+}
+
+// forget drops a candidate, a banned one is kept so it isn't dialed when a tracker gives it again
+func (m *connManager) forget(addr netip.AddrPort) {
+	delete(m.candidates, addr)
+}
+
+func peerBackoff(failures int) time.Duration {
+	backoff := initialPeerBackoff
+	for i := 1; i < failures && backoff < maxPeerBackoff; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, maxPeerBackoff)
+}
+
+// Banned tells if the peer was banned, its connection should be closed
+func (m *connManager) Banned(addr netip.AddrPort) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := m.candidates[addr]
+	return c != nil && c.banned
+}
+
+// pieceFailed keeps the hashes of the blocks of a piece that failed its hash check, with the peer that sent each
+func (m *connManager) pieceFailed(pieceIndex int, addr netip.AddrPort, piece []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for begin := 0; begin < len(piece); begin += blockSize {
+		block := piece[begin:min(begin+blockSize, len(piece))]
+		m.failedPieces[pieceIndex] = append(m.failedPieces[pieceIndex], blockRecord{
+			addr:  addr,
+			begin: begin,
+			hash:  sha1.Sum(block),
+		})
+	}
+}
+
+// pieceVerified compares the good piece with the blocks we got for it before, the peers that sent
+// a wrong block get a strike, and are banned after a few. It returns the peers that were banned.
+func (m *connManager) pieceVerified(pieceIndex int, piece []byte) []netip.AddrPort {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	records, ok := m.failedPieces[pieceIndex]
+	if !ok {
+		return nil
+	}
+	delete(m.failedPieces, pieceIndex)
+
+	// a peer gets one strike per piece, however many of its blocks were wrong
+	struck := make(map[netip.AddrPort]bool)
+	for _, record := range records {
+		good := sha1.Sum(piece[record.begin:min(record.begin+blockSize, len(piece))])
+		if good != record.hash {
+			struck[record.addr] = true
+		}
+	}
+
+	var banned []netip.AddrPort
+	for addr := range struck {
+		c := m.candidates[addr]
+		if c == nil || c.banned {
+			continue
+		}
+
+		c.strikes++
+		if c.strikes >= smartBanStrikes {
+			c.banned = true
+			banned = append(banned, addr)
+		}
+	}
+
+	return banned
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// signaled tells if the candidates were signaled, and takes the signal
+func signaled(m *connManager) bool {
+	select {
+	case <-m.added:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestConnManagerBackoff(t *testing.T) {
+	m := newConnManager(0)
+	now := time.Now()
+
+	addr := netip.MustParseAddrPort("10.0.0.1:6881")
+	m.Add([]*Peer{NewPeer(addr)})
+	if !signaled(m) {
+		t.Fatal("new peer wasn't signaled")
+	}
+
+	peer, _ := m.next(now, 0)
+	if peer == nil || peer.addr != addr {
+		t.Fatalf("got %v to dial", peer)
+	}
+
+	// connected peers aren't dialed twice, nor announced again
+	if peer, wait := m.next(now, 1); peer != nil || wait >= 0 {
+		t.Fatalf("got %v to dial and wait %v while connected", peer, wait)
+	}
+	m.Add([]*Peer{NewPeer(addr)})
+	if signaled(m) {
+		t.Fatal("connected peer was signaled")
+	}
+
+	failure := errors.New("connection refused")
+
+	// every failure in a row doubles the backoff, until the peer is forgotten
+	for failures := 1; failures < maxDialFailures; failures++ {
+		m.disconnected(peer, failure, false, now)
+
+		if peer, wait := m.next(now, 0); peer != nil || wait != peerBackoff(failures) {
+			t.Fatalf("after %d failures got %v to dial and wait %v, want %v", failures, peer, wait, peerBackoff(failures))
+		}
+
+		// announced again, the peer keeps its backoff but a run waiting for peers is woken up
+		m.Add([]*Peer{NewPeer(addr)})
+		if !signaled(m) {
+			t.Fatalf("peer announced again after %d failures wasn't signaled", failures)
+		}
+		if !m.dialable() {
+			t.Fatal("peer backing off isn't dialable")
+		}
+
+		now = now.Add(peerBackoff(failures))
+		if peer, _ = m.next(now, 0); peer == nil {
+			t.Fatalf("peer wasn't dialed again after %d failures", failures)
+		}
+	}
+
+	m.disconnected(peer, failure, false, now)
+	if m.dialable() {
+		t.Fatal("peer that kept failing is still a candidate")
+	}
+
+	// found again, it starts over
+	m.Add([]*Peer{NewPeer(addr)})
+	if peer, _ := m.next(now, 0); peer == nil {
+		t.Fatal("forgotten peer wasn't dialed once found again")
+	}
+
+	if peerBackoff(100) != maxPeerBackoff {
+		t.Fatalf("backoff grows to %v", peerBackoff(100))
+	}
+}
+
+func TestConnManagerDuplicates(t *testing.T) {
+	m := newConnManager(2)
+	now := time.Now()
+
+	a := netip.MustParseAddrPort("10.0.0.1:6881")
+	b := netip.MustParseAddrPort("[2001:db8::1]:6881")
+	c := netip.MustParseAddrPort("10.0.0.3:6881")
+	m.Add([]*Peer{NewPeer(a), NewPeer(b), NewPeer(c), NewPeer(a)})
+
+	first, _ := m.next(now, 0)
+	second, _ := m.next(now, 1)
+	if first.addr != a || second.addr != b {
+		t.Fatalf("dialed %v then %v, want the order they were found in", first, second)
+	}
+
+	// the torrent has all its connections
+	if peer, wait := m.next(now, 2); peer != nil || wait >= 0 {
+		t.Fatalf("got %v to dial over the limit", peer)
+	}
+
+	// the same peer under both of its addresses
+	id := []byte("-XX0000-000000000000")
+	first.handshake = &Handshake{PeerID: id}
+	second.handshake = &Handshake{PeerID: id}
+
+	if err := m.connected(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.connected(second); !errors.Is(err, errDuplicatePeer) {
+		t.Fatalf("second connection to the same peer: %v", err)
+	}
+	m.disconnected(second, errDuplicatePeer, false, now)
+
+	// the other address isn't dialed while the peer is connected, even once its backoff is over
+	later := now.Add(time.Hour)
+	if peer, _ := m.next(later, 1); peer == nil || peer.addr != c {
+		t.Fatalf("got %v to dial, want %s", peer, c)
+	}
+
+	m.disconnected(first, nil, true, later)
+	if peer, _ := m.next(later.Add(initialPeerBackoff), 1); peer == nil {
+		t.Fatal("a peer wasn't dialed again once disconnected")
+	}
+}
+
+func TestConnManagerSmartBan(t *testing.T) {
+	m := newConnManager(0)
+
+	good := netip.MustParseAddrPort("10.0.0.1:6881")
+	bad := netip.MustParseAddrPort("10.0.0.2:6881")
+	m.Add([]*Peer{NewPeer(good), NewPeer(bad)})
+
+	// a piece of two blocks, the bad peer sends the second one wrong
+	piece := bytes.Repeat([]byte{1}, 2*blockSize)
+	corrupt := bytes.Clone(piece)
+	corrupt[blockSize] ^= 0xff
+
+	// the blocks of the good peer are kept too, only the ones that turn out wrong count
+	fail := func(pieceIndex int) {
+		m.pieceFailed(pieceIndex, bad, corrupt)
+		m.pieceFailed(pieceIndex, good, piece)
+	}
+
+	// a piece that failed is no proof until it's downloaded again
+	if banned := m.pieceVerified(7, piece); banned != nil {
+		t.Fatalf("banned %v without a failed piece", banned)
+	}
+
+	fail(0)
+	if banned := m.pieceVerified(0, piece); len(banned) != 0 || m.Banned(bad) {
+		t.Fatalf("banned %v after one strike", banned)
+	}
+
+	// the blocks of a piece are only compared once
+	if banned := m.pieceVerified(0, piece); banned != nil {
+		t.Fatalf("banned %v comparing a piece twice", banned)
+	}
+
+	fail(1)
+	banned := m.pieceVerified(1, piece)
+	if len(banned) != 1 || banned[0] != bad || !m.Banned(bad) {
+		t.Fatalf("banned %v after two strikes, want %s", banned, bad)
+	}
+
+	if m.Banned(good) {
+		t.Fatal("peer that sent good blocks was banned")
+	}
+
+	// a banned peer isn't dialed, even when it's announced again
+	m.Add([]*Peer{NewPeer(bad)})
+	for {
+		peer, _ := m.next(time.Now(), 0)
+		if peer == nil {
+			break
+		}
+		if peer.addr == bad {
+			t.Fatal("banned peer was dialed")
+		}
+	}
+}
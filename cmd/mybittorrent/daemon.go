@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+)
+
+// DaemonCmd runs a session until it's interrupted, the torrents are driven through the RPC API
+func DaemonCmd(args []string) error {
+
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	listenAddr := fs.String("listen", ":6881", "address to accept peers on, over TCP and uTP")
+	rpcAddr := fs.String("rpc", defaultRPCAddr, "address of the RPC API, unix:<path> for a unix socket")
+	downloadDir := fs.String("dir", ".", "directory the torrents are saved to")
+	maxConnections := fs.Int("max-connections", 200, "maximum number of peer connections across all torrents, 0 for unlimited")
+	maxPeers := fs.Int("max-peers", defaultMaxPeers, "maximum number of peers every torrent downloads from, 0 for unlimited")
+	maxDownloads := fs.Int("max-downloads", 3, "maximum number of torrents downloading at the same time, 0 for unlimited")
+	maxSeeds := fs.Int("max-seeds", 5, "maximum number of torrents seeding at the same time, 0 for unlimited")
+	transport := fs.String("transport", "prefer-tcp", "how to connect to peers: prefer-tcp, prefer-utp, tcp or utp")
+	lsd := fs.Bool("lsd", true, "find the peers of public torrents on the local network, and be found by them")
+	hostWhitelist := fs.String("rpc-host-whitelist", "", "comma separated host names the Transmission API is reached by, besides localhost and IP addresses")
+	limits := addRateFlags(fs)
+	fs.Parse(args)
+
+	limits.apply()
+
+	policy, err := parseTransportPolicy(*transport)
+	if err != nil {
+		return err
+	}
+
+	session, err := NewSession(SessionConfig{
+		ListenAddr:         *listenAddr,
+		MaxConnections:     *maxConnections,
+		MaxPeersPerTorrent: *maxPeers,
+		MaxActiveDownloads: *maxDownloads,
+		MaxActiveSeeds:     *maxSeeds,
+		Transport:          policy,
+		PeerUploadRate:     int64(limits.peerUpload),
+		PeerDownloadRate:   int64(limits.peerDownload),
+		LocalDiscovery:     *lsd,
+	})
+	if err != nil {
+		return err
+	}
+
+	defer session.Close()
+
+	ln, err := listenRPC(*rpcAddr)
+	if err != nil {
+		return err
+	}
+
+	transmission := newTransmissionServer(session, *downloadDir)
+	if *hostWhitelist != "" {
+		transmission.hostWhitelist = strings.Split(*hostWhitelist, ",")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(rpcPath, newRPCServer(session, *downloadDir))
+	mux.Handle(transmissionPath, transmission)
+	mux.Handle(metricsPath, metrics)
+
+	server := &http.Server{
+		Handler: mux,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	context.AfterFunc(ctx, func() {
+		server.Close()
+	})
+
+	slog.Info("daemon started", "peers", session.Addr(), "rpc", *rpcAddr)
+
+	err = server.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return session.Close()
+	}
+
+	return err
+}
+
+const ctlUsage = `usage: ctl [-rpc address] <command> [arguments]
+
+commands:
+  add [-o path] [-files selection] [-priority file=level] <torrent file or magnet link>
+  list
+  status <info hash>
+  pause <info hash>
+  resume <info hash>
+  remove <info hash>
+  peers <info hash>
+  limits [-torrent info hash] [-upload-rate rate] [-download-rate rate]`
+
+// CtlCmd drives a running daemon
+func CtlCmd(args []string) error {
+
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	rpcAddr := fs.String("rpc", defaultRPCAddr, "address of the daemon's RPC API, unix:<path> for a unix socket")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New(ctlUsage)
+	}
+
+	client := newRPCClient(*rpcAddr)
+	ctx := context.Background()
+
+	command, args := fs.Arg(0), fs.Args()[1:]
+
+	switch command {
+	case "add":
+		return ctlAdd(ctx, client, args)
+
+	case "list":
+		var torrents []torrentJSON
+		err := client.Call(ctx, "torrent.list", nil, &torrents)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "INFO HASH\tSTATE\tPROGRESS\tNAME")
+		for _, t := range torrents {
+			fmt.Fprintf(w, "%s\t%s\t%.1f%%\t%s\n", t.InfoHash, t.State, t.Progress, t.Name)
+		}
+		return w.Flush()
+
+	case "status":
+		if len(args) != 1 {
+			return errors.New(ctlUsage)
+		}
+
+		var t torrentJSON
+		err := client.Call(ctx, "torrent.status", infoHashParams{InfoHash: args[0]}, &t)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Info Hash:", t.InfoHash)
+		fmt.Println("Name:", t.Name)
+		if t.Private {
+			fmt.Println("Private: yes")
+		}
+		fmt.Println("State:", t.State)
+		if t.Error != "" {
+			fmt.Println("Error:", t.Error)
+		}
+		fmt.Printf("Pieces: %d/%d\n", t.Pieces, t.TotalPieces)
+		fmt.Printf("Completed: %d/%d (%.1f%%)\n", t.Completed, t.Length, t.Progress)
+		if t.Seeders >= 0 && t.Leechers >= 0 {
+			fmt.Printf("Swarm: %d seeders, %d leechers\n", t.Seeders, t.Leechers)
+		}
+		if t.TrackerError != "" {
+			fmt.Println("Tracker Error:", t.TrackerError)
+		}
+		if t.TrackerWarning != "" {
+			fmt.Println("Tracker Warning:", t.TrackerWarning)
+		}
+		return nil
+
+	case "pause", "resume", "remove":
+		if len(args) != 1 {
+			return errors.New(ctlUsage)
+		}
+
+		return client.Call(ctx, "torrent."+command, infoHashParams{InfoHash: args[0]}, nil)
+
+	case "peers":
+		if len(args) != 1 {
+			return errors.New(ctlUsage)
+		}
+
+		var peers []peerJSON
+		err := client.Call(ctx, "torrent.peers", infoHashParams{InfoHash: args[0]}, &peers)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ADDRESS\tDIRECTION\tPIECES\tCHOKED\tPEER ID")
+		for _, p := range peers {
+			direction := "out"
+			if p.Incoming {
+				direction = "in"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%t\t%q\n", p.Addr, direction, p.Pieces, p.Choked, p.PeerID)
+		}
+		return w.Flush()
+
+	case "limits":
+		limitsFlags := flag.NewFlagSet("limits", flag.ExitOnError)
+		infoHash := limitsFlags.String("torrent", "", "info hash of the torrent to limit, the global limits when empty")
+		var upload, download rateFlag
+		limitsFlags.Var(&upload, "upload-rate", "maximum upload rate in bytes per second, accepts K, M and G suffixes, 0 for unlimited")
+		limitsFlags.Var(&download, "download-rate", "maximum download rate in bytes per second, accepts K, M and G suffixes, 0 for unlimited")
+		limitsFlags.Parse(args)
+
+		// only the rates that were given change, a zero would lift the other limit
+		params := setLimitsParams{InfoHash: *infoHash}
+		limitsFlags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "upload-rate":
+				params.UploadRate = (*int64)(&upload)
+			case "download-rate":
+				params.DownloadRate = (*int64)(&download)
+			}
+		})
+
+		if params.UploadRate == nil && params.DownloadRate == nil {
+			return errors.New("limits needs -upload-rate or -download-rate")
+		}
+
+		return client.Call(ctx, "session.limits", params, nil)
+
+	default:
+		return fmt.Errorf("unknown ctl command %s\n%s", command, ctlUsage)
+	}
+}
+
+func ctlAdd(ctx context.Context, client *rpcClient, args []string) error {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	out := fs.String("o", "", "where the daemon saves the torrent, defaults to its name in the daemon's directory")
+	selection := fs.String("files", "", "comma separated file indexes or globs to download, all files when empty")
+	var priorities stringsFlag
+	fs.Var(&priorities, "priority", "file priority as <file index or glob>=<skip|low|normal|high>, can be repeated")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New(ctlUsage)
+	}
+
+	params := addTorrentParams{
+		Output:     *out,
+		Files:      *selection,
+		Priorities: priorities,
+	}
+
+	// the daemon may run on another machine, so the torrent file is sent rather than its path
+	if strings.HasPrefix(fs.Arg(0), "magnet:") {
+		params.Magnet = fs.Arg(0)
+
+		// the daemon answers once it fetched the metadata from the peers
+		client.httpClient.Timeout = rpcTimeout + metadataTimeout
+	} else {
+		content, err := os.ReadFile(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		params.Metainfo = content
+	}
+
+	var t torrentJSON
+	err := client.Call(ctx, "torrent.add", params, &t)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(t.InfoHash)
+	return nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// how often a peer that has nothing to download checks the picker again
+	pickRetryInterval = 500 * time.Millisecond
+
+	// a peer that fails that many pieces in a row is dropped
+	maxPeerFailures = 3
+
+	// the errors of the dropped peers reported when a download gives up
+	maxRunErrors = 10
+)
+
+// downloader fetches the pieces of a torrent from many peers at the same time.
+// When a peer stops answering, the piece it was downloading goes back to the
+// picker so one of the other peers downloads it.
+type downloader struct {
+	file    *TorrentFile
+	picker  *piecePicker
+	storage Storage
+
+	// called after every piece was verified and stored, may be nil
+	onPiece func(pieceIndex int)
+
+	dialer *peerDialer
+
+	// the id we introduce ourselves with to the peers
+	peerID []byte
+
+	// shared by all the connections of a session to limit their number, nil for no limit
+	connSlots chan struct{}
+
+	// a slot is taken while a connection is set up, shared by the session too
+	dialSlots chan struct{}
+
+	// the peers to download from, wherever they were found
+	conns *connManager
+
+	// the connected peers are added to it, may be nil
+	peers *peerSet
+
+	log *slog.Logger
+
+	requestTimeout time.Duration
+
+	// limits of the whole torrent
+	bandwidth *bandwidthLimiter
+
+	// limits of every single peer, zero for unlimited
+	peerUploadRate   int64
+	peerDownloadRate int64
+
+	mu       sync.Mutex
+	fatalErr error
+}
+
+func newDownloader(file *TorrentFile, storage Storage) *downloader {
+	return &downloader{
+		file:           file,
+		picker:         newPiecePicker(len(file.Info.PiecesHash)),
+		storage:        storage,
+		dialer:         defaultDialer,
+		peerID:         localPeerID,
+		requestTimeout: defaultRequestTimeout,
+		bandwidth:      newBandwidthLimiter(realClock{}, 0, 0),
+		dialSlots:      make(chan struct{}, defaultMaxDials),
+		conns:          newConnManager(defaultMaxPeers),
+		log:            torrentLogger(file),
+	}
+}
+
+// AddPeers hands peers to the running download, or to the next one when none runs
+func (d *downloader) AddPeers(peers []*Peer) {
+	d.conns.Add(peers)
+}
+
+// Run downloads from the peers, and from the ones added while it runs, until every piece is downloaded
+// or none of the peers is usable. The peers that failed are tried again after a while, so it only
+// gives up when every peer failed too many times or was banned.
+func (d *downloader) Run(ctx context.Context, peers []*Peer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// a new run gets another chance after the storage failed
+	d.mu.Lock()
+	d.fatalErr = nil
+	d.mu.Unlock()
+
+	d.conns.Add(peers)
+
+	var errs []error
+	done := make(chan error)
+	running := 0
+
+	start := func(peer *Peer) {
+		running++
+		go func() {
+			err := d.downloadFrom(ctx, peer)
+			if err != nil {
+				d.log.Warn("dropped peer", "peer", peer, "err", err)
+			}
+
+			// wake up the peers that wait for pieces
+			if d.picker.Complete() || d.fatal() != nil {
+				cancel()
+			}
+
+			done <- err
+		}()
+	}
+
+	for {
+		wait := time.Duration(-1)
+		for ctx.Err() == nil {
+			var peer *Peer
+			peer, wait = d.conns.next(time.Now(), running)
+			if peer == nil {
+				break
+			}
+
+			start(peer)
+		}
+
+		if running == 0 && (wait < 0 || ctx.Err() != nil) {
+			break
+		}
+
+		// a nil channel blocks, when no peer is backing off
+		var retry <-chan time.Time
+		var timer *time.Timer
+		if wait >= 0 && ctx.Err() == nil {
+			timer = time.NewTimer(wait)
+			retry = timer.C
+		}
+
+		select {
+		case err := <-done:
+			running--
+
+			// a long download drops a lot of peers, only the last ones explain why it gave up
+			if err != nil {
+				errs = append(errs, err)
+				if len(errs) > maxRunErrors {
+					errs = errs[1:]
+				}
+			}
+		case <-d.conns.added:
+		case <-retry:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+
+	if err := d.fatal(); err != nil {
+		return err
+	}
+
+	if d.picker.Complete() {
+		return nil
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return fmt.Errorf("no peer left to download from: %w", errors.Join(errs...))
+}
+
+func (d *downloader) fatal() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.fatalErr
+}
+
+func (d *downloader) setFatal(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.fatalErr == nil {
+		d.fatalErr = err
+	}
+}
+
+// downloadFrom downloads from one peer until it fails or every piece is downloaded,
+// how it ended decides when the peer is dialed again
+func (d *downloader) downloadFrom(ctx context.Context, peer *Peer) (err error) {
+	var registered bool
+	defer func() {
+		d.conns.disconnected(peer, err, registered, time.Now())
+	}()
+
+	if d.connSlots != nil {
+		select {
+		case d.connSlots <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+
+		defer func() { <-d.connSlots }()
+	}
+
+	peer.log = d.log.With("peer", peer.String())
+	peer.dialer = d.dialer
+	peer.localPeerID = d.peerID
+	peer.numPieces = len(d.file.Info.PiecesHash)
+	peer.requestTimeout = d.requestTimeout
+	peer.sharedBandwidth = []*bandwidthLimiter{globalBandwidth, d.bandwidth}
+	peer.bandwidth.upload.SetLimit(d.peerUploadRate)
+	peer.bandwidth.download.SetLimit(d.peerDownloadRate)
+
+	err = d.connect(ctx, peer)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+
+	defer peer.Close()
+
+	// the same peer may be known under another address, like its IPv4 and IPv6 ones
+	err = d.conns.connected(peer)
+	if err != nil {
+		return err
+	}
+	registered = true
+
+	if d.peers != nil {
+		d.peers.Add(peer)
+		defer d.peers.Remove(peer)
+	}
+
+	infoHash := hex.EncodeToString(d.file.Info.InfoHash)
+
+	var failures int
+	for !d.picker.Complete() {
+		// smart ban found out the peer sent a bad block
+		if d.conns.Banned(peer.addr) {
+			return errPeerBanned
+		}
+
+		pieceIndex, ok := d.picker.Pick(peer)
+		if !ok {
+			// everything the peer has is done or downloaded by other peers
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-peer.Done():
+				return peer.Err()
+			case <-time.After(pickRetryInterval):
+			}
+			continue
+		}
+
+		piece, err := peer.DownloadPiece(ctx, d.file, pieceIndex)
+		if err != nil {
+			// let another peer download it
+			d.picker.Failed(pieceIndex)
+
+			switch {
+			case errors.Is(err, errHashMismatch):
+				metricPiecesFailed.Inc(infoHash)
+				d.conns.pieceFailed(pieceIndex, peer.addr, piece)
+				putPieceBuffer(piece)
+			case errors.Is(err, errRequestTimeout):
+				metricRequestTimeouts.Inc(infoHash)
+			}
+
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			// a peer that stopped answering is dropped so its pieces are downloaded by the others
+			if errors.Is(err, errRequestTimeout) || peer.Err() != nil {
+				return err
+			}
+
+			failures++
+			if failures >= maxPeerFailures {
+				return fmt.Errorf("too many failures, last: %w", err)
+			}
+
+			continue
+		}
+
+		failures = 0
+
+		err = d.storePiece(pieceIndex, piece)
+		if err != nil {
+			putPieceBuffer(piece)
+			d.picker.Failed(pieceIndex)
+			d.setFatal(err)
+			return err
+		}
+
+		d.picker.Done(pieceIndex)
+		metricPiecesVerified.Inc(infoHash)
+		peer.log.Debug("piece verified", "piece", pieceIndex)
+
+		for _, addr := range d.conns.pieceVerified(pieceIndex, piece) {
+			d.log.Warn("banned peer for sending bad blocks", "peer", addr, "piece", pieceIndex)
+			metricPeersBanned.Inc(infoHash)
+		}
+
+		// the storage has its own copy
+		putPieceBuffer(piece)
+
+		if d.onPiece != nil {
+			d.onPiece(pieceIndex)
+		}
+	}
+
+	return nil
+}
+
+// connect dials the peer and exchanges handshakes, while holding a dial slot
+func (d *downloader) connect(ctx context.Context, peer *Peer) error {
+	if d.dialSlots != nil {
+		select {
+		case d.dialSlots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		defer func() { <-d.dialSlots }()
+	}
+
+	return peer.Connect(ctx, d.file.Info.InfoHash)
+}
+
+func (d *downloader) storePiece(pieceIndex int, piece []byte) error {
+	_, err := d.storage.WriteAt(piece, pieceIndex, 0)
+	if err != nil {
+		return fmt.Errorf("failed to store piece %d: %w", pieceIndex, err)
+	}
+
+	return d.storage.MarkComplete(pieceIndex)
+}
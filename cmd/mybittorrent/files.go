@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// filePriority decides how early the pieces of a file are downloaded, if at all
+type filePriority int
+
+const (
+	prioritySkip filePriority = iota
+	priorityLow
+	priorityNormal
+	priorityHigh
+)
+
+func parseFilePriority(s string) (filePriority, error) {
+	switch strings.ToLower(s) {
+	case "skip", "0":
+		return prioritySkip, nil
+	case "low", "1":
+		return priorityLow, nil
+	case "normal", "2":
+		return priorityNormal, nil
+	case "high", "3":
+		return priorityHigh, nil
+	default:
+		return 0, fmt.Errorf("unknown priority %q, expected one of skip, low, normal, high", s)
+	}
+}
+
+func (p filePriority) String() string {
+	switch p {
+	case prioritySkip:
+		return "skip"
+	case priorityLow:
+		return "low"
+	case priorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// matchFiles returns the indexes of the files a selector matches.
+// A selector is either a file index or a glob matched against the path of the file.
+func matchFiles(info *Info, selector string) ([]int, error) {
+	if index, err := strconv.Atoi(selector); err == nil {
+		if index < 0 || index >= len(info.Files) {
+			return nil, fmt.Errorf("file index %d out of range, the torrent has %d files", index, len(info.Files))
+		}
+
+		return []int{index}, nil
+	}
+
+	var matches []int
+	for i, file := range info.Files {
+		matched, err := path.Match(selector, file.DisplayPath())
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", selector, err)
+		}
+
+		if matched {
+			matches = append(matches, i)
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no file matches %q", selector)
+	}
+
+	return matches, nil
+}
+
+// fileSelection turns the --files and --priority flags into a priority per file.
+// selection is a comma separated list of selectors, empty selects every file.
+// Every priority is a selector and a level separated by '=', like "*.iso=high".
+func fileSelection(info *Info, selection string, priorities []string) ([]filePriority, error) {
+	filePriorities := make([]filePriority, len(info.Files))
+
+	if selection == "" {
+		for i := range filePriorities {
+			filePriorities[i] = priorityNormal
+		}
+	}
+
+	for _, selector := range strings.Split(selection, ",") {
+		selector = strings.TrimSpace(selector)
+		if selector == "" {
+			continue
+		}
+
+		matches, err := matchFiles(info, selector)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, i := range matches {
+			filePriorities[i] = priorityNormal
+		}
+	}
+
+	for _, priority := range priorities {
+		selector, level, ok := strings.Cut(priority, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid priority %q, expected <file>=<level>", priority)
+		}
+
+		p, err := parseFilePriority(level)
+		if err != nil {
+			return nil, err
+		}
+
+		matches, err := matchFiles(info, selector)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, i := range matches {
+			filePriorities[i] = p
+		}
+	}
+
+	return filePriorities, nil
+}
+
+// piecePriorities gives every piece the highest priority of the files it overlaps,
+// so the boundary pieces of a wanted file are downloaded as well
+func piecePriorities(info *Info, filePriorities []filePriority) []filePriority {
+	priorities := make([]filePriority, len(info.PiecesHash))
+
+	for fileIndex, priority := range filePriorities {
+		first, last := info.FilePieces(fileIndex)
+		for i := first; i <= last; i++ {
+			priorities[i] = max(priorities[i], priority)
+		}
+	}
+
+	return priorities
+}
+
+// fileProgress tracks how much of every file was downloaded
+type fileProgress struct {
+	info       *Info
+	downloaded []int64
+}
+
+func newFileProgress(info *Info) *fileProgress {
+	return &fileProgress{
+		info:       info,
+		downloaded: make([]int64, len(info.Files)),
+	}
+}
+
+// Add records a downloaded piece and returns the files it belongs to
+func (fp *fileProgress) Add(pieceIndex int) []int {
+	var files []int
+	for _, segment := range fp.info.PieceSegments(pieceIndex) {
+		fp.downloaded[segment.fileIndex] += segment.length
+		files = append(files, segment.fileIndex)
+	}
+
+	return files
+}
+
+func (fp *fileProgress) Percent(fileIndex int) float64 {
+	length := fp.info.Files[fileIndex].Length
+	if length == 0 {
+		return 100
+	}
+
+	return float64(fp.downloaded[fileIndex]) * 100 / float64(length)
+}
+
+// outputPath is where a file of the torrent is saved. A single-file torrent is saved to out,
+// the files of a multi-file torrent are saved inside the out directory.
+func outputPath(info *Info, out string, fileIndex int) string {
+	if !info.MultiFile {
+		return out
+	}
+
+	return filepath.Join(out, filepath.Join(info.Files[fileIndex].Path...))
+}
+
+// removeTorrentData deletes the files of the torrent saved at out, then the directories that were
+// left empty. Anything else in the directories, like files a user put next to the torrent, is kept.
+func removeTorrentData(info *Info, out string) error {
+	out = filepath.Clean(out)
+
+	var errs []error
+	dirs := make(map[string]bool)
+
+	for i := range info.Files {
+		filePath := outputPath(info, out, i)
+
+		err := os.Remove(filePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+
+		if !info.MultiFile {
+			continue
+		}
+
+		// the directories of the file, up to the one of the torrent
+		for dir := filepath.Dir(filePath); len(dir) >= len(out); dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+
+	// the deepest directories go first, so their parents can be empty once it's their turn
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	slices.SortFunc(sorted, func(a, b string) int {
+		return len(b) - len(a)
+	})
+
+	for _, dir := range sorted {
+		// directories that aren't empty stay
+		os.Remove(dir)
+	}
+
+	return errors.Join(errs...)
+}
+
+// stringsFlag is a flag.Value that collects every use of a repeated flag
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
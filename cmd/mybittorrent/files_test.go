@@ -0,0 +1,216 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testMultiFileInfo is a torrent of 160 bytes in pieces of 32 bytes, with a file that crosses
+// several pieces, files sharing a piece and an empty file
+func testMultiFileInfo() *Info {
+	info := &Info{
+		Name:        "movie",
+		MultiFile:   true,
+		PieceLength: 32,
+	}
+
+	for _, f := range []struct {
+		path   string
+		length int64
+	}{
+		{"film/film.iso", 100},
+		{"film/subs/en.srt", 10},
+		{"readme.txt", 0},
+		{"extras/cover.jpg", 50},
+	} {
+		info.Files = append(info.Files, FileInfo{
+			Length: f.length,
+			Path:   strings.Split(f.path, "/"),
+			Offset: info.Length,
+		})
+		info.Length += f.length
+	}
+
+	info.PiecesHash = make([]string, (info.Length+info.PieceLength-1)/info.PieceLength)
+	return info
+}
+
+func TestParseFilePriority(t *testing.T) {
+	tests := []struct {
+		level   string
+		want    filePriority
+		invalid bool
+	}{
+		{level: "skip", want: prioritySkip},
+		{level: "0", want: prioritySkip},
+		{level: "Low", want: priorityLow},
+		{level: "normal", want: priorityNormal},
+		{level: "HIGH", want: priorityHigh},
+		{level: "3", want: priorityHigh},
+		{level: "4", invalid: true},
+		{level: "urgent", invalid: true},
+		{level: "", invalid: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseFilePriority(tt.level)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("level %q parsed as %s", tt.level, got)
+			}
+			continue
+		}
+
+		if err != nil || got != tt.want {
+			t.Errorf("level %q parsed as %s, %v, want %s", tt.level, got, err, tt.want)
+		}
+	}
+}
+
+func TestMatchFiles(t *testing.T) {
+	info := testMultiFileInfo()
+
+	tests := []struct {
+		selector string
+		want     []int
+		invalid  bool
+	}{
+		{selector: "0", want: []int{0}},
+		{selector: "3", want: []int{3}},
+		{selector: "*.txt", want: []int{2}},
+		{selector: "film/*", want: []int{0}},
+		{selector: "film/*/*", want: []int{1}},
+		{selector: "*/*.[ij]*", want: []int{0, 3}},
+		{selector: "film/subs/en.srt", want: []int{1}},
+		{selector: "4", invalid: true},
+		{selector: "-1", invalid: true},
+		{selector: "*.mkv", invalid: true},
+		{selector: "[", invalid: true},
+	}
+
+	for _, tt := range tests {
+		got, err := matchFiles(info, tt.selector)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("selector %q matched %v", tt.selector, got)
+			}
+			continue
+		}
+
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("selector %q matched %v, %v, want %v", tt.selector, got, err, tt.want)
+		}
+	}
+}
+
+func TestFileSelection(t *testing.T) {
+	info := testMultiFileInfo()
+
+	const (
+		skip   = prioritySkip
+		low    = priorityLow
+		normal = priorityNormal
+		high   = priorityHigh
+	)
+
+	tests := []struct {
+		name       string
+		selection  string
+		priorities []string
+		want       []filePriority
+		invalid    bool
+	}{
+		{name: "everything", want: []filePriority{normal, normal, normal, normal}},
+		{name: "selected", selection: "0, *.txt", want: []filePriority{normal, skip, normal, skip}},
+		{name: "priorities", priorities: []string{"film/*=high", "3=low"}, want: []filePriority{high, normal, normal, low}},
+		{name: "priority of a file that isn't selected", selection: "0", priorities: []string{"3=high"}, want: []filePriority{normal, skip, skip, high}},
+		{name: "last priority wins", priorities: []string{"*/*=low", "0=skip"}, want: []filePriority{skip, normal, normal, low}},
+		{name: "unknown file", selection: "0,7", invalid: true},
+		{name: "priority without level", priorities: []string{"0"}, invalid: true},
+		{name: "unknown level", priorities: []string{"0=urgent"}, invalid: true},
+		{name: "priority of an unknown file", priorities: []string{"*.mkv=high"}, invalid: true},
+	}
+
+	for _, tt := range tests {
+		got, err := fileSelection(info, tt.selection, tt.priorities)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("%s: got %v", tt.name, got)
+			}
+			continue
+		}
+
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestFilePieces(t *testing.T) {
+	info := testMultiFileInfo()
+
+	tests := []struct {
+		file        int
+		first, last int
+	}{
+		{file: 0, first: 0, last: 3},
+		{file: 1, first: 3, last: 3},
+		// an empty file has no piece
+		{file: 2, first: 3, last: 2},
+		{file: 3, first: 3, last: 4},
+	}
+
+	for _, tt := range tests {
+		first, last := info.FilePieces(tt.file)
+		if first != tt.first || last != tt.last {
+			t.Errorf("file %d has pieces %d to %d, want %d to %d", tt.file, first, last, tt.first, tt.last)
+		}
+	}
+
+	// the piece shared by three files is split between them, the empty one left out
+	segments := info.PieceSegments(3)
+	want := []fileSegment{
+		{fileIndex: 0, fileOffset: 96, pieceOffset: 0, length: 4},
+		{fileIndex: 1, fileOffset: 0, pieceOffset: 4, length: 10},
+		{fileIndex: 3, fileOffset: 0, pieceOffset: 14, length: 18},
+	}
+	if !slices.Equal(segments, want) {
+		t.Errorf("piece 3 has segments %+v, want %+v", segments, want)
+	}
+
+	// the last piece is short
+	if size := info.PieceSize(4); size != 32 {
+		t.Errorf("last piece of %d bytes, want 32", size)
+	}
+	info.Length -= 7
+	if size := info.PieceSize(4); size != 25 {
+		t.Errorf("last piece of %d bytes, want 25", size)
+	}
+}
+
+func TestPiecePriorities(t *testing.T) {
+	info := testMultiFileInfo()
+
+	got := piecePriorities(info, []filePriority{priorityLow, prioritySkip, priorityHigh, priorityNormal})
+
+	// a piece shared by files gets the highest of their priorities, the empty file has none to give
+	want := []filePriority{priorityLow, priorityLow, priorityLow, priorityNormal, priorityNormal}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got piece priorities %v, want %v", got, want)
+	}
+}
+
+func TestOutputPath(t *testing.T) {
+	info := testMultiFileInfo()
+
+	if got, want := outputPath(info, "out", 1), filepath.Join("out", "film", "subs", "en.srt"); got != want {
+		t.Errorf("file saved to %s, want %s", got, want)
+	}
+
+	single := &Info{Name: "file.bin", Files: []FileInfo{{Length: 1, Path: []string{"file.bin"}}}}
+	if got := outputPath(single, "out.bin", 0); got != "out.bin" {
+		t.Errorf("single file saved to %s, want out.bin", got)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// logFlags decide where the diagnostics go. They are global flags that come before the command,
+// like mybittorrent -v -log-format json download ..., stdout is left for the results of the commands.
+type logFlags struct {
+	verbose bool
+	level   string
+	format  string
+	file    string
+}
+
+func addLogFlags(fs *flag.FlagSet) *logFlags {
+	l := &logFlags{}
+	fs.BoolVar(&l.verbose, "v", false, "log everything, same as -log-level debug")
+	fs.StringVar(&l.level, "log-level", "info", "minimum level of the logs: debug, info, warn or error")
+	fs.StringVar(&l.format, "log-format", "text", "format of the logs: text or json")
+	fs.StringVar(&l.file, "log-file", "", "file the logs are appended to, stderr when empty")
+	return l
+}
+
+// setup installs the default logger, the returned function closes the log file
+func (l *logFlags) setup() (func() error, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(l.level))
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", l.level, err)
+	}
+
+	if l.verbose {
+		level = slog.LevelDebug
+	}
+
+	var w io.Writer = os.Stderr
+	closeLog := func() error { return nil }
+
+	if l.file != "" {
+		f, err := os.OpenFile(l.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+
+		w = f
+		closeLog = f.Close
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch l.format {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		closeLog()
+		return nil, fmt.Errorf("unknown log format %q, expected text or json", l.format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+
+	return closeLog, nil
+}
+
+// torrentLogger adds the attributes of the torrent to every log
+func torrentLogger(file *TorrentFile) *slog.Logger {
+	return slog.With("torrent", file.Info.Name, "info_hash", fmt.Sprintf("%x", file.Info.InfoHash))
+}
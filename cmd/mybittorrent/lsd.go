@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Local Service Discovery finds the peers of our torrents on the local network with multicast announces
+// https://www.bittorrent.org/beps/bep_0014.html
+const (
+	lsdIPv4Group = "239.192.152.143:6771"
+	lsdIPv6Group = "[ff15::efc0:988f]:6771"
+
+	// every torrent is announced that often while it runs
+	lsdAnnounceInterval = 5 * time.Minute
+
+	// and never more often than that, however often it's added again
+	lsdMinAnnounceInterval = time.Minute
+
+	// announces are kept under the usual MTU, the info hashes that don't fit go in another one
+	maxLSDMessageSize = 1400
+)
+
+// lsdGroup is the multicast group of one address family, the group is joined by one socket and
+// announces are sent from another so we also reach the peers running on this host
+type lsdGroup struct {
+	addr   *net.UDPAddr
+	listen *net.UDPConn
+	send   *net.UDPConn
+}
+
+// lsdService announces the torrents it's given to the local network and reports the peers announcing them
+type lsdService struct {
+	// the port we accept peers on
+	port int
+
+	// sent with every announce, so we recognize ours when the group echoes them back
+	cookie string
+
+	// called for every peer announcing one of our torrents
+	onPeer func(infoHash []byte, addr netip.AddrPort)
+
+	groups []*lsdGroup
+
+	mu sync.Mutex
+
+	// the torrents to announce, by info hash
+	torrents map[string]bool
+
+	// when every info hash was last announced, kept after a torrent is removed so pausing
+	// and resuming it doesn't get around the rate limit
+	announced map[string]time.Time
+}
+
+// newLSDService joins the groups of both address families, a family without multicast is skipped
+func newLSDService(port int, onPeer func(infoHash []byte, addr netip.AddrPort)) (*lsdService, error) {
+	cookie := make([]byte, 4)
+	_, _ = rand.Read(cookie)
+
+	l := &lsdService{
+		port:      port,
+		cookie:    hex.EncodeToString(cookie),
+		onPeer:    onPeer,
+		torrents:  make(map[string]bool),
+		announced: make(map[string]time.Time),
+	}
+
+	var errs []error
+	for _, g := range []struct{ network, addr string }{{"udp4", lsdIPv4Group}, {"udp6", lsdIPv6Group}} {
+		group, err := joinLSDGroup(g.network, g.addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", g.network, err))
+			continue
+		}
+
+		l.groups = append(l.groups, group)
+	}
+
+	if len(l.groups) == 0 {
+		return nil, fmt.Errorf("local service discovery: %w", errors.Join(errs...))
+	}
+
+	for _, err := range errs {
+		slog.Debug("local service discovery skips a family", "err", err)
+	}
+
+	return l, nil
+}
+
+func joinLSDGroup(network, address string) (*lsdGroup, error) {
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	listen, err := net.ListenMulticastUDP(network, nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	send, err := net.ListenUDP(network, nil)
+	if err != nil {
+		listen.Close()
+		return nil, err
+	}
+
+	return &lsdGroup{addr: addr, listen: listen, send: send}, nil
+}
+
+// Add announces the torrent now and then regularly, until it's removed
+func (l *lsdService) Add(infoHash []byte) {
+	l.mu.Lock()
+	l.torrents[string(infoHash)] = true
+	due := l.due(string(infoHash), time.Now())
+	l.mu.Unlock()
+
+	if due {
+		l.announce([][]byte{infoHash})
+	}
+}
+
+// due tells if the info hash may be announced, and records the announce if so
+func (l *lsdService) due(infoHash string, now time.Time) bool {
+	if now.Sub(l.announced[infoHash]) < lsdMinAnnounceInterval {
+		return false
+	}
+
+	l.announced[infoHash] = now
+	return true
+}
+
+// Remove stops announcing the torrent and ignores the peers announcing it
+func (l *lsdService) Remove(infoHash []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.torrents, string(infoHash))
+}
+
+// Run reads the announces of the other peers and announces our torrents again, until the context is canceled
+func (l *lsdService) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for _, g := range l.groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.readLoop(g)
+		}()
+	}
+
+	defer func() {
+		for _, g := range l.groups {
+			g.listen.Close()
+			g.send.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(lsdAnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+
+		l.mu.Lock()
+		var infoHashes [][]byte
+		for infoHash := range l.torrents {
+			if l.due(infoHash, now) {
+				infoHashes = append(infoHashes, []byte(infoHash))
+			}
+		}
+
+		for infoHash, last := range l.announced {
+			if !l.torrents[infoHash] && now.Sub(last) >= lsdMinAnnounceInterval {
+				delete(l.announced, infoHash)
+			}
+		}
+		l.mu.Unlock()
+
+		l.announce(infoHashes)
+	}
+}
+
+// announce sends as few messages as the info hashes fit in, to every group
+func (l *lsdService) announce(infoHashes [][]byte) {
+	for _, g := range l.groups {
+		for _, msg := range l.messages(g.addr.String(), infoHashes) {
+			_, err := g.send.WriteTo(msg, g.addr)
+			if err != nil {
+				slog.Debug("failed to send local service discovery announce", "group", g.addr, "err", err)
+			}
+		}
+	}
+}
+
+func (l *lsdService) messages(host string, infoHashes [][]byte) [][]byte {
+	header := fmt.Sprintf("BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", host, l.port)
+	trailer := fmt.Sprintf("cookie: %s\r\n\r\n\r\n", l.cookie)
+
+	var msgs [][]byte
+	var msg []byte
+	for _, infoHash := range infoHashes {
+		line := "Infohash: " + hex.EncodeToString(infoHash) + "\r\n"
+
+		if msg != nil && len(msg)+len(line)+len(trailer) > maxLSDMessageSize {
+			msgs = append(msgs, append(msg, trailer...))
+			msg = nil
+		}
+
+		if msg == nil {
+			msg = []byte(header)
+		}
+
+		msg = append(msg, line...)
+	}
+
+	if msg != nil {
+		msgs = append(msgs, append(msg, trailer...))
+	}
+
+	return msgs
+}
+
+func (l *lsdService) readLoop(g *lsdGroup) {
+	buf := make([]byte, maxLSDMessageSize)
+	for {
+		n, from, err := g.listen.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Debug("local service discovery stopped", "group", g.addr, "err", err)
+			}
+			return
+		}
+
+		port, infoHashes, cookie, err := parseLSDMessage(buf[:n])
+		if err != nil {
+			slog.Debug("invalid local service discovery announce", "from", from, "err", err)
+			continue
+		}
+
+		if cookie == l.cookie {
+			continue
+		}
+
+		src := from.AddrPort()
+		addr := netip.AddrPortFrom(src.Addr().Unmap(), port)
+
+		// a peer that just joined would otherwise wait for our next announce to find us
+		var reply [][]byte
+		for _, infoHash := range infoHashes {
+			l.mu.Lock()
+			ok := l.torrents[string(infoHash)]
+			if ok && l.due(string(infoHash), time.Now()) {
+				reply = append(reply, infoHash)
+			}
+			l.mu.Unlock()
+
+			if ok {
+				l.onPeer(infoHash, addr)
+			}
+		}
+
+		if len(reply) > 0 {
+			l.announce(reply)
+		}
+	}
+}
+
+// parseLSDMessage reads the port, info hashes and cookie of an announce, the headers are case insensitive
+func parseLSDMessage(msg []byte) (port uint16, infoHashes [][]byte, cookie string, err error) {
+	lines := strings.Split(string(bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))), "\n")
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "BT-SEARCH * HTTP/1.1") {
+		return 0, nil, "", errors.New("not a BT-SEARCH")
+	}
+
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "port":
+			p, err := strconv.ParseUint(value, 10, 16)
+			if err != nil || p == 0 {
+				return 0, nil, "", fmt.Errorf("invalid port %q", value)
+			}
+			port = uint16(p)
+
+		case "infohash":
+			infoHash, err := hex.DecodeString(value)
+			if err != nil || len(infoHash) != 20 {
+				return 0, nil, "", fmt.Errorf("invalid info hash %q", value)
+			}
+			infoHashes = append(infoHashes, infoHash)
+
+		case "cookie":
+			cookie = value
+		}
+	}
+
+	if port == 0 || len(infoHashes) == 0 {
+		return 0, nil, "", errors.New("port or info hash missing")
+	}
+
+	return port, infoHashes, cookie, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lsdPeer is a peer as a service reports it
+type lsdPeer struct {
+	infoHash []byte
+	addr     netip.AddrPort
+}
+
+// startLSDService runs a service that reports its peers on the returned channel, the test is skipped
+// when the host can't join the multicast groups
+func startLSDService(t *testing.T, port int) (*lsdService, chan lsdPeer) {
+	t.Helper()
+
+	peers := make(chan lsdPeer, 16)
+	l, err := newLSDService(port, func(infoHash []byte, addr netip.AddrPort) {
+		select {
+		case peers <- lsdPeer{infoHash: infoHash, addr: addr}:
+		default:
+		}
+	})
+	if err != nil {
+		t.Skipf("no multicast on this host: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		l.Run(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	return l, peers
+}
+
+func TestLSDRoundTrip(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	other := bytes.Repeat([]byte{0xcd}, 20)
+
+	a, fromA := startLSDService(t, 6881)
+	b, fromB := startLSDService(t, 6882)
+
+	// b only hears about the torrents it has
+	b.Add(infoHash)
+	a.Add(other)
+	a.Add(infoHash)
+
+	select {
+	case peer := <-fromB:
+		if !bytes.Equal(peer.infoHash, infoHash) || peer.addr.Port() != 6881 {
+			t.Fatalf("b found %x at %s, want %x on port 6881", peer.infoHash, peer.addr, infoHash)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("b didn't hear the announce of a")
+	}
+
+	// a may have heard b too, depending on when its torrent was added, but never itself
+	timeout := time.After(200 * time.Millisecond)
+	for {
+		select {
+		case peer := <-fromA:
+			if peer.addr.Port() != 6882 {
+				t.Fatalf("a found %x at %s", peer.infoHash, peer.addr)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func TestLSDMessages(t *testing.T) {
+	l := &lsdService{port: 6881, cookie: "c00k1e"}
+
+	var infoHashes [][]byte
+	for i := 0; i < 100; i++ {
+		infoHashes = append(infoHashes, bytes.Repeat([]byte{byte(i)}, 20))
+	}
+
+	msgs := l.messages(lsdIPv4Group, infoHashes)
+	if len(msgs) < 2 {
+		t.Fatalf("100 info hashes fit in %d messages", len(msgs))
+	}
+
+	var got [][]byte
+	for _, msg := range msgs {
+		if len(msg) > maxLSDMessageSize {
+			t.Fatalf("message of %d bytes", len(msg))
+		}
+
+		port, hashes, cookie, err := parseLSDMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if port != 6881 || cookie != "c00k1e" {
+			t.Fatalf("parsed port %d and cookie %q", port, cookie)
+		}
+
+		got = append(got, hashes...)
+	}
+
+	if len(got) != len(infoHashes) {
+		t.Fatalf("got %d info hashes back, want %d", len(got), len(infoHashes))
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], infoHashes[i]) {
+			t.Fatalf("info hash %d is %x, want %x", i, got[i], infoHashes[i])
+		}
+	}
+}
+
+func TestParseLSDMessage(t *testing.T) {
+	infoHash := strings.Repeat("ab", 20)
+
+	tests := []struct {
+		name  string
+		msg   string
+		valid bool
+	}{
+		{name: "announce", msg: "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6881\r\nInfohash: " + infoHash + "\r\n\r\n\r\n", valid: true},
+		{name: "lower case headers", msg: "BT-SEARCH * HTTP/1.1\r\nhost: x\r\nport: 6881\r\ninfohash: " + infoHash + "\r\n\r\n\r\n", valid: true},
+		{name: "bare newlines", msg: "BT-SEARCH * HTTP/1.1\nPort: 6881\nInfohash: " + infoHash + "\n\n\n", valid: true},
+		{name: "another method", msg: "M-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: " + infoHash + "\r\n\r\n\r\n"},
+		{name: "no port", msg: "BT-SEARCH * HTTP/1.1\r\nInfohash: " + infoHash + "\r\n\r\n\r\n"},
+		{name: "port zero", msg: "BT-SEARCH * HTTP/1.1\r\nPort: 0\r\nInfohash: " + infoHash + "\r\n\r\n\r\n"},
+		{name: "no info hash", msg: "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n\r\n"},
+		{name: "short info hash", msg: "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: abcd\r\n\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		_, _, _, err := parseLSDMessage([]byte(tt.msg))
+		if tt.valid && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
+
+func TestLSDRateLimit(t *testing.T) {
+	l := &lsdService{announced: make(map[string]time.Time)}
+	now := time.Now()
+
+	if !l.due("torrent", now) {
+		t.Fatal("first announce isn't due")
+	}
+	if l.due("torrent", now.Add(lsdMinAnnounceInterval/2)) {
+		t.Fatal("announce is due again before the minimum interval")
+	}
+	if !l.due("torrent", now.Add(lsdMinAnnounceInterval)) {
+		t.Fatal("announce isn't due after the minimum interval")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// without a DHT the trackers of the link are the only place to find the peers that have the metadata
+var errMagnetWithoutTrackers = errors.New("magnet link without trackers, add the .torrent file instead")
+
+// bounds finding the peers of a magnet link and fetching the metadata from them
+const metadataTimeout = 2 * time.Minute
+
+// magnetLink is the content of a magnet URI like magnet:?xt=urn:btih:<info hash>&dn=<name>&tr=<tracker>
+type magnetLink struct {
+	InfoHash []byte
+
+	// display name, may be empty
+	Name string
+
+	Trackers []string
+}
+
+func parseMagnet(uri string) (*magnetLink, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("not a magnet link: %s", uri)
+	}
+
+	q := u.Query()
+	link := &magnetLink{
+		Name:     q.Get("dn"),
+		Trackers: q["tr"],
+	}
+
+	for _, xt := range q["xt"] {
+		hash, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+
+		// the info hash is either 40 hex characters or 32 base32 characters
+		switch len(hash) {
+		case 40:
+			link.InfoHash, err = hex.DecodeString(hash)
+		case 32:
+			link.InfoHash, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+		default:
+			err = fmt.Errorf("info hash %q has the wrong length", hash)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid magnet link: %w", err)
+		}
+
+		return link, nil
+	}
+
+	return nil, fmt.Errorf("magnet link without a btih info hash: %s", uri)
+}
+
+// ResolveMagnet asks the trackers of the magnet link for its peers and fetches the info dictionary of
+// the torrent from them. The torrent that is returned announces to the trackers of the link.
+func (s *Session) ResolveMagnet(ctx context.Context, link *magnetLink) (*TorrentFile, error) {
+	if len(link.Trackers) == 0 {
+		return nil, errMagnetWithoutTrackers
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+
+	seen := make(map[netip.AddrPort]bool)
+	var peers []*Peer
+	var errs []error
+
+	for _, tracker := range link.Trackers {
+		stub := &TorrentFile{
+			Announce: tracker,
+			Info:     Info{Name: link.Name, InfoHash: link.InfoHash},
+		}
+
+		// the size of the torrent isn't known yet, anything but zero keeps us from looking like a seed
+		resp, err := s.tracker.Announce(ctx, stub, DiscoverPeersRequest{
+			Event: eventStarted,
+			Stats: announceStats{Left: 1},
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, peer := range resp.peers {
+			if !seen[peer.addr] {
+				seen[peer.addr] = true
+				peers = append(peers, peer)
+			}
+		}
+	}
+
+	if len(peers) == 0 {
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("no peers for the magnet link: %w", errors.Join(errs...))
+		}
+		return nil, fmt.Errorf("%w, the trackers know no peers", errNoMetadata)
+	}
+
+	metadata, err := fetchMetadata(ctx, s.dialer, s.peerID, link.InfoHash, peers)
+	if err != nil {
+		return nil, err
+	}
+
+	return torrentFromMetadata(link, metadata)
+}
@@ -5,12 +5,19 @@ import (
 	// "encoding/json"
 	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 
 	bencode "github.com/jackpal/bencode-go" // Available if you need it!
 )
@@ -18,7 +25,7 @@ import (
 func main() {
 	err := run()
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
@@ -30,18 +37,63 @@ const (
 	commandHandshake     = "handshake"
 	commandDownloadPiece = "download_piece"
 	commandDownload      = "download"
+	commandSeed          = "seed"
+	commandFiles         = "files"
+	commandStream        = "stream"
+	commandDaemon        = "daemon"
+	commandCtl           = "ctl"
+	commandTracker       = "tracker"
 )
 
 func run() error {
 	// You can use print statements as follows for debugging, they'll be visible when running tests.
 	// fmt.Println("Logs from your program will appear here!")
 
-	command := os.Args[1]
+	fs := flag.NewFlagSet("mybittorrent", flag.ExitOnError)
+	logging := addLogFlags(fs)
+	peerID := fs.String("peer-id", "", "id to introduce ourselves with, as 20 characters or 40 hex digits, random when empty")
+	proxy := addProxyFlags(fs)
+	tracker := addTrackerFlags(fs)
+	fs.Parse(os.Args[1:])
+
+	if fs.NArg() == 0 {
+		return errors.New("usage: mybittorrent [-v] [-log-level level] [-log-format text|json] [-log-file path] [-peer-id id] [-proxy url] [-proxy-only] [-tracker-proxy url] [-tracker-timeout duration] [-user-agent agent] [-numwant n] <command> [arguments]")
+	}
+
+	if *peerID != "" {
+		id, err := parsePeerID(*peerID)
+		if err != nil {
+			return err
+		}
+
+		setLocalPeerID(id)
+	}
+
+	err := proxy.apply()
+	if err != nil {
+		return err
+	}
+
+	err = tracker.apply()
+	if err != nil {
+		return err
+	}
+
+	closeLog, err := logging.setup()
+	if err != nil {
+		return err
+	}
+
+	defer closeLog()
+
+	// args[0] is the command
+	args := fs.Args()
+	command := args[0]
 
 	switch command {
 	case commandDecode:
 
-		bencodedValue := os.Args[2]
+		bencodedValue := args[1]
 
 		reader := bytes.NewReader([]byte(bencodedValue))
 
@@ -54,28 +106,38 @@ func run() error {
 		fmt.Println(string(jsonOutput))
 
 	case commandInfo:
-		filePath := os.Args[2]
-
-		err := InfoCmd(filePath)
-		if err != nil {
-			return err
-		}
+		return InfoCmd(args[1:])
 
 	case commandPeers:
-		filePath := os.Args[2]
-
-		return PeersCmd(filePath)
+		return PeersCmd(args[1:])
 
 	case commandHandshake:
-		filePath := os.Args[2]
-		peer := os.Args[3]
-		return HandshakeCmd(filePath, peer)
+		return HandshakeCmd(args[1:])
 
 	case commandDownloadPiece:
-		return DownloadPieceCmd(os.Args[2:])
+		return DownloadPieceCmd(args[1:])
 
 	case commandDownload:
-		return DownloadCmd(os.Args[2:])
+		return DownloadCmd(args[1:])
+
+	case commandSeed:
+		return SeedCmd(args[1:])
+
+	case commandFiles:
+		return FilesCmd(args[1:])
+
+	case commandStream:
+		return StreamCmd(args[1:])
+
+	case commandDaemon:
+		return DaemonCmd(args[1:])
+
+	case commandCtl:
+		return CtlCmd(args[1:])
+
+	case commandTracker:
+		return TrackerCmd(args[1:])
+
 	default:
 		return fmt.Errorf("unknown command %s", command)
 	}
@@ -83,30 +145,46 @@ func run() error {
 	return nil
 }
 
-func InfoCmd(filePath string) error {
+func InfoCmd(args []string) error {
 
-	file, err := NewTorrentFile(filePath)
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	output := addOutputFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: info [-json] <torrent file>")
+	}
+
+	file, err := NewTorrentFile(fs.Arg(0))
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Tracker URL: %+v\n", file.Announce)
-	fmt.Printf("Length: %+v\n", file.Info.Length)
+	return output.print(newTorrentInfoJSON(file), func() {
+		fmt.Printf("Tracker URL: %+v\n", file.Announce)
+		fmt.Printf("Length: %+v\n", file.Info.Length)
 
-	// info hash in hex
-	fmt.Printf("Info Hash: %x\n", file.Info.InfoHash)
-	fmt.Printf("Piece Length: %+v\n", file.Info.PieceLength)
-	fmt.Printf("Piece Hashes:\n")
-	for _, pieceHash := range file.Info.PiecesHash {
-		fmt.Println(pieceHash)
-	}
-
-	return nil
+		// info hash in hex
+		fmt.Printf("Info Hash: %x\n", file.Info.InfoHash)
+		fmt.Printf("Piece Length: %+v\n", file.Info.PieceLength)
+		fmt.Printf("Piece Hashes:\n")
+		for _, pieceHash := range file.Info.PiecesHash {
+			fmt.Println(pieceHash)
+		}
+	})
 }
 
-func PeersCmd(filePath string) error {
+func PeersCmd(args []string) error {
 
-	file, err := NewTorrentFile(filePath)
+	fs := flag.NewFlagSet("peers", flag.ExitOnError)
+	output := addOutputFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: peers [-json] <torrent file>")
+	}
+
+	file, err := NewTorrentFile(fs.Arg(0))
 	if err != nil {
 		return err
 	}
@@ -116,15 +194,29 @@ func PeersCmd(filePath string) error {
 		return err
 	}
 
-	for _, peer := range resp.peers {
-		fmt.Printf("%s:%d\n", peer.ipAddr, peer.port)
+	peers := make([]peerAddrJSON, len(resp.peers))
+	for i, peer := range resp.peers {
+		peers[i] = peerAddrJSON{IP: peer.addr.Addr().String(), Port: peer.addr.Port()}
 	}
-	return nil
+
+	return output.print(peers, func() {
+		for _, peer := range resp.peers {
+			fmt.Println(peer)
+		}
+	})
 }
 
-func HandshakeCmd(filePath string, peerInfo string) error {
+func HandshakeCmd(args []string) error {
 
-	file, err := NewTorrentFile(filePath)
+	fs := flag.NewFlagSet("handshake", flag.ExitOnError)
+	output := addOutputFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: handshake [-json] <torrent file> <peer ip>:<port>")
+	}
+
+	file, err := NewTorrentFile(fs.Arg(0))
 	if err != nil {
 		return err
 	}
@@ -134,47 +226,63 @@ func HandshakeCmd(filePath string, peerInfo string) error {
 		return err
 	}
 
-	peerAddr := strings.Split(peerInfo, ":")[0]
-
-	peerPort, err := strconv.Atoi(strings.Split(peerInfo, ":")[1])
+	// IPv6 peers are written as [address]:port
+	peerAddr, err := netip.ParseAddrPort(fs.Arg(1))
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid peer address: %w", err)
 	}
 
-	var desiredPeer *Peer
+	// the tracker may not list the peer, it can still be reached
+	desiredPeer := NewPeer(peerAddr)
 	for _, peer := range resp.peers {
-		if peer.ipAddr == peerAddr && peer.port == uint16(peerPort) {
+		if peer.addr == desiredPeer.addr {
 			desiredPeer = peer
 			break
 		}
 	}
 
+	desiredPeer.numPieces = len(file.Info.PiecesHash)
+
 	// Open a connection to the peer
-	err = desiredPeer.Connect(file.Info.InfoHash)
+	err = desiredPeer.Connect(context.Background(), file.Info.InfoHash)
 	if err != nil {
 		return err
 	}
 
 	defer desiredPeer.Close()
 
-	fmt.Printf("Peer ID: %x\n", string(desiredPeer.handshake.PeerID))
-	return nil
+	h := desiredPeer.handshake
+	result := handshakeJSON{
+		IP:         desiredPeer.addr.Addr().String(),
+		Port:       desiredPeer.addr.Port(),
+		PeerID:     hex.EncodeToString(h.PeerID),
+		Reserved:   hex.EncodeToString(h.Reserved[:]),
+		Extensions: h.Extensions(),
+	}
+
+	return output.print(result, func() {
+		fmt.Printf("Peer ID: %x\n", string(h.PeerID))
+	})
 }
 
 func DownloadPieceCmd(args []string) error {
 
 	fs := flag.NewFlagSet("download_piece", flag.ExitOnError)
 	pieceFile := fs.String("o", "", "path to where to save the piece")
+	transport := fs.String("transport", "prefer-tcp", "how to connect to peers: prefer-tcp, prefer-utp, tcp or utp")
 	fs.Parse(args)
 
+	policy, err := parseTransportPolicy(*transport)
+	if err != nil {
+		return err
+	}
+
 	filePath := args[len(args)-2]
 	pieceNum, err := strconv.Atoi(args[len(args)-1])
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("filePath", filePath)
-
 	file, err := NewTorrentFile(filePath)
 	if err != nil {
 		return err
@@ -187,9 +295,11 @@ func DownloadPieceCmd(args []string) error {
 
 	// At this point all the peers contains all the pieces
 	desiredPeer := resp.peers[0]
+	desiredPeer.dialer = newPeerDialer(policy)
+	desiredPeer.numPieces = len(file.Info.PiecesHash)
 
 	// Open a connection to the peer
-	err = desiredPeer.Connect(file.Info.InfoHash)
+	err = desiredPeer.Connect(context.Background(), file.Info.InfoHash)
 	if err != nil {
 		return err
 	}
@@ -207,9 +317,24 @@ func DownloadPieceCmd(args []string) error {
 func DownloadCmd(args []string) error {
 
 	fs := flag.NewFlagSet("download", flag.ExitOnError)
-	pathToFile := fs.String("o", "", "path to where to save the torrent file")
+	pathToFile := fs.String("o", "", "path to where to save the torrent file, the directory for multi-file torrents")
+	transport := fs.String("transport", "prefer-tcp", "how to connect to peers: prefer-tcp, prefer-utp, tcp or utp")
+	selection := fs.String("files", "", "comma separated file indexes or globs to download, all files when empty")
+	var priorities stringsFlag
+	fs.Var(&priorities, "priority", "file priority as <file index or glob>=<skip|low|normal|high>, can be repeated")
+	preallocate := fs.Bool("preallocate", false, "create the files at their full size before downloading")
+	jsonProgress := fs.Bool("json-progress", false, "print the progress as JSON objects, one per line")
+	maxPeers := fs.Int("max-peers", defaultMaxPeers, "maximum number of peers to download from at the same time, 0 for unlimited")
+	limits := addRateFlags(fs)
 	fs.Parse(args)
 
+	limits.apply()
+
+	policy, err := parseTransportPolicy(*transport)
+	if err != nil {
+		return err
+	}
+
 	filePath := args[len(args)-1]
 
 	file, err := NewTorrentFile(filePath)
@@ -217,41 +342,362 @@ func DownloadCmd(args []string) error {
 		return err
 	}
 
-	resp, err := file.DiscoverPeers(context.Background())
+	filePriorities, err := fileSelection(&file.Info, *selection, priorities)
 	if err != nil {
 		return err
 	}
 
-	desiredPeer := resp.peers[1]
+	wanted := piecePriorities(&file.Info, filePriorities)
 
-	// Open a connection to the peer
-	err = desiredPeer.Connect(file.Info.InfoHash)
+	// bytes of the wanted pieces, and how many of them were downloaded, for the tracker
+	var wantedBytes int64
+	var downloaded atomic.Int64
+	for i := range file.Info.PiecesHash {
+		if wanted[i] != prioritySkip {
+			wantedBytes += file.Info.PieceSize(i)
+		}
+	}
+
+	newStorage := newFileStorage
+	if *preallocate {
+		newStorage = newSparseFileStorage
+	}
+
+	storage, err := newStorage(&file.Info, *pathToFile, filePriorities)
 	if err != nil {
-		return fmt.Errorf("failed to connect to peer: %w", err)
+		return err
 	}
 
-	defer desiredPeer.Close()
+	defer storage.Close()
+
+	progress := newFileProgress(&file.Info)
+	var progressMu sync.Mutex
+
+	peers := newPeerSet()
+
+	mode := progressStyle(os.Stdout, *jsonProgress)
+	reporter := newProgressReporter(&file.Info, os.Stdout, mode, wanted)
+	reporter.peers = func() int { return len(peers.List()) }
+
+	d := newDownloader(file, storage)
+	d.conns.maxPeers = *maxPeers
+	d.peers = peers
+	d.onPiece = func(pieceIndex int) {
+		reporter.PieceDone(pieceIndex)
+
+		if wanted[pieceIndex] != prioritySkip {
+			downloaded.Add(file.Info.PieceSize(pieceIndex))
+		}
+
+		progressMu.Lock()
+		defer progressMu.Unlock()
+
+		for _, fileIndex := range progress.Add(pieceIndex) {
+			if filePriorities[fileIndex] == prioritySkip {
+				continue
+			}
+
+			d.log.Debug("file progress", "file", fileIndex, "path", file.Info.Files[fileIndex].DisplayPath(), "percent", progress.Percent(fileIndex))
+		}
+	}
+	d.picker.SetPriorities(wanted)
+	d.dialer = newPeerDialer(policy)
+	d.peerUploadRate = int64(limits.peerUpload)
+	d.peerDownloadRate = int64(limits.peerDownload)
+
+	// an interrupt still tells the tracker we stopped
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	announcer := newAnnouncer(defaultTracker, file, func() announceStats {
+		n := downloaded.Load()
+		return announceStats{Downloaded: n, Left: wantedBytes - n}
+	}, torrentLogger(file))
+
+	// the peers of the next announces join the download
+	announcer.onPeers = d.AddPeers
+
+	initialPeers, err := announcer.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	announceCtx, stopAnnounce := context.WithCancel(ctx)
+	announceDone := make(chan struct{})
+	go func() {
+		defer close(announceDone)
+		announcer.Run(announceCtx)
+	}()
+
+	// sends stopped, after completed when the download succeeded
+	defer func() {
+		stopAnnounce()
+		<-announceDone
+	}()
+
+	reporter.Start()
+
+	err = d.Run(ctx, initialPeers)
+	if err == nil {
+		announcer.Completed()
+		err = storage.Close()
+	}
 
-	fmt.Println("pieces len:", len(file.Info.Pieces))
-	pieces := make([]byte, 0, file.Info.Length)
-	for pieceIndex := range file.Info.PiecesHash {
-		piece, err := desiredPeer.DownloadPiece(context.Background(), file, pieceIndex)
+	reporter.Finish(*pathToFile, err)
+	if err != nil {
+		return err
+	}
+
+	// the complete event already tells the wrappers where the torrent is
+	if mode != progressJSON {
+		fmt.Println("Save torrent file:", *pathToFile)
+	}
+
+	return nil
+}
+
+func FilesCmd(args []string) error {
+
+	fs := flag.NewFlagSet("files", flag.ExitOnError)
+	output := addOutputFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: files [-json] <torrent file>")
+	}
+
+	file, err := NewTorrentFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	return output.print(newFilesJSON(&file.Info), func() {
+		for i, f := range file.Info.Files {
+			fmt.Printf("%d\t%d\t%s\n", i, f.Length, f.DisplayPath())
+		}
+	})
+}
+
+func SeedCmd(args []string) error {
+
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	listenAddr := fs.String("listen", ":6881", "address to accept peers on, over TCP and uTP")
+	limits := addRateFlags(fs)
+	fs.Parse(args)
+
+	limits.apply()
+
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: seed [flags] <torrent file> <downloaded file or directory>")
+	}
+
+	file, err := NewTorrentFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	for i, f := range file.Info.Files {
+		filePath := outputPath(&file.Info, fs.Arg(1), i)
+
+		stat, err := os.Stat(filePath)
 		if err != nil {
 			return err
 		}
 
-		fmt.Println("downloaded piece:", pieceIndex)
+		if stat.Size() != f.Length {
+			return fmt.Errorf("expected %s to have %d bytes, got %d", filePath, f.Length, stat.Size())
+		}
+	}
+
+	storage, err := newFileStorage(&file.Info, fs.Arg(1), nil)
+	if err != nil {
+		return err
+	}
+
+	defer storage.Close()
 
-		pieces = append(pieces, piece...)
+	s := newSeeder(file, storage)
+	s.peerUploadRate = int64(limits.peerUpload)
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	tcpListener, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		return err
 	}
 
-	err = os.WriteFile(*pathToFile, pieces, 0755)
+	utpListener, err := ListenUTP(*listenAddr)
 	if err != nil {
+		tcpListener.Close()
 		return err
 	}
 
-	fmt.Println("Save torrent file:", *pathToFile)
+	s.log.Info("seeding", "addr", tcpListener.Addr())
 
-	return nil
+	errCh := make(chan error, 2)
+	go func() { errCh <- s.Serve(ctx, tcpListener) }()
+	go func() { errCh <- s.Serve(ctx, utpListener) }()
+
+	return errors.Join(<-errCh, <-errCh)
+}
+
+func StreamCmd(args []string) error {
+
+	fs := flag.NewFlagSet("stream", flag.ExitOnError)
+	pathToFile := fs.String("o", "", "path to where to save the torrent, defaults to its name")
+	listenAddr := fs.String("listen", "127.0.0.1:8080", "address of the HTTP server serving the file")
+	selector := fs.String("file", "0", "index or glob of the file to stream")
+	readahead := fs.Int("readahead", defaultReadahead, "number of pieces after the read position that are downloaded first")
+	transport := fs.String("transport", "prefer-tcp", "how to connect to peers: prefer-tcp, prefer-utp, tcp or utp")
+	maxPeers := fs.Int("max-peers", defaultMaxPeers, "maximum number of peers to download from at the same time, 0 for unlimited")
+	limits := addRateFlags(fs)
+	fs.Parse(args)
+
+	limits.apply()
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: stream [flags] <torrent file>")
+	}
+
+	policy, err := parseTransportPolicy(*transport)
+	if err != nil {
+		return err
+	}
+
+	file, err := NewTorrentFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	matches, err := matchFiles(&file.Info, *selector)
+	if err != nil {
+		return err
+	}
+	fileIndex := matches[0]
+
+	// only the streamed file is downloaded
+	wanted := make([]filePriority, len(file.Info.Files))
+	wanted[fileIndex] = priorityNormal
+
+	// bytes of the pieces of the file, and how many of them were downloaded, for the tracker
+	pieceWanted := piecePriorities(&file.Info, wanted)
+	var wantedBytes int64
+	var downloaded atomic.Int64
+	for i := range file.Info.PiecesHash {
+		if pieceWanted[i] != prioritySkip {
+			wantedBytes += file.Info.PieceSize(i)
+		}
+	}
+
+	out := *pathToFile
+	if out == "" {
+		out = file.Info.Name
+	}
+
+	storage, err := newFileStorage(&file.Info, out, wanted)
+	if err != nil {
+		return err
+	}
+
+	defer storage.Close()
+
+	d := newDownloader(file, storage)
+	d.conns.maxPeers = *maxPeers
+	d.dialer = newPeerDialer(policy)
+	d.peerUploadRate = int64(limits.peerUpload)
+	d.peerDownloadRate = int64(limits.peerDownload)
+
+	stream := newTorrentStream(&file.Info, storage, d.picker, fileIndex)
+	stream.readahead = *readahead
+	d.onPiece = func(pieceIndex int) {
+		if pieceWanted[pieceIndex] != prioritySkip {
+			downloaded.Add(file.Info.PieceSize(pieceIndex))
+		}
+
+		stream.PieceDone(pieceIndex)
+	}
+
+	// an interrupt still tells the tracker we stopped
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	announcer := newAnnouncer(defaultTracker, file, func() announceStats {
+		n := downloaded.Load()
+		return announceStats{Downloaded: n, Left: wantedBytes - n}
+	}, torrentLogger(file))
+
+	// the peers of the next announces join the download
+	announcer.onPeers = d.AddPeers
+
+	initialPeers, err := announcer.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	announceCtx, stopAnnounce := context.WithCancel(ctx)
+	announceDone := make(chan struct{})
+	go func() {
+		defer close(announceDone)
+		announcer.Run(announceCtx)
+	}()
+
+	// sends stopped, after completed when the file was downloaded
+	defer func() {
+		stopAnnounce()
+		<-announceDone
+	}()
+
+	go func() {
+		err := d.Run(ctx, initialPeers)
+		if err != nil {
+			d.log.Error("download failed", "err", err)
+			stream.Fail(err)
+			return
+		}
+
+		announcer.Completed()
+		d.log.Info("download complete")
+	}()
+
+	server := &http.Server{
+		Addr:    *listenAddr,
+		Handler: stream,
+	}
+
+	context.AfterFunc(ctx, func() {
+		server.Close()
+	})
+
+	fmt.Printf("streaming %s at http://%s/\n", file.Info.Files[fileIndex].DisplayPath(), *listenAddr)
+
+	err = server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// rateFlags are the bandwidth limit flags shared by the transfer commands
+type rateFlags struct {
+	upload       rateFlag
+	download     rateFlag
+	peerUpload   rateFlag
+	peerDownload rateFlag
+}
+
+func addRateFlags(fs *flag.FlagSet) *rateFlags {
+	limits := &rateFlags{}
+	fs.Var(&limits.upload, "upload-rate", "maximum upload rate in bytes per second, accepts K, M and G suffixes, 0 for unlimited")
+	fs.Var(&limits.download, "download-rate", "maximum download rate in bytes per second, accepts K, M and G suffixes, 0 for unlimited")
+	fs.Var(&limits.peerUpload, "peer-upload-rate", "maximum upload rate to a single peer")
+	fs.Var(&limits.peerDownload, "peer-download-rate", "maximum download rate from a single peer")
+	return limits
+}
+
+// apply sets the global limits, the peer limits are applied per connection
+func (r *rateFlags) apply() {
+	globalBandwidth.upload.SetLimit(int64(r.upload))
+	globalBandwidth.download.SetLimit(int64(r.download))
 }
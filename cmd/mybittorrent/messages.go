@@ -1,5 +1,7 @@
 package main
 
+import "fmt"
+
 // https://www.bittorrent.org/beps/bep_0003.html#peer-messages
 const (
 	messageIDChoke = iota
@@ -12,3 +14,46 @@ const (
 	messageIDPiece
 	messageIDCancel
 )
+
+// Fast extension
+// https://www.bittorrent.org/beps/bep_0006.html
+const (
+	messageIDSuggestPiece  = 0x0D
+	messageIDHaveAll       = 0x0E
+	messageIDHaveNone      = 0x0F
+	messageIDRejectRequest = 0x10
+	messageIDAllowedFast   = 0x11
+)
+
+// Extension protocol, the messages of the extensions are all sent with the same id
+// https://www.bittorrent.org/beps/bep_0010.html
+const (
+	messageIDExtended = 0x14
+)
+
+var messageNames = map[byte]string{
+	messageIDChoke:         "choke",
+	messageIDUnchoke:       "unchoke",
+	messageIDInterested:    "interested",
+	messageIDNotInterested: "not_interested",
+	messageIDHave:          "have",
+	messageIDBitfield:      "bitfield",
+	messageIDRequest:       "request",
+	messageIDPiece:         "piece",
+	messageIDCancel:        "cancel",
+	messageIDSuggestPiece:  "suggest_piece",
+	messageIDHaveAll:       "have_all",
+	messageIDHaveNone:      "have_none",
+	messageIDRejectRequest: "reject_request",
+	messageIDAllowedFast:   "allowed_fast",
+	messageIDExtended:      "extended",
+}
+
+// messageName is used in the logs, unknown ids are logged as numbers
+func messageName(id byte) string {
+	if name, ok := messageNames[id]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("unknown(%d)", id)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// The info dictionary of a magnet link is fetched from the peers with the metadata extension,
+// in pieces of 16 KiB, over the extension protocol.
+// https://www.bittorrent.org/beps/bep_0009.html
+// https://www.bittorrent.org/beps/bep_0010.html
+
+const (
+	// the extended message that is the handshake of the extension protocol
+	extendedHandshakeID = 0
+
+	// the id the peers send us ut_metadata messages with, we tell them in our extended handshake
+	localMetadataID = 1
+
+	metadataPieceSize = 16 * 1024
+
+	// far above the info dictionary of any real torrent, protects us from allocating whatever the peer claims
+	maxMetadataSize = 16 << 20
+
+	// peers that are asked for the metadata at the same time
+	metadataFetchers = 4
+
+	// bounds the fetch from a single peer, a slow one shouldn't hold a fetcher for long
+	metadataPeerTimeout = 30 * time.Second
+)
+
+// the types of the ut_metadata messages
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+var (
+	errNoMetadata       = errors.New("no peer sent the metadata")
+	errMetadataMismatch = errors.New("metadata doesn't match the info hash")
+)
+
+// fetchMetadata asks the peers for the info dictionary of the torrent, a few at a time, until one
+// of them sends a dictionary that hashes to the info hash
+func fetchMetadata(ctx context.Context, dialer *peerDialer, peerID, infoHash []byte, peers []*Peer) ([]byte, error) {
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	addrs := make(chan netip.AddrPort)
+	go func() {
+		defer close(addrs)
+
+		for _, peer := range peers {
+			select {
+			case addrs <- peer.addr:
+			case <-fetchCtx.Done():
+				return
+			}
+		}
+	}()
+
+	results := make(chan []byte, 1)
+
+	var mu sync.Mutex
+	var lastErr error
+
+	var wg sync.WaitGroup
+	for i := 0; i < metadataFetchers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for addr := range addrs {
+				metadata, err := fetchMetadataFrom(fetchCtx, dialer, addr, peerID, infoHash)
+				if err != nil {
+					slog.Debug("failed to fetch the metadata", "peer", addr, "err", err)
+
+					mu.Lock()
+					lastErr = err
+					mu.Unlock()
+					continue
+				}
+
+				// the first one wins, the others are stopped
+				select {
+				case results <- metadata:
+				default:
+				}
+				cancel()
+				return
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	metadata, ok := <-results
+	if ok {
+		return metadata, nil
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if lastErr == nil {
+		return nil, errNoMetadata
+	}
+
+	return nil, fmt.Errorf("%w, the last one failed with: %w", errNoMetadata, lastErr)
+}
+
+// fetchMetadataFrom connects to a peer only to fetch the metadata
+func fetchMetadataFrom(ctx context.Context, dialer *peerDialer, addr netip.AddrPort, peerID, infoHash []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, metadataPeerTimeout)
+	defer cancel()
+
+	conn, err := dialer.DialContext(ctx, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return requestMetadata(ctx, newRateLimitedConn(conn, globalBandwidth), peerID, infoHash)
+}
+
+// requestMetadata does the handshakes on the connection, then requests every piece of the metadata
+// in turn. The metadata is only returned when it hashes to the info hash.
+func requestMetadata(ctx context.Context, conn net.Conn, peerID, infoHash []byte) ([]byte, error) {
+	var metadata []byte
+
+	err := withDeadline(ctx, conn, func() error {
+		h := &Handshake{InfoHash: infoHash, PeerID: peerID}
+		h.Reserved[5] |= reservedExtensionProtocol
+
+		_, err := conn.Write(h.Bytes())
+		if err != nil {
+			return err
+		}
+
+		theirs, err := readHandshake(conn)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(theirs.InfoHash, infoHash) {
+			return fmt.Errorf("peer answered with info hash %x", theirs.InfoHash)
+		}
+
+		if isSelf(theirs, peerID) {
+			return errSelfConnection
+		}
+
+		if theirs.Reserved[5]&reservedExtensionProtocol == 0 {
+			return errors.New("peer doesn't support the extension protocol")
+		}
+
+		err = writeExtended(conn, extendedHandshakeID, map[string]any{
+			"m": map[string]any{"ut_metadata": int64(localMetadataID)},
+		})
+		if err != nil {
+			return err
+		}
+
+		// the other messages of the peer, like its bitfield, are skipped until its extended handshake
+		var payload []byte
+		for {
+			id, p, err := readExtended(conn)
+			if err != nil {
+				return err
+			}
+
+			if id == extendedHandshakeID {
+				payload = p
+				break
+			}
+		}
+
+		handshake, _, err := decodeDict(payload)
+		if err != nil {
+			return fmt.Errorf("invalid extended handshake: %w", err)
+		}
+
+		// the id the peer wants the ut_metadata messages with, missing or zero when it doesn't have the extension
+		m, _ := handshake["m"].(map[string]any)
+		remoteID, _ := m["ut_metadata"].(int64)
+		if remoteID <= 0 || remoteID > 255 {
+			return errors.New("peer doesn't support the metadata extension")
+		}
+
+		size, _ := handshake["metadata_size"].(int64)
+		if size <= 0 || size > maxMetadataSize {
+			return fmt.Errorf("peer has metadata of %d bytes", size)
+		}
+
+		metadata = make([]byte, 0, size)
+		for piece := int64(0); piece*metadataPieceSize < size; piece++ {
+			err := writeExtended(conn, byte(remoteID), map[string]any{
+				"msg_type": int64(metadataRequest),
+				"piece":    piece,
+			})
+			if err != nil {
+				return err
+			}
+
+			data, err := readMetadataPiece(conn, piece)
+			if err != nil {
+				return err
+			}
+
+			if want := min(metadataPieceSize, size-piece*metadataPieceSize); int64(len(data)) != want {
+				return fmt.Errorf("piece %d of the metadata has %d bytes, want %d", piece, len(data), want)
+			}
+
+			metadata = append(metadata, data...)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum(metadata)
+	if !bytes.Equal(hash[:], infoHash) {
+		return nil, errMetadataMismatch
+	}
+
+	return metadata, nil
+}
+
+// readMetadataPiece waits for the answer to the request of a piece of the metadata
+func readMetadataPiece(conn net.Conn, piece int64) ([]byte, error) {
+	for {
+		id, payload, err := readExtended(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if id != localMetadataID {
+			continue
+		}
+
+		header, n, err := decodeDict(payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata message: %w", err)
+		}
+
+		msgType, _ := header["msg_type"].(int64)
+		index, _ := header["piece"].(int64)
+
+		// the requests of the peer aren't answered, we don't have the metadata either
+		if msgType == metadataRequest || index != piece {
+			continue
+		}
+
+		switch msgType {
+		case metadataReject:
+			return nil, fmt.Errorf("peer rejected piece %d of the metadata", piece)
+		case metadataData:
+			return payload[n:], nil
+		}
+	}
+}
+
+// writeExtended sends a message of the extension protocol with a bencoded dictionary
+func writeExtended(conn net.Conn, id byte, dict map[string]any) error {
+	var buf bytes.Buffer
+
+	// the length is filled in once the dictionary is encoded
+	buf.Write([]byte{0, 0, 0, 0, messageIDExtended, id})
+
+	err := bencode.Marshal(&buf, dict)
+	if err != nil {
+		return err
+	}
+
+	msg := buf.Bytes()
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)-4))
+
+	_, err = conn.Write(msg)
+	return err
+}
+
+// readExtended returns the next message of the extension protocol, the other messages are skipped
+func readExtended(conn net.Conn) (byte, []byte, error) {
+	lengthBuf := make([]byte, 4)
+
+	for {
+		_, err := io.ReadFull(conn, lengthBuf)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		messageSize := binary.BigEndian.Uint32(lengthBuf)
+
+		// keep-alive
+		if messageSize == 0 {
+			continue
+		}
+
+		if messageSize > maxMessageSize {
+			return 0, nil, fmt.Errorf("message of %d bytes is too large", messageSize)
+		}
+
+		msg := make([]byte, messageSize)
+		_, err = io.ReadFull(conn, msg)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if msg[0] != messageIDExtended {
+			continue
+		}
+
+		if len(msg) < 2 {
+			return 0, nil, errors.New("extended message without an id")
+		}
+
+		return msg[1], msg[2:], nil
+	}
+}
+
+// decodeDict decodes the bencoded dictionary at the start of b and returns its length, the data
+// messages of ut_metadata carry the piece right after it
+func decodeDict(b []byte) (map[string]any, int, error) {
+	r := bytes.NewReader(b)
+	br := bufio.NewReader(r)
+
+	value, err := bencode.Decode(br)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	dict, ok := value.(map[string]any)
+	if !ok {
+		return nil, 0, errors.New("not a dictionary")
+	}
+
+	return dict, len(b) - r.Len() - br.Buffered(), nil
+}
+
+// torrentFromMetadata makes the torrent of a magnet link, announcing to the trackers of the link
+func torrentFromMetadata(link *magnetLink, metadata []byte) (*TorrentFile, error) {
+	info, err := bencode.Decode(bytes.NewReader(metadata))
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+
+	// the trackers of a magnet link are all as good as each other, so they share a tier
+	tier := make([]any, len(link.Trackers))
+	for i, tracker := range link.Trackers {
+		tier[i] = tracker
+	}
+
+	var buf bytes.Buffer
+	err = bencode.Marshal(&buf, map[string]any{
+		"announce":      link.Trackers[0],
+		"announce-list": []any{tier},
+		"info":          info,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := ParseTorrentFile(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// the info hash of a torrent is computed from the dictionary encoded again
+	if !bytes.Equal(file.Info.InfoHash, link.InfoHash) {
+		return nil, fmt.Errorf("%w once it's encoded again", errMetadataMismatch)
+	}
+
+	return file, nil
+}
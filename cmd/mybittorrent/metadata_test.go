@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// testMetadata is the info dictionary of a torrent large enough to take two pieces of metadata
+func testMetadata(t *testing.T) (metadata, infoHash []byte) {
+	t.Helper()
+
+	pieces := make([]byte, 20*1000)
+	rand.Read(pieces)
+
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, map[string]any{
+		"name":         "payload.bin",
+		"length":       int64(1000 * 16384),
+		"piece length": int64(16384),
+		"pieces":       string(pieces),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := sha1.Sum(buf.Bytes())
+	return buf.Bytes(), hash[:]
+}
+
+// metadataPeer is the other end of a connection that serves the metadata extension
+type metadataPeer struct {
+	metadata []byte
+	infoHash []byte
+
+	// the peer doesn't set the bit of the extension protocol
+	noExtensions bool
+
+	// the peer rejects the requests of the pieces
+	reject bool
+}
+
+// the id we ask the client to send ut_metadata messages with, unlike the one the client picks
+const remoteMetadataID = 3
+
+func (m *metadataPeer) serve(conn net.Conn) error {
+	defer conn.Close()
+
+	if _, err := readHandshake(conn); err != nil {
+		return err
+	}
+
+	h := &Handshake{InfoHash: m.infoHash, PeerID: []byte("-XX0000-000000000000")}
+	if !m.noExtensions {
+		h.Reserved[5] |= reservedExtensionProtocol
+	}
+	if _, err := conn.Write(h.Bytes()); err != nil {
+		return err
+	}
+	if m.noExtensions {
+		return nil
+	}
+
+	// messages of other protocols come first, they are skipped
+	if _, err := conn.Write([]byte{0, 0, 0, 0, 0, 0, 0, 1, messageIDHaveAll}); err != nil {
+		return err
+	}
+
+	err := writeExtended(conn, extendedHandshakeID, map[string]any{
+		"m":             map[string]any{"ut_metadata": int64(remoteMetadataID), "ut_pex": int64(2)},
+		"metadata_size": int64(len(m.metadata)),
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		id, payload, err := readExtended(conn)
+		if err != nil {
+			return err
+		}
+
+		if id != remoteMetadataID {
+			continue
+		}
+
+		req, _, err := decodeDict(payload)
+		if err != nil {
+			return err
+		}
+		piece := req["piece"].(int64)
+
+		if m.reject {
+			err = writeExtended(conn, localMetadataID, map[string]any{"msg_type": int64(metadataReject), "piece": piece})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		data := m.metadata[piece*metadataPieceSize : min((piece+1)*metadataPieceSize, int64(len(m.metadata)))]
+
+		var buf bytes.Buffer
+		buf.Write([]byte{0, 0, 0, 0, messageIDExtended, localMetadataID})
+		bencode.Marshal(&buf, map[string]any{
+			"msg_type":   int64(metadataData),
+			"piece":      piece,
+			"total_size": int64(len(m.metadata)),
+		})
+		buf.Write(data)
+
+		msg := buf.Bytes()
+		binary.BigEndian.PutUint32(msg, uint32(len(msg)-4))
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func TestRequestMetadata(t *testing.T) {
+	metadata, infoHash := testMetadata(t)
+	other, _ := testMetadata(t)
+
+	tests := []struct {
+		name string
+		peer *metadataPeer
+		want error
+	}{
+		{name: "metadata", peer: &metadataPeer{metadata: metadata, infoHash: infoHash}},
+		{name: "metadata of another torrent", peer: &metadataPeer{metadata: other, infoHash: infoHash}, want: errMetadataMismatch},
+		{name: "rejected", peer: &metadataPeer{metadata: metadata, infoHash: infoHash, reject: true}},
+		{name: "no extension protocol", peer: &metadataPeer{metadata: metadata, infoHash: infoHash, noExtensions: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the handshakes cross, which needs the buffers of a real connection
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+
+			go func() {
+				if remote, err := ln.Accept(); err == nil {
+					tt.peer.serve(remote)
+				}
+			}()
+
+			local, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer local.Close()
+
+			got, err := requestMetadata(context.Background(), local, localPeerID, infoHash)
+
+			valid := !tt.peer.reject && !tt.peer.noExtensions && tt.want == nil
+			if valid {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, metadata) {
+					t.Fatal("got other metadata")
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatal("got metadata")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeDict(t *testing.T) {
+	dict, n, err := decodeDict([]byte("d8:msg_typei1e5:piecei0eepiece data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != len("d8:msg_typei1e5:piecei0ee") || dict["msg_type"] != int64(1) {
+		t.Fatalf("decoded %v of %d bytes", dict, n)
+	}
+
+	if _, _, err := decodeDict([]byte("li1ee")); err == nil {
+		t.Fatal("a list was decoded as a dictionary")
+	}
+}
+
+func TestAddMagnet(t *testing.T) {
+	metadata, infoHash := testMetadata(t)
+
+	// a peer without the metadata extension is tried too, the one that has it answers
+	peers := []*metadataPeer{
+		{metadata: metadata, infoHash: infoHash, noExtensions: true},
+		{metadata: metadata, infoHash: infoHash},
+	}
+
+	var compact []byte
+	for _, peer := range peers {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go peer.serve(conn)
+			}
+		}()
+
+		addr := ln.Addr().(*net.TCPAddr)
+		compact = append(compact, addr.IP.To4()...)
+		compact = binary.BigEndian.AppendUint16(compact, uint16(addr.Port))
+	}
+
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bencode.Marshal(w, map[string]any{"interval": int64(3600), "peers": string(compact)})
+	}))
+	defer tracker.Close()
+
+	s, err := NewSession(SessionConfig{ListenAddr: "127.0.0.1:0", Transport: transportTCPOnly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	server := httptest.NewServer(newRPCServer(s, t.TempDir()))
+	defer server.Close()
+	client := newRPCClient(strings.TrimPrefix(server.URL, "http://"))
+
+	magnet := "magnet:?xt=urn:btih:" + strings.ToUpper(hex.EncodeToString(infoHash)) + "&dn=payload&tr=" + tracker.URL + "/announce"
+
+	var added torrentJSON
+	err = client.Call(context.Background(), "torrent.add", addTorrentParams{Magnet: magnet}, &added)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torrent := s.Torrent(infoHash)
+	if added.InfoHash != hex.EncodeToString(infoHash) || torrent == nil {
+		t.Fatalf("added %s, want %x", added.InfoHash, infoHash)
+	}
+
+	if torrent.file.Announce != tracker.URL+"/announce" || torrent.file.Info.Name != "payload.bin" || len(torrent.file.Info.PiecesHash) != 1000 {
+		t.Fatalf("torrent of the magnet link announces to %s, is named %s and has %d pieces", torrent.file.Announce, torrent.file.Info.Name, len(torrent.file.Info.PiecesHash))
+	}
+
+	// the torrent is known now, its metadata isn't fetched again
+	tracker.Close()
+	if err := client.Call(context.Background(), "torrent.add", addTorrentParams{Magnet: magnet}, &added); err != nil {
+		t.Fatal(err)
+	}
+
+	// the trackers are the only place to find peers
+	noTrackers := "magnet:?xt=urn:btih:" + strings.Repeat("ab", 20)
+	if err := client.Call(context.Background(), "torrent.add", addTorrentParams{Magnet: noTrackers}, nil); err == nil {
+		t.Fatal("magnet link without trackers was added")
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const metricsPath = "/metrics"
+
+type metricKind string
+
+const (
+	metricCounter   metricKind = "counter"
+	metricGauge     metricKind = "gauge"
+	metricHistogram metricKind = "histogram"
+)
+
+// metricVec is a metric with labels, every combination of label values is a series
+type metricVec struct {
+	name   string
+	help   string
+	kind   metricKind
+	labels []string
+
+	// upper bounds of the histogram buckets, the +Inf bucket is implicit
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+
+	// value of counters and gauges
+	value float64
+
+	// observations of histograms, counts[i] is the number of observations in bucket i only
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// seriesFor returns the series of the label values, creating it if needed. Must be called with mu held.
+func (v *metricVec) seriesFor(labelValues []string) *metricSeries {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &metricSeries{
+			labelValues: append([]string(nil), labelValues...),
+			counts:      make([]uint64, len(v.buckets)+1),
+		}
+		v.series[key] = s
+	}
+
+	return s
+}
+
+func (v *metricVec) Add(delta float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.seriesFor(labelValues).value += delta
+}
+
+func (v *metricVec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+func (v *metricVec) Set(value float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.seriesFor(labelValues).value = value
+}
+
+func (v *metricVec) Observe(value float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s := v.seriesFor(labelValues)
+	s.counts[sort.SearchFloat64s(v.buckets, value)]++
+	s.sum += value
+	s.count++
+}
+
+// Reset drops every series, gauges that are computed on scrape start from scratch
+func (v *metricVec) Reset() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.series = make(map[string]*metricSeries)
+}
+
+// DeleteMatching drops the series whose label has the value, like the series of a removed torrent
+func (v *metricVec) DeleteMatching(label, value string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for i, name := range v.labels {
+		if name != label {
+			continue
+		}
+
+		for key, s := range v.series {
+			if s.labelValues[i] == value {
+				delete(v.series, key)
+			}
+		}
+	}
+}
+
+// write writes the metric in the Prometheus text exposition format
+func (v *metricVec) write(w *bufio.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.series[key]
+
+		if v.kind != metricHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labelValues, "", ""), formatMetricValue(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, bound := range v.buckets {
+			cumulative += s.counts[i]
+			le := formatMetricValue(bound)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, s.labelValues, "le", le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(v.labels, s.labelValues, "", ""), formatMetricValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats the labels as {a="1",b="2"}, with an extra label when extraName isn't empty
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, labelValueEscaper.Replace(values[i]))
+	}
+
+	if extraName != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, extraName, labelValueEscaper.Replace(extraValue))
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// metricsRegistry holds the metrics that are exposed at /metrics
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []*metricVec
+
+	// called before every scrape to update the gauges that are computed, like the peer counts
+	collectors []func()
+}
+
+func (r *metricsRegistry) newVec(kind metricKind, name, help string, labels ...string) *metricVec {
+	v := &metricVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]*metricSeries),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, v)
+	return v
+}
+
+func (r *metricsRegistry) NewCounter(name, help string, labels ...string) *metricVec {
+	return r.newVec(metricCounter, name, help, labels...)
+}
+
+func (r *metricsRegistry) NewGauge(name, help string, labels ...string) *metricVec {
+	return r.newVec(metricGauge, name, help, labels...)
+}
+
+func (r *metricsRegistry) NewHistogram(name, help string, buckets []float64, labels ...string) *metricVec {
+	v := r.newVec(metricHistogram, name, help, labels...)
+	v.buckets = buckets
+	return v
+}
+
+// AddCollector registers a function that updates metrics right before they are scraped
+func (r *metricsRegistry) AddCollector(collect func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors = append(r.collectors, collect)
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	collectors := append([]func(){}, r.collectors...)
+	metrics := append([]*metricVec{}, r.metrics...)
+	r.mu.Unlock()
+
+	for _, collect := range collectors {
+		collect()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	bw.Flush()
+}
+
+// the metrics of the client, they are updated from everywhere so they are global like the bandwidth limits
+var (
+	metrics = &metricsRegistry{}
+
+	metricBytes = metrics.NewCounter("bittorrent_bytes_total",
+		"Bytes of piece data transferred, by torrent and direction.", "info_hash", "direction")
+
+	metricPiecesVerified = metrics.NewCounter("bittorrent_pieces_verified_total",
+		"Pieces downloaded whose hash matched.", "info_hash")
+
+	metricPiecesFailed = metrics.NewCounter("bittorrent_pieces_failed_total",
+		"Pieces downloaded whose hash didn't match.", "info_hash")
+
+	metricPeersBanned = metrics.NewCounter("bittorrent_peers_banned_total",
+		"Peers banned for sending blocks of pieces that failed their hash.", "info_hash")
+
+	metricRequestTimeouts = metrics.NewCounter("bittorrent_request_timeouts_total",
+		"Block requests that a peer didn't answer in time.", "info_hash")
+
+	metricPeers = metrics.NewGauge("bittorrent_peers",
+		"Connected peers by torrent, and how many of them choke us and how many we are interested in.", "info_hash", "state")
+
+	metricAnnounceDuration = metrics.NewHistogram("bittorrent_tracker_announce_duration_seconds",
+		"Latency of the announces to the trackers.", []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "tracker")
+
+	metricAnnounceErrors = metrics.NewCounter("bittorrent_tracker_announce_errors_total",
+		"Announces that failed.", "tracker")
+
+	metricTrackerServerAnnounces = metrics.NewCounter("bittorrent_tracker_server_announces_total",
+		"Announces answered by our tracker, by event and protocol.", "event", "protocol")
+)
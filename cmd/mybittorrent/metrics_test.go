@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	r := &metricsRegistry{}
+
+	bytes := r.NewCounter("test_bytes_total", "Bytes by direction.", "info_hash", "direction")
+	peers := r.NewGauge("test_peers", "Connected peers.")
+	latency := r.NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1}, "tracker")
+	empty := r.NewCounter("test_empty_total", "Series of removed torrents.", "info_hash")
+
+	bytes.Add(1024, "ab", "upload")
+	bytes.Add(0.5, "ab", "download")
+	bytes.Inc(`quote " back\slash`+"\nnewline", "download")
+
+	// the gauges computed on scrape start over
+	r.AddCollector(func() {
+		peers.Reset()
+		peers.Set(3)
+	})
+	peers.Set(100)
+
+	latency.Observe(0.05, "tracker.example")
+	latency.Observe(0.1, "tracker.example")
+	latency.Observe(5, "tracker.example")
+	latency.Observe(math.Inf(1), "other.example")
+
+	empty.Inc("removed")
+	empty.DeleteMatching("info_hash", "removed")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", metricsPath, nil))
+
+	want := `# HELP test_bytes_total Bytes by direction.
+# TYPE test_bytes_total counter
+test_bytes_total{info_hash="ab",direction="download"} 0.5
+test_bytes_total{info_hash="ab",direction="upload"} 1024
+test_bytes_total{info_hash="quote \" back\\slash\nnewline",direction="download"} 1
+# HELP test_peers Connected peers.
+# TYPE test_peers gauge
+test_peers 3
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{tracker="other.example",le="0.1"} 0
+test_latency_seconds_bucket{tracker="other.example",le="1"} 0
+test_latency_seconds_bucket{tracker="other.example",le="+Inf"} 1
+test_latency_seconds_sum{tracker="other.example"} +Inf
+test_latency_seconds_count{tracker="other.example"} 1
+test_latency_seconds_bucket{tracker="tracker.example",le="0.1"} 2
+test_latency_seconds_bucket{tracker="tracker.example",le="1"} 2
+test_latency_seconds_bucket{tracker="tracker.example",le="+Inf"} 3
+test_latency_seconds_sum{tracker="tracker.example"} 5.15
+test_latency_seconds_count{tracker="tracker.example"} 3
+# HELP test_empty_total Series of removed torrents.
+# TYPE test_empty_total counter
+`
+
+	if got := rec.Body.String(); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Fatalf("got content type %q", ct)
+	}
+}
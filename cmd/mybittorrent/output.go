@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"os"
+)
+
+// outputFlags choose between the text for people and JSON for our tooling
+type outputFlags struct {
+	json bool
+}
+
+func addOutputFlags(fs *flag.FlagSet) *outputFlags {
+	o := &outputFlags{}
+	fs.BoolVar(&o.json, "json", false, "print the result as JSON")
+	return o
+}
+
+// print writes v as indented JSON with -json, otherwise it calls text
+func (o *outputFlags) print(v any, text func()) error {
+	if !o.json {
+		text()
+		return nil
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+type fileJSON struct {
+	Index  int    `json:"index"`
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+	Offset int64  `json:"offset"`
+}
+
+type torrentInfoJSON struct {
+	Announce     string     `json:"announce"`
+	AnnounceList [][]string `json:"announce_list,omitempty"`
+	InfoHash     string     `json:"info_hash"`
+	Name         string     `json:"name"`
+	Length       int64      `json:"length"`
+	MultiFile    bool       `json:"multi_file"`
+	Private      bool       `json:"private"`
+	PieceLength  int64      `json:"piece_length"`
+	PieceHashes  []string   `json:"piece_hashes"`
+	Files        []fileJSON `json:"files"`
+}
+
+func newTorrentInfoJSON(file *TorrentFile) torrentInfoJSON {
+	return torrentInfoJSON{
+		Announce:     file.Announce,
+		AnnounceList: file.AnnounceList,
+		InfoHash:     hex.EncodeToString(file.Info.InfoHash),
+		Name:         file.Info.Name,
+		Length:       file.Info.Length,
+		MultiFile:    file.Info.MultiFile,
+		Private:      file.Info.Private,
+		PieceLength:  file.Info.PieceLength,
+		PieceHashes:  file.Info.PiecesHash,
+		Files:        newFilesJSON(&file.Info),
+	}
+}
+
+func newFilesJSON(info *Info) []fileJSON {
+	files := make([]fileJSON, len(info.Files))
+	for i, f := range info.Files {
+		files[i] = fileJSON{
+			Index:  i,
+			Path:   f.DisplayPath(),
+			Length: f.Length,
+			Offset: f.Offset,
+		}
+	}
+
+	return files
+}
+
+type peerAddrJSON struct {
+	IP   string `json:"ip"`
+	Port uint16 `json:"port"`
+}
+
+type handshakeJSON struct {
+	IP     string `json:"ip"`
+	Port   uint16 `json:"port"`
+	PeerID string `json:"peer_id"`
+
+	// the eight reserved bytes in hex, and the extensions they advertise
+	Reserved   string   `json:"reserved"`
+	Extensions []string `json:"extensions"`
+}
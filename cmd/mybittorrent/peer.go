@@ -5,97 +5,352 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"net/netip"
 	"sync"
 	"time"
 )
 
 type Peer struct {
-	// make sure we don't write and read at the same time
+	// IPv4 addresses are never mapped into IPv6, so they compare equal however we learned them
+	addr netip.AddrPort
+	conn net.Conn
 
-	sync.Once
+	// opens the connection to the peer over TCP or uTP
+	dialer *peerDialer
 
-	port   uint16
-	ipAddr string
-	conn   net.Conn
+	// the id we introduce ourselves with in the handshake
+	localPeerID []byte
+
+	// the peer opened the connection to us
+	incoming bool
+
+	// diagnostics about the connection, with the address of the peer and the torrent when known
+	log *slog.Logger
+
+	// limits of this connection alone
+	bandwidth *bandwidthLimiter
+
+	// limits shared with other connections, like the global and the torrent limits
+	sharedBandwidth []*bandwidthLimiter
+
+	// reads the blocks the peer requests from us, nil when we have nothing to upload
+	serveBlock func(pieceIndex int, begin int64, length int) ([]byte, error)
+
+	// the peer is not allowed to request blocks until we unchoke it
+	amChoking bool
 
 	handshake *Handshake
 
-	availablePiecesIndexes []int
+	// how long we wait for a requested block before giving up on the peer
+	requestTimeout time.Duration
+
+	// make sure we don't interleave messages written from different goroutines
+	writeMu sync.Mutex
+
+	// when we last wrote to the peer, used to decide when to send a keep-alive
+	lastWrite time.Time
+
+	// protects the state the peer sent us
+	mu sync.Mutex
+
+	// pieces of the torrent, the peer is dropped when it sends an index past them
+	numPieces int
+
+	// pieces the peer has, from the bitfield and have messages
+	pieces bitfield
+
+	// the peer sent have_all instead of a bitfield
+	hasAll bool
+
+	// both sides set the fast extension bit in the handshake
+	fastExtension bool
+
+	// pieces we may request even while the peer is choking us
+	allowedFast map[int]bool
+
+	// pieces the peer would like us to download, most recent first
+	suggestedPieces []int
+
+	// we told the peer we are interested
+	interested bool
 
 	// If the peer is choked then we can't request any pieces from him
 	chockedCh chan struct{}
 
 	unChokedCh chan struct{}
 
+	allowedFastCh chan struct{}
+
 	// If we are unchoked then we can download from the peer
 	choked bool
 
-	// TODO: add chan that we pass the messages through him
 	msgChan chan []byte
 
 	// Pass piece messages from the peer
 	pieceMsgChan chan []byte
 
-	downloadedPieceChan chan downloadPieceChan
+	// closed when the connection is closed, stops all the goroutines of the peer
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
 }
 
-type downloadPieceChan struct {
-	content []byte
-	err     error
-}
+func NewPeer(addr netip.AddrPort) *Peer {
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
 
-func NewPeer(port uint16, ipAddr string) *Peer {
 	return &Peer{
-		port:                port,
-		ipAddr:              ipAddr,
-		msgChan:             make(chan []byte),
-		chockedCh:           make(chan struct{}),
-		unChokedCh:          make(chan struct{}),
-		pieceMsgChan:        make(chan []byte),
-		downloadedPieceChan: make(chan downloadPieceChan),
-		// lock:         sync.Mutex{},
+		addr:            addr,
+		dialer:          defaultDialer,
+		localPeerID:     localPeerID,
+		log:             slog.With("peer", addr.String()),
+		bandwidth:       newBandwidthLimiter(realClock{}, 0, 0),
+		sharedBandwidth: []*bandwidthLimiter{globalBandwidth},
+		amChoking:       true,
+		requestTimeout:  defaultRequestTimeout,
+		msgChan:         make(chan []byte),
+		allowedFast:     make(map[int]bool),
+		choked:          true,
+		chockedCh:       make(chan struct{}, 1),
+		unChokedCh:      make(chan struct{}, 1),
+		allowedFastCh:   make(chan struct{}, 1),
+		pieceMsgChan:    make(chan []byte, maxPendingBlocks),
+		done:            make(chan struct{}),
 	}
 }
 
 const (
 	blockSize = 16 * 1024
+
+	// bounds the handshake when the context has no deadline of its own
+	handshakeTimeout = 10 * time.Second
+
+	// how long we wait for the peer to unchoke us after the handshake
+	unchokeTimeout = 3 * time.Second
+
+	defaultRequestTimeout = 20 * time.Second
+
+	// peers close connections that are quiet for more than two minutes
+	keepAliveInterval = 2 * time.Minute
+
+	// a peer that sent nothing, not even a keep-alive, for that long is disconnected
+	idleTimeout = 3 * time.Minute
+
+	writeTimeout = 30 * time.Second
+
+	// larger than any message we expect, protects us from allocating whatever the peer claims
+	maxMessageSize = 1 << 21
+
+	// blocks that arrived and wait to be picked up by the download
+	maxPendingBlocks = 64
+
+	// allowed fast sets are about ten pieces, suggestions are only worth keeping while they are recent
+	maxAllowedFast     = 32
+	maxSuggestedPieces = 32
 )
 
-func (p *Peer) Connect(infoHash []byte) error {
-	addr := fmt.Sprintf("%s:%d", p.ipAddr, p.port)
-	conn, err := net.Dial("tcp", addr)
+var (
+	errRequestTimeout = errors.New("request timed out")
+	errPeerClosed     = errors.New("peer connection closed")
+	errHashMismatch   = errors.New("piece hash doesn't match expected hash")
+)
+
+func (p *Peer) String() string {
+	return p.addr.String()
+}
+
+// Connect dials the peer, performs the handshake and waits to be unchoked.
+// The context bounds the whole process, not the connection that is returned.
+func (p *Peer) Connect(ctx context.Context, infoHash []byte) error {
+	conn, err := p.dialer.DialContext(ctx, p.String())
 	if err != nil {
 		return err
 	}
 
-	p.conn = conn
+	p.conn = p.limitConn(conn)
 
-	// unique identifier of our peer
-	peerID := []byte("00112233445566778899")
-	p.handshake, err = p.Handshake(context.Background(), infoHash, peerID)
+	p.handshake, err = p.Handshake(ctx, infoHash, p.localPeerID)
 	if err != nil {
+		p.Close()
 		return err
 	}
 
-	go p.handleConnection()
+	if isSelf(p.handshake, p.localPeerID) {
+		p.Close()
+		return errSelfConnection
+	}
 
-	go p.handleMessage()
+	p.start()
 
 	select {
 	case <-p.unChokedCh:
 		return nil
-	case <-time.After(3 * time.Second):
+
+	// we can already download the allowed fast pieces while choked
+	case <-p.allowedFastCh:
+		return nil
+
+	case <-p.done:
+		return p.closeErr
+
+	case <-ctx.Done():
+		p.Close()
+		return ctx.Err()
+
+	case <-time.After(unchokeTimeout):
+		p.Close()
 		return fmt.Errorf("timed out to receive unchoke message")
 	}
 
 }
 
+// NewIncomingPeer creates a peer for a connection the peer opened to us
+func NewIncomingPeer(conn net.Conn) (*Peer, error) {
+	addr, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+
+	p := NewPeer(addr)
+	p.conn = conn
+	p.incoming = true
+
+	return p, nil
+}
+
+// Accept answers the handshake of a peer that connected to us and starts serving the connection.
+// The peer's handshake was already read with ReadHandshake to decide which torrent it wants.
+func (p *Peer) Accept(ctx context.Context, theirs *Handshake) error {
+	p.conn = p.limitConn(p.conn)
+	p.handshake = theirs
+
+	h := &Handshake{
+		InfoHash: theirs.InfoHash,
+		PeerID:   p.localPeerID,
+	}
+	h.Reserved[7] |= reservedFastExtension
+
+	// a connection to ourselves is answered too, so our dialing side sees its own peer ID and bans
+	// the address instead of retrying it as a peer that went away
+	err := withDeadline(ctx, p.conn, func() error {
+		return p.writeMessage(h.Bytes())
+	})
+	if isSelf(theirs, p.localPeerID) {
+		p.conn.Close()
+		return errSelfConnection
+	}
+	if err != nil {
+		p.Close()
+		return err
+	}
+
+	p.start()
+
+	return nil
+}
+
+// limitConn applies the bandwidth limits of the peer to the connection
+func (p *Peer) limitConn(conn net.Conn) net.Conn {
+	limiters := append(append([]*bandwidthLimiter(nil), p.sharedBandwidth...), p.bandwidth)
+	return newRateLimitedConn(conn, limiters...)
+}
+
+// start runs the goroutines that serve the connection once the handshake is done
+func (p *Peer) start() {
+	p.fastExtension = p.handshake.SupportsFast()
+
+	go p.handleConnection()
+
+	go p.handleMessage()
+
+	go p.keepAlive()
+}
+
+// Close closes the connection and stops the goroutines serving it
 func (p *Peer) Close() error {
-	return p.conn.Close()
+	p.closeWithError(errPeerClosed)
+	return nil
+}
+
+func (p *Peer) closeWithError(err error) {
+	p.closeOnce.Do(func() {
+		p.log.Debug("connection closed", "err", err)
+
+		p.closeErr = err
+		close(p.done)
+
+		if p.conn != nil {
+			p.conn.Close()
+		}
+	})
+}
+
+// Done is closed once the connection to the peer is closed
+func (p *Peer) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err returns why the connection was closed
+func (p *Peer) Err() error {
+	select {
+	case <-p.done:
+		return p.closeErr
+	default:
+		return nil
+	}
+}
+
+// writeMessage writes a whole message to the peer, bounded by the write timeout
+func (p *Peer) writeMessage(msg []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	err := p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err != nil {
+		return err
+	}
+
+	_, err = p.conn.Write(msg)
+	if err != nil {
+		return err
+	}
+
+	p.lastWrite = time.Now()
+	return nil
+}
+
+// keepAlive sends a keep-alive message whenever we didn't send anything for a while
+func (p *Peer) keepAlive() {
+	ticker := time.NewTicker(keepAliveInterval / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+
+		case <-ticker.C:
+			p.writeMu.Lock()
+			lastWrite := p.lastWrite
+			p.writeMu.Unlock()
+
+			if time.Since(lastWrite) < keepAliveInterval {
+				continue
+			}
+
+			// keep-alive is a message with zero length
+			err := p.writeMessage([]byte{0, 0, 0, 0})
+			if err != nil {
+				p.closeWithError(fmt.Errorf("failed to send keep-alive: %w", err))
+				return
+			}
+		}
+	}
 }
 
 const (
@@ -110,6 +365,9 @@ type Handshake struct {
 	// BitTorrent protocol - 19 bytes
 	ProtocolName string
 
+	// eight reserved bytes, used to advertise extensions
+	Reserved [8]byte
+
 	// sha1 info hash - 20 bytes
 	InfoHash []byte
 
@@ -126,10 +384,8 @@ func (h *Handshake) Bytes() []byte {
 	// name of the protocol
 	buf.WriteString("BitTorrent protocol")
 
-	// eight reserved bytes, which are all set to zero (8 bytes)
-	for i := 0; i < 8; i++ {
-		buf.WriteByte(0)
-	}
+	// eight reserved bytes
+	buf.Write(h.Reserved[:])
 
 	buf.WriteString(string(h.InfoHash))
 	buf.WriteString(string(h.PeerID))
@@ -142,13 +398,57 @@ func ParseHandshake(buf []byte) (*Handshake, error) {
 		return nil, fmt.Errorf("wrong size, expected %d, got %d", handshakeSize, len(buf))
 	}
 
+	if buf[0] != 19 || string(buf[1:20]) != "BitTorrent protocol" {
+		return nil, fmt.Errorf("unknown protocol %q", buf[1:min(1+int(buf[0]), len(buf))])
+	}
+
 	peerID := buf[handshakeSize-20 : handshakeSize]
 	peerHashInfo := buf[handshakeSize-40 : handshakeSize-20]
 
-	return &Handshake{
+	h := &Handshake{
 		PeerID:   peerID,
 		InfoHash: peerHashInfo,
-	}, nil
+	}
+	copy(h.Reserved[:], buf[20:28])
+
+	return h, nil
+}
+
+// the fast extension is advertised with the third least significant bit of the last reserved byte
+// https://www.bittorrent.org/beps/bep_0006.html
+const reservedFastExtension = 0x04
+
+// the extension protocol is advertised with the fifth bit from the right of the sixth reserved byte
+// https://www.bittorrent.org/beps/bep_0010.html
+const reservedExtensionProtocol = 0x10
+
+func (h *Handshake) SupportsFast() bool {
+	return h.Reserved[7]&reservedFastExtension != 0
+}
+
+// the extensions that are advertised in the reserved bytes, by their byte and bit
+var reservedExtensions = []struct {
+	name string
+	byte int
+	bit  byte
+}{
+	// https://www.bittorrent.org/beps/bep_0005.html
+	{"dht", 7, 0x01},
+	{"fast", 7, reservedFastExtension},
+	// https://www.bittorrent.org/beps/bep_0010.html
+	{"extension_protocol", 5, reservedExtensionProtocol},
+}
+
+// Extensions names the extensions the peer advertises, unknown bits are left out
+func (h *Handshake) Extensions() []string {
+	extensions := []string{}
+	for _, e := range reservedExtensions {
+		if h.Reserved[e.byte]&e.bit != 0 {
+			extensions = append(extensions, e.name)
+		}
+	}
+
+	return extensions
 }
 
 func (p *Peer) Handshake(ctx context.Context, infoHash []byte, peerID []byte) (*Handshake, error) {
@@ -157,196 +457,429 @@ func (p *Peer) Handshake(ctx context.Context, infoHash []byte, peerID []byte) (*
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+	h.Reserved[7] |= reservedFastExtension
+
+	var handshake *Handshake
+	err := withDeadline(ctx, p.conn, func() error {
+		_, err := p.conn.Write(h.Bytes())
+		if err != nil {
+			return err
+		}
 
-	_, err := p.conn.Write(h.Bytes())
+		handshake, err = readHandshake(p.conn)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	buf := make([]byte, 1024)
+	if !bytes.Equal(handshake.InfoHash, infoHash) {
+		return nil, fmt.Errorf("peer answered with info hash %x", handshake.InfoHash)
+	}
+
+	return handshake, nil
+}
+
+// ReadHandshake reads the handshake of a peer that connected to us
+func ReadHandshake(ctx context.Context, conn net.Conn) (*Handshake, error) {
+	var handshake *Handshake
+	err := withDeadline(ctx, conn, func() error {
+		var err error
+		handshake, err = readHandshake(conn)
+		return err
+	})
+
+	return handshake, err
+}
 
-	size, err := p.conn.Read(buf)
+func readHandshake(conn net.Conn) (*Handshake, error) {
+	// the peer may send its first messages right after the handshake, so only read the handshake itself
+	buf := make([]byte, handshakeSize)
+
+	_, err := io.ReadFull(conn, buf)
 	if err != nil {
 		return nil, err
 	}
 
 	// Parse the handshake
 
-	handshake, err := ParseHandshake(buf[:size])
+	return ParseHandshake(buf)
+}
+
+// withDeadline bounds f by the context deadline, and aborts it if the context is canceled
+func withDeadline(ctx context.Context, conn net.Conn, f func() error) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+
+	err := conn.SetDeadline(deadline)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return handshake, err
+	defer conn.SetDeadline(time.Time{})
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	return contextError(ctx, f())
 }
 
+// contextError prefers the context error over the i/o error it caused
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// DownloadPiece downloads a piece and verifies its hash. The data is returned with errHashMismatch too,
+// to find out which of its blocks were wrong once the piece is downloaded again. The piece is in a
+// buffer of the pool, given back with putPieceBuffer once it's stored.
 func (p *Peer) DownloadPiece(ctx context.Context, file *TorrentFile, pieceIndex int) ([]byte, error) {
 
-	// // Then it's not the first time, we need to send an interested message
-	// if len(p.availablePiecesIndexes) > 0 {
-	// 	// Send interested message to start
-	// 	_, err := p.conn.Write([]byte{0, 0, 0, 1, messageIDInterested})
-	// 	if err != nil {
-	// 		return nil, err
-	// 	}
+	content := getPieceBuffer(&file.Info, pieceIndex)
 
-	// 	fmt.Println("sent interested message")
-	// }
-	// send in the background
-	go p.downloadPiece(file, pieceIndex)
+	err := p.downloadPiece(ctx, file, pieceIndex, content)
+	if err != nil {
+		putPieceBuffer(content)
+		return nil, err
+	}
 
-	// wait for the choke message or the piece to be downloaded
-	select {
-	case <-p.chockedCh:
-		return nil, fmt.Errorf("peer %s:%d is choked", p.ipAddr, p.port)
+	// validate the hash of the piece
 
-	case pieceRes := <-p.downloadedPieceChan:
-		if pieceRes.err != nil {
-			return nil, pieceRes.err
-		}
+	expectedPieceHash := file.Info.PiecesHash[pieceIndex]
 
-		// validate the hash of the piece
+	hash := sha1.New()
 
-		expectedPieceHash := file.Info.PiecesHash[pieceIndex]
+	_, err = hash.Write(content)
+	if err != nil {
+		putPieceBuffer(content)
+		return nil, err
+	}
+
+	pieceHash := fmt.Sprintf("%x", hash.Sum(nil))
+
+	if pieceHash != expectedPieceHash {
+		return content, errHashMismatch
+	}
+
+	return content, nil
+}
 
-		hash := sha1.New()
+// handleConnection reads the messages from the peer until the connection is closed
+func (p *Peer) handleConnection() {
+	lengthBuf := make([]byte, 4)
 
-		_, err := hash.Write(pieceRes.content)
+	for {
+		// a peer that doesn't send anything, not even keep-alives, is gone
+		err := p.conn.SetReadDeadline(time.Now().Add(idleTimeout))
 		if err != nil {
-			return nil, err
+			p.closeWithError(err)
+			return
 		}
 
-		pieceHash := fmt.Sprintf("%x", hash.Sum(nil))
+		_, err = io.ReadFull(p.conn, lengthBuf)
+		if err != nil {
+			p.closeWithError(fmt.Errorf("failed to read message: %w", err))
+			return
+		}
+
+		messageSize := binary.BigEndian.Uint32(lengthBuf)
 
-		if pieceHash != expectedPieceHash {
-			return nil, errors.New("piece hash doesn't match expected hash")
+		// Keep alive
+		if messageSize == 0 {
+			continue
 		}
 
-		return pieceRes.content, nil
+		if messageSize > maxMessageSize {
+			p.closeWithError(fmt.Errorf("message of %d bytes is too large", messageSize))
+			return
+		}
 
-	}
+		// the message keeps its length prefix so the id is always at index 4
+		msg := make([]byte, 4+messageSize)
+		copy(msg, lengthBuf)
 
-}
+		_, err = io.ReadFull(p.conn, msg[4:])
+		if err != nil {
+			p.closeWithError(fmt.Errorf("failed to read payload: %w", err))
+			return
+		}
 
-func (p *Peer) handleConnection() error {
-	buf := make([]byte, 5)
+		select {
+		case p.msgChan <- msg:
+		case <-p.done:
+			return
+		}
+	}
+}
 
+func (p *Peer) handleMessage() {
 	for {
 
-		// Read the first 5 bytes to get the size and message id
+		var msg []byte
+		select {
+		case msg = <-p.msgChan:
+		case <-p.done:
+			return
+		}
 
-		size, err := p.conn.Read(buf)
+		err := p.dispatchMessage(msg)
 		if err != nil {
-			// Connection was closed
-			if errors.Is(err, io.EOF) {
-				fmt.Println("eof")
-				return nil
-			}
+			p.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (p *Peer) dispatchMessage(msg []byte) error {
+	msgID := msg[4]
+
+	p.log.Debug("received message", "type", messageName(msgID), "size", len(msg)-4)
+
+	switch msgID {
+
+	case messageIDChoke:
+		p.mu.Lock()
+		p.choked = true
+		p.mu.Unlock()
+		notify(p.chockedCh)
+
+	case messageIDUnchoke:
+		p.mu.Lock()
+		p.choked = false
+		p.mu.Unlock()
+		notify(p.unChokedCh)
+
+	case messageIDInterested:
+
+		// we unchoke everyone that wants something we have
+		if p.serveBlock != nil {
+			return p.sendUnchoke()
+		}
+
+	case messageIDNotInterested:
+
+	case messageIDHave:
 
+		pieceIndex, err := p.messagePieceIndex(msg)
+		if err != nil {
 			return err
 		}
-		buf = buf[:size]
 
-		// Keep alive
-		if len(buf) < 5 {
-			continue
+		p.mu.Lock()
+		if p.pieces == nil {
+			p.pieces = newBitfield(p.numPieces)
 		}
+		p.pieces.Set(pieceIndex)
+		p.mu.Unlock()
 
-		messageSize := binary.BigEndian.Uint32(buf[:4])
+		return p.sendInterested()
 
-		// Because we read the message ID already
-		messageSize = messageSize - 1
+		// get all the pieces that the peer has
+	case messageIDBitfield:
 
-		msg := buf
+		err := p.handleBitfieldMessage(msg)
+		if err != nil {
+			return fmt.Errorf("failed to handle bitfield message: %w", err)
+		}
+	case messageIDRequest:
+		return p.handleRequestMessage(msg)
 
-		// Read the payload if exist
-		if messageSize > 0 {
-			payloadBuf := make([]byte, messageSize)
+	case messageIDPiece:
+		return p.forwardBlock(msg)
 
-			_, err = io.ReadFull(p.conn, payloadBuf)
-			if err != nil {
-				return fmt.Errorf("failed to read payload")
-			}
-			msg = append(msg, payloadBuf...)
+	case messageIDCancel:
 
+	case messageIDHaveAll, messageIDHaveNone, messageIDSuggestPiece, messageIDRejectRequest, messageIDAllowedFast:
+		err := p.handleFastMessage(msg)
+		if err != nil {
+			return fmt.Errorf("failed to handle fast extension message: %w", err)
 		}
 
-		p.msgChan <- msg
+	default:
+		// unknown messages are ignored so other extensions don't break the connection
+	}
+
+	return nil
+}
+
+// forwardBlock passes a piece or reject message to the download waiting for it.
+// Blocks that nobody picks up, like answers to requests that already timed out, are dropped.
+func (p *Peer) forwardBlock(msg []byte) error {
+	// a reject carries the length of the block, not its data
+	if msg[4] == messageIDPiece && len(msg) > 13 {
+		metricBytes.Add(float64(len(msg)-13), p.infoHashLabel(), "download")
+	}
+
+	select {
+	case p.pieceMsgChan <- msg:
+	default:
+		p.log.Debug("dropping unexpected block")
 	}
+
+	return nil
 }
 
-func (p *Peer) handleMessage() error {
-	for {
+// handleFastMessage handles the messages of the fast extension
+// https://www.bittorrent.org/beps/bep_0006.html
+func (p *Peer) handleFastMessage(msg []byte) error {
 
-		msg := <-p.msgChan
+	// the peer must not send these unless both sides advertised the extension
+	if !p.fastExtension {
+		return fmt.Errorf("got message %d without negotiating the fast extension", msg[4])
+	}
 
-		msgID := msg[4]
+	switch msg[4] {
+	case messageIDHaveAll:
 
-		switch msgID {
+		p.mu.Lock()
+		p.hasAll = true
+		p.mu.Unlock()
 
-		case messageIDChoke:
-			fmt.Println("msg choke")
-			p.chockedCh <- struct{}{}
-			p.choked = true
+		return p.sendInterested()
 
-		case messageIDUnchoke:
+	case messageIDHaveNone:
 
-			fmt.Println("msg unchoke")
-			p.choked = false
-			p.unChokedCh <- struct{}{}
+	case messageIDSuggestPiece:
 
-		case messageIDInterested:
-			fmt.Println("msg Interested")
+		pieceIndex, err := p.messagePieceIndex(msg)
+		if err != nil {
+			return err
+		}
 
-		case messageIDNotInterested:
-			fmt.Println("msg NotInterested")
+		p.mu.Lock()
+		p.suggestedPieces = suggestPiece(p.suggestedPieces, pieceIndex)
+		p.mu.Unlock()
 
-		case messageIDHave:
-			fmt.Println("msg Have")
+	case messageIDRejectRequest:
 
-			// get all the pieces that the peer has
-		case messageIDBitfield:
-			fmt.Println("msg Bitfield")
+		// fails the block that is waiting for it
+		return p.forwardBlock(msg)
 
-			err := p.handleBitfieldMessage(msg)
-			if err != nil {
-				return fmt.Errorf("failed to handle bitfield message: %w", err)
-			}
-		case messageIDRequest:
-			fmt.Println("msg Request")
+	case messageIDAllowedFast:
+
+		pieceIndex, err := p.messagePieceIndex(msg)
+		if err != nil {
+			return err
+		}
+
+		// the set is a handful of pieces, a peer growing it past that is ignored
+		p.mu.Lock()
+		if len(p.allowedFast) < maxAllowedFast {
+			p.allowedFast[pieceIndex] = true
+		}
+		p.mu.Unlock()
 
-		case messageIDPiece:
-			fmt.Println("msg Piece")
-			p.pieceMsgChan <- msg
+		notify(p.allowedFastCh)
+	}
+
+	return nil
+}
 
-		case messageIDCancel:
-			fmt.Println("msg Cancel")
+// messagePieceIndex reads the piece index that follows the message id, it fails when the torrent has no such piece
+func (p *Peer) messagePieceIndex(msg []byte) (int, error) {
+	if len(msg) < 9 {
+		return 0, fmt.Errorf("message %d is too short: %d bytes", msg[4], len(msg))
+	}
 
-		default:
-			fmt.Println("unknown message")
+	pieceIndex := int(binary.BigEndian.Uint32(msg[5:9]))
+	if pieceIndex >= p.numPieces {
+		return 0, fmt.Errorf("message %d has piece index %d, the torrent has %d pieces", msg[4], pieceIndex, p.numPieces)
+	}
+
+	return pieceIndex, nil
+}
+
+// suggestPiece moves the piece first in the suggestions, which keep the most recent ones only
+func suggestPiece(suggested []int, pieceIndex int) []int {
+	for i, index := range suggested {
+		if index == pieceIndex {
+			suggested = append(suggested[:i], suggested[i+1:]...)
+			break
 		}
+	}
 
+	if len(suggested) >= maxSuggestedPieces {
+		suggested = suggested[:maxSuggestedPieces-1]
 	}
+
+	return append([]int{pieceIndex}, suggested...)
 }
 
-func (p *Peer) downloadPiece(file *TorrentFile, pieceIndex int) {
+// HasPiece reports whether the peer told us it has the piece
+func (p *Peer) HasPiece(pieceIndex int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	// TODO: block until not choked
-	// Wait X time
-	// if p.choked {
-	// 	p.downloadedPieceChan <- downloadPieceChan{
-	// 		err: fmt.Errorf("trying to download while choked"),
-	// 	}
-	// }
+	return p.hasAll || p.pieces.Has(pieceIndex)
+}
+
+// CanRequest reports whether we are allowed to request blocks of the piece right now
+func (p *Peer) CanRequest(pieceIndex int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return !p.choked || p.allowedFast[pieceIndex]
+}
+
+// PeerStatus is a snapshot of a connection to a peer
+type PeerStatus struct {
+	Addr     string
+	PeerID   []byte
+	Incoming bool
 
-	fmt.Println("unchoke starting to download")
+	// the peer is choking us
+	Choked bool
 
-	pieceLen := file.Info.PieceLength
+	// we told the peer we are interested
+	Interested bool
+
+	FastExtension bool
+
+	// pieces the peer has
+	Pieces int
+}
+
+// Status must only be called once the handshake is done
+func (p *Peer) Status(numPieces int) PeerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := PeerStatus{
+		Addr:          p.String(),
+		PeerID:        p.handshake.PeerID,
+		Incoming:      p.incoming,
+		Choked:        p.choked,
+		Interested:    p.interested,
+		FastExtension: p.fastExtension,
+	}
 
-	if len(file.Info.PiecesHash)-1 == pieceIndex {
-		pieceLen = file.Info.Length % file.Info.PieceLength
+	for i := 0; i < numPieces; i++ {
+		if p.hasAll || p.pieces.Has(i) {
+			status.Pieces++
+		}
 	}
-	var completedPiece []byte
+
+	return status
+}
+
+func (p *Peer) SuggestedPieces() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]int(nil), p.suggestedPieces...)
+}
+
+// downloadPiece writes the blocks of the piece into piece at their offset, piece is as long as the piece
+func (p *Peer) downloadPiece(ctx context.Context, file *TorrentFile, pieceIndex int, piece []byte) error {
+
+	pieceLen := len(piece)
 
 	numBlocks := pieceLen / blockSize
 
@@ -354,24 +887,13 @@ func (p *Peer) downloadPiece(file *TorrentFile, pieceIndex int) {
 	if pieceLen%blockSize != 0 {
 		numBlocks++
 	}
-	fmt.Printf("num of blocks in a piece: %d\n", numBlocks)
-	fmt.Println("piece length", pieceLen)
+	p.log.Debug("downloading piece", "piece", pieceIndex, "length", pieceLen, "blocks", numBlocks)
 
-	for i := 0; i < int(numBlocks); i++ {
+	for i := 0; i < numBlocks; i++ {
 
 		index := uint32(pieceIndex)
 		begin := uint32(i * blockSize)
-		length := uint32(blockSize)
-
-		// The length of the last piece can be less then the others
-		if i == int(numBlocks)-1 && pieceLen%blockSize != 0 {
-
-			// fmt.Println(`file.Info.PieceLength % blockSize:`, file.Info.PieceLength%blockSize)
-			length = uint32(pieceLen % blockSize)
-		}
-
-		// fmt.Printf("begin: %d, block num: %d\n", begin, i)
-		fmt.Printf("length: %d, begin: %d, block num: %d\n", length, begin, i)
+		length := uint32(min(blockSize, pieceLen-int(begin)))
 
 		var request []byte
 
@@ -382,65 +904,208 @@ func (p *Peer) downloadPiece(file *TorrentFile, pieceIndex int) {
 		request = binary.BigEndian.AppendUint32(request, length)
 
 		// Send the request
+		err := p.writeMessage(request)
+		if err != nil {
+			return fmt.Errorf("failed to write: %w", err)
+		}
+
+		p.log.Debug("requested block", "piece", pieceIndex, "begin", begin, "length", length)
+
+		// Read the response
 
-		fmt.Println("trying to send request")
-		_, err := p.conn.Write(request)
+		respBlock, err := p.waitForBlock(ctx, index, begin, length)
 		if err != nil {
-			p.downloadedPieceChan <- downloadPieceChan{
-				err: fmt.Errorf("failed to write: %w", err),
+			return err
+		}
+
+		copy(piece[begin:], respBlock)
+	}
+
+	return nil
+}
+
+// waitForBlock waits for the answer to a request, bounded by the request timeout
+func (p *Peer) waitForBlock(ctx context.Context, index, begin, length uint32) ([]byte, error) {
+	timeout := time.NewTimer(p.requestTimeout)
+	defer timeout.Stop()
+
+	for {
+		var resp []byte
+
+		select {
+		case resp = <-p.pieceMsgChan:
+
+		case <-p.chockedCh:
+			// with the fast extension the peer rejects our pending requests explicitly
+			if p.fastExtension {
+				continue
 			}
-			return
+
+			// the notification of a choke the peer already took back
+			p.mu.Lock()
+			choked := p.choked
+			p.mu.Unlock()
+			if !choked {
+				continue
+			}
+
+			return nil, fmt.Errorf("peer %s is choked", p)
+
+		case <-timeout.C:
+			return nil, fmt.Errorf("piece %d block %d from peer %s: %w", index, begin, p, errRequestTimeout)
+
+		case <-p.done:
+			return nil, p.closeErr
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if len(resp) < 13 {
+			continue
 		}
 
-		fmt.Println("sent request message")
+		respIndex := binary.BigEndian.Uint32(resp[5:9])
+		respBegin := binary.BigEndian.Uint32(resp[9:13])
 
-		// Read the response
+		// a late answer to a request of a previous piece
+		if respIndex != index || respBegin != begin {
+			continue
+		}
 
-		resp := <-p.pieceMsgChan
+		if resp[4] == messageIDRejectRequest {
+			return nil, fmt.Errorf("peer rejected request for piece %d block %d", index, begin)
+		}
 
-		resp = resp[:length+13]
+		if uint32(len(resp)) < length+13 {
+			return nil, fmt.Errorf("short block for piece %d block %d", index, begin)
+		}
 
-		fmt.Println("got piece message")
+		return resp[13 : length+13], nil
+	}
+}
 
-		// fmt.Println("respSize", respSize)
+func (p *Peer) handleBitfieldMessage(msg []byte) error {
 
-		// resp = resp[:respSize]
-		// fmt.Println("resp:", resp)
+	if len(msg)-5 != (p.numPieces+7)/8 {
+		return fmt.Errorf("bitfield of %d bytes for %d pieces", len(msg)-5, p.numPieces)
+	}
 
-		// respIndex := binary.BigEndian.Uint32(resp[5:9])
-		// respBegin := binary.BigEndian.Uint32(resp[9:13])
-		respBlock := resp[13:]
+	p.mu.Lock()
+	p.pieces = bitfield(append([]byte(nil), msg[5:]...))
+	p.mu.Unlock()
 
-		// fmt.Println("resp Length", binary.BigEndian.Uint32(resp[:5]))
-		// fmt.Println("respIndex", respIndex)
-		// fmt.Println("respBegin", respBegin)
+	return p.sendInterested()
+}
 
-		completedPiece = append(completedPiece, respBlock...)
-		// fmt.Println("respBlock", respBlock)
+// sendInterested tells the peer we want to download from it, only the first call sends the message
+func (p *Peer) sendInterested() error {
+	p.mu.Lock()
+	if p.interested {
+		p.mu.Unlock()
+		return nil
 	}
+	p.interested = true
+	p.mu.Unlock()
 
-	p.downloadedPieceChan <- downloadPieceChan{
-		content: completedPiece,
+	// Send interested message to start
+	err := p.writeMessage([]byte{0, 0, 0, 1, messageIDInterested})
+	if err != nil {
+		return err
 	}
 
+	p.log.Debug("sent interested")
+	return nil
 }
 
-func (p *Peer) handleBitfieldMessage(msg []byte) error {
+func (p *Peer) sendUnchoke() error {
+	p.mu.Lock()
+	if !p.amChoking {
+		p.mu.Unlock()
+		return nil
+	}
+	p.amChoking = false
+	p.mu.Unlock()
+
+	return p.writeMessage([]byte{0, 0, 0, 1, messageIDUnchoke})
+}
+
+// handleRequestMessage uploads the requested block to the peer
+func (p *Peer) handleRequestMessage(msg []byte) error {
+	if len(msg) < 17 {
+		return fmt.Errorf("request message is too short: %d bytes", len(msg))
+	}
+
+	index := binary.BigEndian.Uint32(msg[5:9])
+	begin := binary.BigEndian.Uint32(msg[9:13])
+	length := binary.BigEndian.Uint32(msg[13:17])
+
+	p.mu.Lock()
+	amChoking := p.amChoking
+	p.mu.Unlock()
 
-	piecesBinRep := fmt.Sprintf("%b", msg[5:])
-	for i, pieceIndex := range piecesBinRep {
-		if pieceIndex == '1' {
-			p.availablePiecesIndexes = append(p.availablePiecesIndexes, i)
+	var block []byte
+	var err error
+	if !amChoking && p.serveBlock != nil && length <= blockSize {
+		block, err = p.serveBlock(int(index), int64(begin), int(length))
+	}
+
+	if block == nil || err != nil {
+		// with the fast extension we have to tell the peer, otherwise requests are just ignored
+		if p.fastExtension {
+			return p.writeMessage(append([]byte{0, 0, 0, 13, messageIDRejectRequest}, msg[5:17]...))
 		}
+
+		return nil
 	}
 
-	fmt.Printf("availablePiecesIndexes: %+v\n", p.availablePiecesIndexes)
-	// Send interested message to start
-	_, err := p.conn.Write([]byte{0, 0, 0, 1, messageIDInterested})
+	var piece []byte
+	piece = binary.BigEndian.AppendUint32(piece, uint32(9+len(block)))
+	piece = append(piece, messageIDPiece)
+	piece = binary.BigEndian.AppendUint32(piece, index)
+	piece = binary.BigEndian.AppendUint32(piece, begin)
+	piece = append(piece, block...)
+
+	err = p.writeMessage(piece)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("sent interested message")
+	metricBytes.Add(float64(len(block)), p.infoHashLabel(), "upload")
 	return nil
 }
+
+// infoHashLabel identifies the torrent of the connection in the metrics
+func (p *Peer) infoHashLabel() string {
+	return hex.EncodeToString(p.handshake.InfoHash)
+}
+
+// SendBitfield tells the peer which pieces we have, it's sent right after the handshake
+func (p *Peer) SendBitfield(bf bitfield, numPieces int) error {
+	var count int
+	for i := 0; i < numPieces; i++ {
+		if bf.Has(i) {
+			count++
+		}
+	}
+
+	if p.fastExtension && count == numPieces {
+		return p.writeMessage([]byte{0, 0, 0, 1, messageIDHaveAll})
+	}
+
+	if p.fastExtension && count == 0 {
+		return p.writeMessage([]byte{0, 0, 0, 1, messageIDHaveNone})
+	}
+
+	// the bitfield is optional when we have nothing
+	if count == 0 {
+		return nil
+	}
+
+	var msg []byte
+	msg = binary.BigEndian.AppendUint32(msg, uint32(1+len(bf)))
+	msg = append(msg, messageIDBitfield)
+	msg = append(msg, bf...)
+
+	return p.writeMessage(msg)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// remotePeer is the other end of a connection to a peer, the messages the peer sends arrive on msgs
+type remotePeer struct {
+	t    *testing.T
+	conn net.Conn
+	msgs chan []byte
+}
+
+// pipePeer starts a peer that completed its handshake over an in-memory connection
+func pipePeer(t *testing.T, numPieces int, fast bool) (*Peer, *remotePeer) {
+	t.Helper()
+
+	local, conn := net.Pipe()
+
+	p := NewPeer(netip.MustParseAddrPort("127.0.0.1:6881"))
+	p.conn = local
+	p.numPieces = numPieces
+	p.handshake = &Handshake{InfoHash: make([]byte, 20), PeerID: []byte("-XX0000-000000000000")}
+	if fast {
+		p.handshake.Reserved[7] |= reservedFastExtension
+	}
+	p.start()
+
+	remote := &remotePeer{t: t, conn: conn, msgs: make(chan []byte, 64)}
+	go func() {
+		defer close(remote.msgs)
+
+		for {
+			var length [4]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+
+			msg := make([]byte, 4+binary.BigEndian.Uint32(length[:]))
+			copy(msg, length[:])
+			if _, err := io.ReadFull(conn, msg[4:]); err != nil {
+				return
+			}
+
+			remote.msgs <- msg
+		}
+	}()
+
+	t.Cleanup(func() {
+		p.Close()
+		conn.Close()
+	})
+
+	return p, remote
+}
+
+func (r *remotePeer) send(msg []byte) {
+	r.t.Helper()
+
+	r.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.conn.Write(msg); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// expect waits for the next message of the peer and checks its id
+func (r *remotePeer) expect(id byte) []byte {
+	r.t.Helper()
+
+	select {
+	case msg, ok := <-r.msgs:
+		if !ok {
+			r.t.Fatalf("connection closed while waiting for message %s", messageName(id))
+		}
+		if msg[4] != id {
+			r.t.Fatalf("got message %s, want %s", messageName(msg[4]), messageName(id))
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		r.t.Fatalf("timed out waiting for message %s", messageName(id))
+		return nil
+	}
+}
+
+// indexMessage is a message with a piece index as its payload, like have, suggest and allowed fast
+func indexMessage(id byte, pieceIndex uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte{0, 0, 0, 5, id}, pieceIndex)
+}
+
+// blockMessage is a piece or a reject answering a request
+func blockMessage(id byte, pieceIndex, begin uint32, data []byte) []byte {
+	var msg []byte
+	msg = binary.BigEndian.AppendUint32(msg, uint32(9+len(data)))
+	msg = append(msg, id)
+	msg = binary.BigEndian.AppendUint32(msg, pieceIndex)
+	msg = binary.BigEndian.AppendUint32(msg, begin)
+	return append(msg, data...)
+}
+
+func rejectMessage(pieceIndex, begin, length uint32) []byte {
+	msg := blockMessage(messageIDRejectRequest, pieceIndex, begin, nil)
+	binary.BigEndian.PutUint32(msg, 13)
+	return binary.BigEndian.AppendUint32(msg, length)
+}
+
+// eventually polls cond until it holds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func assertClosed(t *testing.T, p *Peer) {
+	t.Helper()
+
+	select {
+	case <-p.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer wasn't disconnected")
+	}
+}
+
+func TestPeerHaveAll(t *testing.T) {
+	p, remote := pipePeer(t, 20, true)
+
+	remote.send([]byte{0, 0, 0, 1, messageIDHaveAll})
+	remote.expect(messageIDInterested)
+
+	for i := 0; i < 20; i++ {
+		if !p.HasPiece(i) {
+			t.Fatalf("peer that has all doesn't have piece %d", i)
+		}
+	}
+}
+
+func TestPeerHaveNone(t *testing.T) {
+	p, remote := pipePeer(t, 20, true)
+
+	remote.send([]byte{0, 0, 0, 1, messageIDHaveNone})
+	remote.send(indexMessage(messageIDHave, 3))
+	remote.expect(messageIDInterested)
+
+	for i := 0; i < 20; i++ {
+		if p.HasPiece(i) != (i == 3) {
+			t.Fatalf("peer has piece %d: %v", i, p.HasPiece(i))
+		}
+	}
+}
+
+func TestPeerSuggestPiece(t *testing.T) {
+	p, remote := pipePeer(t, 100, true)
+
+	for _, index := range []uint32{1, 2, 1} {
+		remote.send(indexMessage(messageIDSuggestPiece, index))
+	}
+
+	// suggested again, 1 moves first
+	eventually(t, "the suggestions are in", func() bool {
+		s := p.SuggestedPieces()
+		return len(s) == 2 && s[0] == 1 && s[1] == 2
+	})
+
+	for i := 0; i < 2*maxSuggestedPieces; i++ {
+		remote.send(indexMessage(messageIDSuggestPiece, uint32(i)))
+	}
+
+	eventually(t, "the last suggestion is in", func() bool {
+		s := p.SuggestedPieces()
+		return len(s) > 0 && s[0] == 2*maxSuggestedPieces-1
+	})
+
+	if s := p.SuggestedPieces(); len(s) != maxSuggestedPieces {
+		t.Fatalf("peer keeps %d suggestions", len(s))
+	}
+}
+
+func TestPeerAllowedFast(t *testing.T) {
+	p, remote := pipePeer(t, 100, true)
+
+	if p.CanRequest(7) {
+		t.Fatal("can request from a peer that chokes us")
+	}
+
+	remote.send(indexMessage(messageIDAllowedFast, 7))
+
+	eventually(t, "piece 7 is allowed fast", func() bool { return p.CanRequest(7) })
+	if p.CanRequest(8) {
+		t.Fatal("can request a piece that isn't allowed fast from a peer that chokes us")
+	}
+
+	// the set doesn't grow past a handful
+	for i := 0; i < 100; i++ {
+		remote.send(indexMessage(messageIDAllowedFast, uint32(i)))
+	}
+
+	eventually(t, "the last allowed fast message is handled", func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.allowedFast) == maxAllowedFast
+	})
+
+	remote.send(indexMessage(messageIDAllowedFast, 99))
+	remote.send([]byte{0, 0, 0, 1, messageIDHaveAll})
+	remote.expect(messageIDInterested)
+
+	if p.CanRequest(99) {
+		t.Fatal("allowed fast set grew past its bound")
+	}
+}
+
+func TestPeerDropsInvalidMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		fast bool
+		msg  []byte
+	}{
+		{name: "have past the torrent", fast: true, msg: indexMessage(messageIDHave, 10)},
+		{name: "suggest past the torrent", fast: true, msg: indexMessage(messageIDSuggestPiece, 10)},
+		{name: "allowed fast past the torrent", fast: true, msg: indexMessage(messageIDAllowedFast, 1<<31)},
+		{name: "short have", fast: true, msg: []byte{0, 0, 0, 2, messageIDHave, 0}},
+		{name: "bitfield too long", fast: true, msg: []byte{0, 0, 0, 4, messageIDBitfield, 0xff, 0xff, 0xff}},
+		{name: "have all without the extension", msg: []byte{0, 0, 0, 1, messageIDHaveAll}},
+		{name: "reject without the extension", msg: rejectMessage(0, 0, blockSize)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, remote := pipePeer(t, 10, tt.fast)
+
+			remote.send(tt.msg)
+			assertClosed(t, p)
+		})
+	}
+}
+
+func TestPeerDownloadPiece(t *testing.T) {
+	p, remote := pipePeer(t, 1, false)
+
+	data := bytes.Repeat([]byte("0123456789"), (2*blockSize+100)/10)
+	piece := make([]byte, len(data))
+
+	remote.send([]byte{0, 0, 0, 1, messageIDUnchoke})
+	eventually(t, "the peer unchoked us", func() bool { return p.CanRequest(0) })
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- p.downloadPiece(context.Background(), nil, 0, piece)
+	}()
+
+	for begin := 0; begin < len(data); begin += blockSize {
+		req := remote.expect(messageIDRequest)
+
+		index := binary.BigEndian.Uint32(req[5:9])
+		reqBegin := binary.BigEndian.Uint32(req[9:13])
+		length := binary.BigEndian.Uint32(req[13:17])
+		if index != 0 || int(reqBegin) != begin || int(length) != min(blockSize, len(data)-begin) {
+			t.Fatalf("requested piece %d begin %d length %d", index, reqBegin, length)
+		}
+
+		// a late answer to another request comes first, it's skipped
+		remote.send(blockMessage(messageIDPiece, 0, reqBegin+1, []byte("late")))
+		remote.send(blockMessage(messageIDPiece, 0, reqBegin, data[reqBegin:reqBegin+length]))
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(piece, data) {
+		t.Fatal("the piece wasn't put together from its blocks")
+	}
+}
+
+func TestPeerWaitForBlock(t *testing.T) {
+	t.Run("rejected", func(t *testing.T) {
+		p, remote := pipePeer(t, 1, true)
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := p.waitForBlock(context.Background(), 0, blockSize, blockSize)
+			errs <- err
+		}()
+
+		// with the fast extension a choke doesn't fail the request, the reject does
+		remote.send([]byte{0, 0, 0, 1, messageIDChoke})
+		remote.send(rejectMessage(0, blockSize, blockSize))
+
+		if err := <-errs; err == nil {
+			t.Fatal("rejected request succeeded")
+		}
+	})
+
+	t.Run("choked", func(t *testing.T) {
+		p, remote := pipePeer(t, 1, false)
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := p.waitForBlock(context.Background(), 0, 0, blockSize)
+			errs <- err
+		}()
+
+		remote.send([]byte{0, 0, 0, 1, messageIDChoke})
+
+		if err := <-errs; err == nil {
+			t.Fatal("request succeeded after the peer choked us")
+		}
+	})
+
+	t.Run("choke taken back", func(t *testing.T) {
+		p, remote := pipePeer(t, 1, false)
+
+		remote.send([]byte{0, 0, 0, 1, messageIDChoke})
+		remote.send([]byte{0, 0, 0, 1, messageIDUnchoke})
+
+		// the notification of the choke is still pending once the unchoke is handled
+		eventually(t, "the peer unchoked us again", func() bool { return p.CanRequest(0) })
+		if len(p.chockedCh) != 1 {
+			t.Fatal("the choke wasn't notified")
+		}
+
+		blocks := make(chan []byte, 1)
+		errs := make(chan error, 1)
+		go func() {
+			block, err := p.waitForBlock(context.Background(), 0, 0, 4)
+			blocks <- block
+			errs <- err
+		}()
+
+		remote.send(blockMessage(messageIDPiece, 0, 0, []byte("data")))
+
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		if block := <-blocks; string(block) != "data" {
+			t.Fatalf("got block %q", block)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		p, _ := pipePeer(t, 1, true)
+		p.requestTimeout = 20 * time.Millisecond
+
+		_, err := p.waitForBlock(context.Background(), 0, 0, blockSize)
+		if !errors.Is(err, errRequestTimeout) {
+			t.Fatalf("request without an answer: %v", err)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		p, remote := pipePeer(t, 1, true)
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := p.waitForBlock(context.Background(), 0, 0, blockSize)
+			errs <- err
+		}()
+
+		remote.conn.Close()
+
+		if err := <-errs; err == nil {
+			t.Fatal("request succeeded on a closed connection")
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// peerIDPrefix identifies our client and its version in the Azureus style, -<client><version>-
+// https://wiki.theory.org/BitTorrentSpecification#peer_id
+const peerIDPrefix = "-MB0100-"
+
+const peerIDSize = 20
+
+// characters of the random part, they don't need escaping in the announce URLs
+const peerIDAlphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+var errSelfConnection = errors.New("connected to ourselves")
+
+// localPeerID is the id we introduce ourselves with, to the trackers and the peers. It's generated
+// once per process so every torrent and announce uses the same one, -peer-id replaces it.
+var localPeerID = newPeerID()
+
+// setLocalPeerID replaces our id, it must be called before any torrent or session is created
+func setLocalPeerID(id []byte) {
+	localPeerID = id
+	defaultTracker.peerID = id
+}
+
+// newPeerID returns our prefix followed by random characters
+func newPeerID() []byte {
+	id := make([]byte, peerIDSize)
+	copy(id, peerIDPrefix)
+
+	random := id[len(peerIDPrefix):]
+	_, _ = rand.Read(random)
+	for i, b := range random {
+		random[i] = peerIDAlphabet[int(b)%len(peerIDAlphabet)]
+	}
+
+	return id
+}
+
+// parsePeerID accepts the id as 20 characters or as 40 hex digits
+func parsePeerID(s string) ([]byte, error) {
+	switch len(s) {
+	case peerIDSize:
+		return []byte(s), nil
+	case 2 * peerIDSize:
+		id, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer id %q: %w", s, err)
+		}
+		return id, nil
+	default:
+		return nil, fmt.Errorf("invalid peer id %q, expected %d characters or %d hex digits", s, peerIDSize, 2*peerIDSize)
+	}
+}
+
+// isSelf tells if the handshake comes from our own client, like when the tracker returns our address
+func isSelf(h *Handshake, ourID []byte) bool {
+	return len(ourID) > 0 && bytes.Equal(h.PeerID, ourID)
+}
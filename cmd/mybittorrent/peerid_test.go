@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestNewPeerID(t *testing.T) {
+	id := newPeerID()
+
+	if len(id) != peerIDSize || !bytes.HasPrefix(id, []byte(peerIDPrefix)) {
+		t.Fatalf("peer id %q isn't %d bytes starting with %s", id, peerIDSize, peerIDPrefix)
+	}
+
+	for _, c := range id[len(peerIDPrefix):] {
+		if !strings.ContainsRune(peerIDAlphabet, rune(c)) {
+			t.Fatalf("peer id %q has character %q that would be escaped in announces", id, c)
+		}
+	}
+
+	if bytes.Equal(id, newPeerID()) {
+		t.Fatal("two peer ids are the same")
+	}
+}
+
+func TestParsePeerID(t *testing.T) {
+	tests := []struct {
+		id      string
+		want    []byte
+		invalid bool
+	}{
+		{id: "-TR3000-abcdefghijkl", want: []byte("-TR3000-abcdefghijkl")},
+		{id: "2d5452333030302d000102030405060708090a0b", want: append([]byte("-TR3000-"), 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)},
+		{id: "-TR3000-short", invalid: true},
+		{id: "2d5452333030302d000102030405060708090azz", invalid: true},
+		{id: "", invalid: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parsePeerID(tt.id)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("peer id %q parsed as %q", tt.id, got)
+			}
+			continue
+		}
+
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("peer id %q parsed as %q, %v, want %q", tt.id, got, err, tt.want)
+		}
+	}
+}
+
+func TestAcceptSelfConnection(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	p := NewPeer(netip.MustParseAddrPort("127.0.0.1:6881"))
+	p.conn = local
+	p.incoming = true
+
+	// our own handshake, coming back through the tracker's list of peers
+	ours := &Handshake{InfoHash: make([]byte, 20), PeerID: p.localPeerID}
+
+	answers := make(chan *Handshake, 1)
+	go func() {
+		h, _ := readHandshake(remote)
+		answers <- h
+	}()
+
+	err := p.Accept(context.Background(), ours)
+	if !errors.Is(err, errSelfConnection) {
+		t.Fatalf("accepted a connection to ourselves: %v", err)
+	}
+
+	// the dialing side needs the answer to find out it reached itself
+	h := <-answers
+	if h == nil || !isSelf(h, localPeerID) {
+		t.Fatalf("connection to ourselves was answered with %+v", h)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+)
+
+type pieceState int
+
+const (
+	pieceMissing pieceState = iota
+	pieceInProgress
+	pieceDone
+)
+
+// piecePicker decides which piece is downloaded next from a peer
+type piecePicker struct {
+	mu sync.Mutex
+
+	states []pieceState
+
+	// pieces with a higher priority are picked first, skipped pieces are never picked
+	priorities []filePriority
+}
+
+func newPiecePicker(numPieces int) *piecePicker {
+	priorities := make([]filePriority, numPieces)
+	for i := range priorities {
+		priorities[i] = priorityNormal
+	}
+
+	return &piecePicker{
+		states:     make([]pieceState, numPieces),
+		priorities: priorities,
+	}
+}
+
+// SetPriorities changes the priority of every piece, it can be called during the download
+func (pp *piecePicker) SetPriorities(priorities []filePriority) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	pp.priorities = priorities
+}
+
+// Pick returns the next piece to download from the peer and marks it in progress.
+// Pieces are picked by priority, within the same priority the pieces the peer
+// suggested come first. While we are choked only the pieces the peer allowed us
+// to download are considered.
+func (pp *piecePicker) Pick(p *Peer) (int, bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	canDownload := func(index int, priority filePriority) bool {
+		return index >= 0 && index < len(pp.states) &&
+			pp.states[index] == pieceMissing &&
+			pp.priorities[index] == priority &&
+			p.HasPiece(index) &&
+			p.CanRequest(index)
+	}
+
+	suggested := p.SuggestedPieces()
+
+	for priority := priorityHigh; priority > prioritySkip; priority-- {
+		for _, index := range suggested {
+			if canDownload(index, priority) {
+				pp.states[index] = pieceInProgress
+				return index, true
+			}
+		}
+
+		for index := range pp.states {
+			if canDownload(index, priority) {
+				pp.states[index] = pieceInProgress
+				return index, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+func (pp *piecePicker) Done(index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	pp.states[index] = pieceDone
+}
+
+// Failed puts the piece back so it can be picked again
+func (pp *piecePicker) Failed(index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	pp.states[index] = pieceMissing
+}
+
+// Complete reports whether every piece that isn't skipped is downloaded
+func (pp *piecePicker) Complete() bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	for i, state := range pp.states {
+		if state != pieceDone && pp.priorities[i] != prioritySkip {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,26 @@
+package main
+
+import "sync"
+
+// pieceBuffers recycles the buffers pieces are assembled in, so downloading takes as much memory
+// as the pieces in flight, whatever the size of the torrent. The pieces of a torrent all have the
+// same size but the last one, so a buffer almost always fits the next piece.
+var pieceBuffers sync.Pool
+
+// getPieceBuffer returns a buffer for the piece, holding whatever the piece it was used for left in it.
+// Buffers are made at the length of the pieces of the torrent, so the short last piece doesn't
+// leave a buffer in the pool that fits no other piece.
+func getPieceBuffer(info *Info, pieceIndex int) []byte {
+	size := int(info.PieceSize(pieceIndex))
+
+	if buf, ok := pieceBuffers.Get().(*[]byte); ok && cap(*buf) >= size {
+		return (*buf)[:size]
+	}
+
+	return make([]byte, size, max(size, int(info.PieceLength)))
+}
+
+// putPieceBuffer gives a buffer back once the piece in it is stored or dropped, it must not be used after
+func putPieceBuffer(buf []byte) {
+	pieceBuffers.Put(&buf)
+}
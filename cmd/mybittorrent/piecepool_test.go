@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// poolTorrent is a torrent of two pieces of two blocks, the last one shorter
+func poolTorrent(t *testing.T) (*TorrentFile, []byte) {
+	t.Helper()
+
+	data := make([]byte, 3*blockSize+100)
+	rand.Read(data)
+
+	file := &TorrentFile{
+		Info: Info{
+			Name:        "payload.bin",
+			Length:      int64(len(data)),
+			PieceLength: 2 * blockSize,
+			InfoHash:    make([]byte, 20),
+		},
+	}
+
+	for begin := 0; begin < len(data); begin += 2 * blockSize {
+		hash := sha1.Sum(data[begin:min(begin+2*blockSize, len(data))])
+		file.Info.PiecesHash = append(file.Info.PiecesHash, hex.EncodeToString(hash[:]))
+	}
+
+	return file, data
+}
+
+func TestPieceBufferReassembly(t *testing.T) {
+	file, data := poolTorrent(t)
+	info := &file.Info
+
+	for i := range info.PiecesHash {
+		piece := data[i*2*blockSize : min((i+1)*2*blockSize, len(data))]
+
+		// whatever the piece, the buffer fits any piece of the torrent
+		buf := getPieceBuffer(info, i)
+		if len(buf) != len(piece) || cap(buf) < int(info.PieceLength) {
+			t.Fatalf("piece %d got a buffer of %d bytes and capacity %d", i, len(buf), cap(buf))
+		}
+
+		// what a previous piece left in the buffer is overwritten by the blocks
+		for j := range buf {
+			buf[j] = 0xff
+		}
+
+		// the blocks come in any order, each one lands at its offset
+		for begin := (len(piece) - 1) / blockSize * blockSize; begin >= 0; begin -= blockSize {
+			copy(buf[begin:], piece[begin:min(begin+blockSize, len(piece))])
+		}
+
+		if !bytes.Equal(buf, piece) {
+			t.Fatalf("piece %d wasn't put together from its blocks", i)
+		}
+
+		putPieceBuffer(buf)
+	}
+}
+
+func TestPeerDownloadLastPiece(t *testing.T) {
+	file, data := poolTorrent(t)
+	p, remote := pipePeer(t, 2, false)
+
+	// the buffer of a full piece, dirty, is in the pool
+	full := getPieceBuffer(&file.Info, 0)
+	copy(full, bytes.Repeat([]byte{0xff}, len(full)))
+	putPieceBuffer(full)
+
+	remote.send([]byte{0, 0, 0, 1, messageIDUnchoke})
+	eventually(t, "the peer unchoked us", func() bool { return p.CanRequest(1) })
+
+	type result struct {
+		piece []byte
+		err   error
+	}
+	results := make(chan result, 1)
+	go func() {
+		piece, err := p.DownloadPiece(context.Background(), file, 1)
+		results <- result{piece, err}
+	}()
+
+	last := data[2*blockSize:]
+	for range 2 {
+		req := remote.expect(messageIDRequest)
+
+		begin := binary.BigEndian.Uint32(req[9:13])
+		length := binary.BigEndian.Uint32(req[13:17])
+		remote.send(blockMessage(messageIDPiece, 1, begin, last[begin:begin+length]))
+	}
+
+	res := <-results
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if !bytes.Equal(res.piece, last) {
+		t.Fatalf("got a piece of %d bytes, want the %d of the last piece", len(res.piece), len(last))
+	}
+	putPieceBuffer(res.piece)
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how often the terminal display is redrawn
+	ttyProgressInterval = 500 * time.Millisecond
+
+	// how often a line is printed when the output isn't a terminal
+	lineProgressInterval = 5 * time.Second
+
+	// number of cells of the piece map, every cell covers a range of pieces
+	pieceMapWidth = 60
+
+	// weight of the latest interval in the smoothed rates
+	rateSmoothing = 0.3
+)
+
+type progressMode int
+
+const (
+	// redraws a few lines in place
+	progressTTY progressMode = iota
+
+	// prints a line every few seconds, for logs and CI
+	progressLines
+
+	// prints a JSON object per line for programs that wrap us
+	progressJSON
+)
+
+// progressStyle picks the terminal display when the output is a terminal
+func progressStyle(f *os.File, json bool) progressMode {
+	if json {
+		return progressJSON
+	}
+
+	stat, err := f.Stat()
+	if err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+		return progressTTY
+	}
+
+	return progressLines
+}
+
+// progressEvent is what the --json-progress mode prints, one object per line
+type progressEvent struct {
+	// progress, piece, complete or error
+	Event string `json:"event"`
+
+	Piece *int `json:"piece,omitempty"`
+
+	Pieces      int     `json:"pieces"`
+	TotalPieces int     `json:"total_pieces"`
+	Completed   int64   `json:"completed_bytes"`
+	Wanted      int64   `json:"wanted_bytes"`
+	Percent     float64 `json:"percent"`
+
+	// bytes per second
+	DownloadRate int64 `json:"download_rate"`
+	UploadRate   int64 `json:"upload_rate"`
+
+	// missing while the rate is unknown
+	ETASeconds *int64 `json:"eta_seconds,omitempty"`
+
+	Peers int `json:"peers"`
+
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// progressReporter shows how a download is going
+type progressReporter struct {
+	info *Info
+	out  io.Writer
+	mode progressMode
+
+	// pieces we don't download, they don't count towards the progress
+	skipped []bool
+
+	// counters of the transfer, and the number of connected peers
+	uploaded func() int64
+	peers    func() int
+
+	mu        sync.Mutex
+	have      bitfield
+	pieces    int
+	completed int64
+	wanted    int64
+
+	// state of the rate estimation
+	lastTick        time.Time
+	lastCompleted   int64
+	lastUploaded    int64
+	downloadRate    float64
+	uploadRate      float64
+	rateInitialized bool
+
+	// lines of the last terminal frame, they are overwritten by the next one
+	lines int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newProgressReporter(info *Info, out io.Writer, mode progressMode, piecePriorities []filePriority) *progressReporter {
+	r := &progressReporter{
+		info:     info,
+		out:      out,
+		mode:     mode,
+		skipped:  make([]bool, len(info.PiecesHash)),
+		uploaded: func() int64 { return 0 },
+		peers:    func() int { return 0 },
+		have:     newBitfield(len(info.PiecesHash)),
+		lastTick: time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	for i := range info.PiecesHash {
+		if piecePriorities != nil && piecePriorities[i] == prioritySkip {
+			r.skipped[i] = true
+			continue
+		}
+
+		r.wanted += info.PieceSize(i)
+	}
+
+	return r
+}
+
+// Start draws the progress periodically until Finish is called
+func (r *progressReporter) Start() {
+	interval := ttyProgressInterval
+	if r.mode != progressTTY {
+		interval = lineProgressInterval
+	}
+
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.tick()
+			}
+		}
+	}()
+}
+
+// PieceDone records a verified piece
+func (r *progressReporter) PieceDone(pieceIndex int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.have.Has(pieceIndex) {
+		return
+	}
+
+	r.have.Set(pieceIndex)
+	r.pieces++
+	if !r.skipped[pieceIndex] {
+		r.completed += r.info.PieceSize(pieceIndex)
+	}
+
+	// the JSON mode reports every piece, the other modes wait for the next tick
+	if r.mode == progressJSON {
+		event := r.event("piece")
+		event.Piece = &pieceIndex
+		r.writeJSON(event)
+	}
+}
+
+// Finish stops the periodic updates and prints the final state, err is nil when the download succeeded
+func (r *progressReporter) Finish(path string, err error) {
+	close(r.stop)
+	<-r.done
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.updateRates()
+
+	switch r.mode {
+	case progressJSON:
+		event := r.event("complete")
+		event.Path = path
+		if err != nil {
+			event.Event = "error"
+			event.Error = err.Error()
+		}
+		r.writeJSON(event)
+
+	case progressTTY:
+		r.drawFrame()
+
+	default:
+		fmt.Fprintln(r.out, r.summary())
+	}
+}
+
+func (r *progressReporter) tick() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.updateRates()
+
+	switch r.mode {
+	case progressJSON:
+		r.writeJSON(r.event("progress"))
+	case progressTTY:
+		r.drawFrame()
+	default:
+		fmt.Fprintln(r.out, r.summary())
+	}
+}
+
+// updateRates smooths the rates so the display doesn't jump with every piece. Must be called with mu held.
+func (r *progressReporter) updateRates() {
+	now := time.Now()
+	elapsed := now.Sub(r.lastTick).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	uploaded := r.uploaded()
+	download := float64(r.completed-r.lastCompleted) / elapsed
+	upload := float64(uploaded-r.lastUploaded) / elapsed
+
+	if r.rateInitialized {
+		download = rateSmoothing*download + (1-rateSmoothing)*r.downloadRate
+		upload = rateSmoothing*upload + (1-rateSmoothing)*r.uploadRate
+	}
+
+	r.downloadRate, r.uploadRate = download, upload
+	r.rateInitialized = true
+	r.lastTick, r.lastCompleted, r.lastUploaded = now, r.completed, uploaded
+}
+
+// eta returns false while nothing is being downloaded. Must be called with mu held.
+func (r *progressReporter) eta() (time.Duration, bool) {
+	left := r.wanted - r.completed
+	if left <= 0 {
+		return 0, true
+	}
+
+	if r.downloadRate < 1 {
+		return 0, false
+	}
+
+	return time.Duration(float64(left) / r.downloadRate * float64(time.Second)), true
+}
+
+func (r *progressReporter) percent() float64 {
+	if r.wanted == 0 {
+		return 100
+	}
+
+	return float64(r.completed) * 100 / float64(r.wanted)
+}
+
+func (r *progressReporter) event(name string) progressEvent {
+	event := progressEvent{
+		Event:        name,
+		Pieces:       r.pieces,
+		TotalPieces:  len(r.info.PiecesHash),
+		Completed:    r.completed,
+		Wanted:       r.wanted,
+		Percent:      r.percent(),
+		DownloadRate: int64(r.downloadRate),
+		UploadRate:   int64(r.uploadRate),
+		Peers:        r.peers(),
+	}
+
+	if eta, ok := r.eta(); ok {
+		seconds := int64(eta.Seconds())
+		event.ETASeconds = &seconds
+	}
+
+	return event
+}
+
+func (r *progressReporter) writeJSON(event progressEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	r.out.Write(append(line, '\n'))
+}
+
+// summary is the single line of the line mode, and the second line of the terminal display
+func (r *progressReporter) summary() string {
+	eta := "unknown"
+	if d, ok := r.eta(); ok {
+		eta = d.Round(time.Second).String()
+	}
+
+	return fmt.Sprintf("%5.1f%%  %s/%s  down %s/s  up %s/s  eta %s  peers %d",
+		r.percent(), formatBytes(r.completed), formatBytes(r.wanted),
+		formatBytes(int64(r.downloadRate)), formatBytes(int64(r.uploadRate)), eta, r.peers())
+}
+
+// pieceMap draws a cell per range of pieces: '#' when all of them are done, '+' when some are, '.' otherwise.
+// Ranges that are skipped entirely are blank.
+func (r *progressReporter) pieceMap() string {
+	numPieces := len(r.info.PiecesHash)
+	width := min(numPieces, pieceMapWidth)
+
+	var b strings.Builder
+	b.WriteByte('[')
+	for cell := 0; cell < width; cell++ {
+		first := cell * numPieces / width
+		last := (cell+1)*numPieces/width - 1
+
+		var done, wanted int
+		for i := first; i <= last; i++ {
+			if r.skipped[i] {
+				continue
+			}
+
+			wanted++
+			if r.have.Has(i) {
+				done++
+			}
+		}
+
+		switch {
+		case wanted == 0:
+			b.WriteByte(' ')
+		case done == wanted:
+			b.WriteByte('#')
+		case done > 0:
+			b.WriteByte('+')
+		default:
+			b.WriteByte('.')
+		}
+	}
+	b.WriteByte(']')
+
+	return b.String()
+}
+
+// drawFrame replaces the previous frame of the terminal display. Must be called with mu held.
+func (r *progressReporter) drawFrame() {
+	lines := []string{
+		fmt.Sprintf("%s  %d/%d pieces", r.info.Name, r.pieces, len(r.info.PiecesHash)),
+		r.summary(),
+		r.pieceMap(),
+	}
+
+	var b strings.Builder
+
+	// move back to the first line of the previous frame
+	if r.lines > 0 {
+		fmt.Fprintf(&b, "\033[%dA", r.lines)
+	}
+
+	for _, line := range lines {
+		b.WriteString("\r\033[K")
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+
+	r.lines = len(lines)
+	io.WriteString(r.out, b.String())
+}
+
+// formatBytes uses the same binary units as the rate flags
+func formatBytes(n int64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	value := float64(n)
+	for _, suffix := range []string{"KiB", "MiB", "GiB"} {
+		value /= unit
+		if value < unit || suffix == "GiB" {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+	}
+
+	return fmt.Sprintf("%d B", n)
+}
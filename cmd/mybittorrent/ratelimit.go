@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clock is the time source of the rate limiters, so tests can control time
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+const (
+	// the bucket never holds less than a full block message, or a single block could never pass
+	minBurst = blockSize + 13
+)
+
+// rateLimiter is a token bucket that limits a byte stream to a rate in bytes per second.
+// A rate of zero means unlimited.
+type rateLimiter struct {
+	mu    sync.Mutex
+	clock clock
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(clk clock, bytesPerSecond int64) *rateLimiter {
+	l := &rateLimiter{
+		clock: clk,
+		last:  clk.Now(),
+	}
+	l.SetLimit(bytesPerSecond)
+	l.tokens = l.burst
+
+	return l
+}
+
+// SetLimit changes the rate, it can be called while transfers are running
+func (l *rateLimiter) SetLimit(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+
+	l.rate = float64(bytesPerSecond)
+
+	// allow bursts of a quarter of a second
+	l.burst = max(l.rate/4, minBurst)
+	l.tokens = min(l.tokens, l.burst)
+}
+
+func (l *rateLimiter) Limit() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int64(l.rate)
+}
+
+func (l *rateLimiter) refill() {
+	now := l.clock.Now()
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+
+	if elapsed > 0 {
+		l.tokens = min(l.tokens+elapsed*l.rate, l.burst)
+	}
+}
+
+// MaxChunk is the largest amount that should be waited for at once
+func (l *rateLimiter) MaxChunk() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate == 0 {
+		return 0
+	}
+
+	return int(l.burst)
+}
+
+// WaitN blocks until n bytes may pass
+func (l *rateLimiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+
+	// take the tokens now, a negative balance is the time the caller has to wait
+	l.refill()
+	l.tokens -= float64(n)
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+
+	select {
+	case <-l.clock.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// bandwidthLimiter limits both directions of a transfer
+type bandwidthLimiter struct {
+	upload   *rateLimiter
+	download *rateLimiter
+}
+
+func newBandwidthLimiter(clk clock, uploadRate, downloadRate int64) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		upload:   newRateLimiter(clk, uploadRate),
+		download: newRateLimiter(clk, downloadRate),
+	}
+}
+
+// globalBandwidth is shared by every connection of the process
+var globalBandwidth = newBandwidthLimiter(realClock{}, 0, 0)
+
+// rateLimitedConn applies a chain of limiters, like global, torrent and peer, to a connection
+type rateLimitedConn struct {
+	net.Conn
+
+	limiters []*bandwidthLimiter
+
+	// waiting for the limiters is bounded by the deadlines of the connection, and stops when it's closed
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	closed context.Context
+	cancel context.CancelFunc
+}
+
+func newRateLimitedConn(conn net.Conn, limiters ...*bandwidthLimiter) *rateLimitedConn {
+	closed, cancel := context.WithCancel(context.Background())
+
+	return &rateLimitedConn{
+		Conn:     conn,
+		limiters: limiters,
+		closed:   closed,
+		cancel:   cancel,
+	}
+}
+
+func (c *rateLimitedConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+func (c *rateLimitedConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.mu.Unlock()
+
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *rateLimitedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *rateLimitedConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// wait takes n bytes from every limiter, until the deadline passes or the connection is closed.
+// It fails with the errors the connection itself returns in those cases.
+func (c *rateLimitedConn) wait(limiters []*rateLimiter, n int, deadline time.Time) error {
+	ctx := c.closed
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	for _, l := range limiters {
+		err := l.WaitN(ctx, n)
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			return os.ErrDeadlineExceeded
+		case err != nil:
+			return net.ErrClosed
+		}
+	}
+
+	return nil
+}
+
+// chunk returns how much may be transferred at once, so we never wait for more than a bucket holds
+func chunk(size int, limiters []*rateLimiter) int {
+	for _, l := range limiters {
+		if maxChunk := l.MaxChunk(); maxChunk > 0 && maxChunk < size {
+			size = maxChunk
+		}
+	}
+
+	return size
+}
+
+func (c *rateLimitedConn) downloadLimiters() []*rateLimiter {
+	limiters := make([]*rateLimiter, len(c.limiters))
+	for i, l := range c.limiters {
+		limiters[i] = l.download
+	}
+	return limiters
+}
+
+func (c *rateLimitedConn) uploadLimiters() []*rateLimiter {
+	limiters := make([]*rateLimiter, len(c.limiters))
+	for i, l := range c.limiters {
+		limiters[i] = l.upload
+	}
+	return limiters
+}
+
+// Read pays for the bytes after they were read. Reading at most a bucket at a time
+// keeps the data in the kernel buffers, so the sender is slowed down as well.
+func (c *rateLimitedConn) Read(b []byte) (int, error) {
+	limiters := c.downloadLimiters()
+
+	n, err := c.Conn.Read(b[:chunk(len(b), limiters)])
+
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+
+	waitErr := c.wait(limiters, n, deadline)
+	if waitErr != nil {
+		return n, waitErr
+	}
+
+	return n, err
+}
+
+func (c *rateLimitedConn) Write(b []byte) (int, error) {
+	limiters := c.uploadLimiters()
+
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+
+	var written int
+	for written < len(b) {
+		size := chunk(len(b)-written, limiters)
+
+		err := c.wait(limiters, size, deadline)
+		if err != nil {
+			return written, err
+		}
+
+		n, err := c.Conn.Write(b[written : written+size])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// parseRate parses a rate in bytes per second, with an optional K, M or G suffix
+func parseRate(rate string) (int64, error) {
+	s := strings.TrimSpace(strings.ToUpper(rate))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "/S"), "B")
+
+	multiplier := int64(1)
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	// a missing number would be zero, which is no limit at all
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 || math.IsNaN(value) || value*float64(multiplier) >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid rate %q", rate)
+	}
+
+	return int64(value * float64(multiplier)), nil
+}
+
+// rateFlag is a flag.Value holding a rate in bytes per second
+type rateFlag int64
+
+func (r *rateFlag) String() string {
+	return strconv.FormatInt(int64(*r), 10)
+}
+
+func (r *rateFlag) Set(s string) error {
+	rate, err := parseRate(s)
+	if err != nil {
+		return err
+	}
+
+	*r = rateFlag(rate)
+	return nil
+}
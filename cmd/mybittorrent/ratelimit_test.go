@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when the limiters wait on it. With sleep set, waiting moves it
+// forward at once as if the caller slept, so the time it shows is the time the transfers were held back.
+// Without it, a wait never ends.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	sleep bool
+}
+
+func newFakeClock(sleep bool) *fakeClock {
+	return &fakeClock{now: time.Unix(1_000_000, 0), sleep: sleep}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	if !c.sleep {
+		return ch
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	ch <- c.now
+	return ch
+}
+
+// nullConn accepts every write and fills every read
+type nullConn struct {
+	net.Conn
+}
+
+func (nullConn) Read(b []byte) (int, error)       { return len(b), nil }
+func (nullConn) Write(b []byte) (int, error)      { return len(b), nil }
+func (nullConn) Close() error                     { return nil }
+func (nullConn) SetDeadline(time.Time) error      { return nil }
+func (nullConn) SetReadDeadline(time.Time) error  { return nil }
+func (nullConn) SetWriteDeadline(time.Time) error { return nil }
+
+// transfer moves total bytes through the connections in turn, a block at a time, and returns
+// the bytes per second they got on the clock
+func transfer(t *testing.T, clk *fakeClock, total int, upload bool, conns ...*rateLimitedConn) float64 {
+	t.Helper()
+
+	start := clk.Now()
+	buf := make([]byte, blockSize)
+
+	for moved := 0; moved < total; {
+		for _, conn := range conns {
+			var n int
+			var err error
+			if upload {
+				n, err = conn.Write(buf)
+			} else {
+				n, err = conn.Read(buf)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			moved += n
+		}
+	}
+
+	elapsed := clk.Now().Sub(start).Seconds()
+	if elapsed == 0 {
+		return 0
+	}
+
+	return float64(total) / elapsed
+}
+
+// assertRate checks the transfer got the rate of its tightest limit, the burst allowed a bit more
+func assertRate(t *testing.T, got float64, limit int64, total int) {
+	t.Helper()
+
+	burst := max(float64(limit)/4, minBurst)
+	upper := float64(limit) * float64(total) / (float64(total) - burst)
+
+	if got > upper*1.01 || got < float64(limit)*0.99 {
+		t.Fatalf("transferred at %.0f B/s, want %d B/s (at most %.0f with the burst)", got, limit, upper)
+	}
+}
+
+func TestRateLimiterBoundsThroughput(t *testing.T) {
+	const total = 4 << 20
+
+	for _, limit := range []int64{64 << 10, 1 << 20, 8 << 20} {
+		clk := newFakeClock(true)
+		l := newRateLimiter(clk, limit)
+
+		start := clk.Now()
+		for sent := 0; sent < total; sent += blockSize {
+			err := l.WaitN(context.Background(), blockSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got := total / clk.Now().Sub(start).Seconds()
+		assertRate(t, got, limit, total)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	clk := newFakeClock(true)
+	l := newRateLimiter(clk, 0)
+
+	start := clk.Now()
+	for i := 0; i < 100; i++ {
+		err := l.WaitN(context.Background(), 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if waited := clk.Now().Sub(start); waited != 0 {
+		t.Fatalf("unlimited limiter waited %v", waited)
+	}
+}
+
+func TestRateLimitedConnBounds(t *testing.T) {
+	const total = 2 << 20
+
+	tests := []struct {
+		name                  string
+		global, torrent, peer int64
+		want                  int64
+	}{
+		{name: "global", global: 100 << 10, want: 100 << 10},
+		{name: "torrent", global: 1 << 20, torrent: 200 << 10, want: 200 << 10},
+		{name: "peer", global: 1 << 20, torrent: 200 << 10, peer: 50 << 10, want: 50 << 10},
+	}
+
+	for _, tt := range tests {
+		for _, upload := range []bool{true, false} {
+			direction := "download"
+			if upload {
+				direction = "upload"
+			}
+
+			t.Run(tt.name+" "+direction, func(t *testing.T) {
+				clk := newFakeClock(true)
+				limits := func(rate int64) *bandwidthLimiter {
+					return newBandwidthLimiter(clk, rate, rate)
+				}
+
+				conn := newRateLimitedConn(nullConn{}, limits(tt.global), limits(tt.torrent), limits(tt.peer))
+
+				assertRate(t, transfer(t, clk, total, upload, conn), tt.want, total)
+			})
+		}
+	}
+}
+
+func TestRateLimitedConnsShareLimits(t *testing.T) {
+	const total = 2 << 20
+
+	clk := newFakeClock(true)
+	global := newBandwidthLimiter(clk, 1<<20, 1<<20)
+	torrent := newBandwidthLimiter(clk, 300<<10, 300<<10)
+
+	// every peer alone could go faster than the torrent allows
+	var conns []*rateLimitedConn
+	for i := 0; i < 3; i++ {
+		peer := newBandwidthLimiter(clk, 200<<10, 200<<10)
+		conns = append(conns, newRateLimitedConn(nullConn{}, global, torrent, peer))
+	}
+
+	assertRate(t, transfer(t, clk, total, true, conns...), 300<<10, total)
+
+	// two torrents that could each go almost as fast as the global limit share it
+	var torrents []*rateLimitedConn
+	for i := 0; i < 2; i++ {
+		torrent := newBandwidthLimiter(clk, 800<<10, 800<<10)
+		torrents = append(torrents, newRateLimitedConn(nullConn{}, global, torrent, newBandwidthLimiter(clk, 0, 0)))
+	}
+
+	assertRate(t, transfer(t, clk, 4*total, true, torrents...), 1<<20, 4*total)
+}
+
+func TestRateLimitedConnSetLimit(t *testing.T) {
+	const total = 2 << 20
+
+	clk := newFakeClock(true)
+	peer := newBandwidthLimiter(clk, 100<<10, 100<<10)
+	conn := newRateLimitedConn(nullConn{}, peer)
+
+	assertRate(t, transfer(t, clk, total, true, conn), 100<<10, total)
+
+	peer.upload.SetLimit(400 << 10)
+	assertRate(t, transfer(t, clk, total, true, conn), 400<<10, total)
+}
+
+func TestRateLimitedConnDeadline(t *testing.T) {
+	// the clock never lets the bytes through, only the deadline or closing ends the wait
+	clk := newFakeClock(false)
+	limits := newBandwidthLimiter(clk, 1<<10, 1<<10)
+
+	conn := newRateLimitedConn(nullConn{}, limits)
+	conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+
+	_, err := conn.Write(make([]byte, 1<<20))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write past the deadline: %v", err)
+	}
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("deadline error is not a timeout: %v", err)
+	}
+
+	// the first read would pass on the burst
+	limits.download.WaitN(context.Background(), minBurst)
+	conn = newRateLimitedConn(nullConn{}, limits)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, blockSize))
+		done <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	conn.Close()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("read of a closed connection: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing the connection didn't end the read")
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate    string
+		want    int64
+		invalid bool
+	}{
+		{rate: "0", want: 0},
+		{rate: "1000", want: 1000},
+		{rate: "512K", want: 512 << 10},
+		{rate: "1.5M", want: 3 << 19},
+		{rate: "2G", want: 2 << 30},
+		{rate: "100kb", want: 100 << 10},
+		{rate: "1MB/s", want: 1 << 20},
+		{rate: " 10 ", want: 10},
+		{rate: "", invalid: true},
+		{rate: "K", invalid: true},
+		{rate: "MB/s", invalid: true},
+		{rate: "1KM", invalid: true},
+		{rate: "10GGG", invalid: true},
+		{rate: "-1K", invalid: true},
+		{rate: "fast", invalid: true},
+		{rate: "inf", invalid: true},
+		{rate: "NaN", invalid: true},
+		{rate: "1e30G", invalid: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseRate(tt.rate)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("rate %q parsed as %d", tt.rate, got)
+			}
+			continue
+		}
+
+		if err != nil || got != tt.want {
+			t.Errorf("rate %q parsed as %d, %v, want %d", tt.rate, got, err, tt.want)
+		}
+	}
+}
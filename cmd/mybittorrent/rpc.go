@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// the daemon speaks JSON-RPC 2.0 over HTTP POST requests to rpcPath
+const (
+	rpcPath = "/rpc"
+
+	defaultRPCAddr = "127.0.0.1:9090"
+
+	// largest request we accept, a .torrent file is sent inside of it
+	maxRPCRequestSize = 16 << 20
+
+	rpcTimeout = 30 * time.Second
+)
+
+// error codes defined by the JSON-RPC specification, rpcErrServer is used for every failed call
+const (
+	rpcErrParse          = -32700
+	rpcErrInvalidRequest = -32600
+	rpcErrMethodNotFound = -32601
+	rpcErrInvalidParams  = -32602
+	rpcErrServer         = -32000
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// the params and results of the methods
+
+type addTorrentParams struct {
+	// content of the .torrent file
+	Metainfo []byte `json:"metainfo,omitempty"`
+
+	// path of a .torrent file on the machine of the daemon
+	Path string `json:"path,omitempty"`
+
+	// the metadata of the torrent is fetched from its peers, which can take up to a couple of minutes
+	Magnet string `json:"magnet,omitempty"`
+
+	// where to save the torrent, defaults to its name in the download directory of the daemon
+	Output string `json:"output,omitempty"`
+
+	// same as the --files and --priority flags of the download command
+	Files      string   `json:"files,omitempty"`
+	Priorities []string `json:"priorities,omitempty"`
+}
+
+type infoHashParams struct {
+	InfoHash string `json:"info_hash"`
+}
+
+type setLimitsParams struct {
+	// the limits of a single torrent, the global limits when empty
+	InfoHash string `json:"info_hash,omitempty"`
+
+	// the directions that are left out keep their limit
+	UploadRate   *int64 `json:"upload_rate,omitempty"`
+	DownloadRate *int64 `json:"download_rate,omitempty"`
+}
+
+type torrentJSON struct {
+	InfoHash    string  `json:"info_hash"`
+	Name        string  `json:"name"`
+	State       string  `json:"state"`
+	Private     bool    `json:"private"`
+	Error       string  `json:"error,omitempty"`
+	Pieces      int     `json:"pieces"`
+	TotalPieces int     `json:"total_pieces"`
+	Completed   int64   `json:"completed"`
+	Length      int64   `json:"length"`
+	Progress    float64 `json:"progress"`
+
+	// from the last announce, -1 when the tracker doesn't say
+	Seeders        int64  `json:"seeders"`
+	Leechers       int64  `json:"leechers"`
+	TrackerError   string `json:"tracker_error,omitempty"`
+	TrackerWarning string `json:"tracker_warning,omitempty"`
+}
+
+func newTorrentJSON(status TorrentStatus) torrentJSON {
+	t := torrentJSON{
+		InfoHash:    status.InfoHash,
+		Name:        status.Name,
+		State:       status.State.String(),
+		Private:     status.Private,
+		Pieces:      status.Pieces,
+		TotalPieces: status.TotalPieces,
+		Completed:   status.Completed,
+		Length:      status.Length,
+		Progress:    100,
+
+		Seeders:        status.Tracker.Seeders,
+		Leechers:       status.Tracker.Leechers,
+		TrackerWarning: status.Tracker.Warning,
+	}
+
+	if status.Err != nil {
+		t.Error = status.Err.Error()
+	}
+
+	if status.Tracker.Err != nil {
+		t.TrackerError = status.Tracker.Err.Error()
+	}
+
+	if status.Length > 0 {
+		t.Progress = float64(status.Completed) * 100 / float64(status.Length)
+	}
+
+	return t
+}
+
+type peerJSON struct {
+	Addr          string `json:"addr"`
+	PeerID        string `json:"peer_id"`
+	Incoming      bool   `json:"incoming"`
+	Choked        bool   `json:"choked"`
+	Interested    bool   `json:"interested"`
+	FastExtension bool   `json:"fast_extension"`
+	Pieces        int    `json:"pieces"`
+}
+
+// rpcServer exposes a session over JSON-RPC
+type rpcServer struct {
+	session *Session
+
+	// where torrents are saved when the caller doesn't say
+	downloadDir string
+
+	methods map[string]func(ctx context.Context, params json.RawMessage) (any, error)
+}
+
+func newRPCServer(session *Session, downloadDir string) *rpcServer {
+	s := &rpcServer{
+		session:     session,
+		downloadDir: downloadDir,
+	}
+
+	s.methods = map[string]func(ctx context.Context, params json.RawMessage) (any, error){
+		"torrent.add":    s.add,
+		"torrent.list":   s.list,
+		"torrent.status": s.status,
+		"torrent.pause":  s.pause,
+		"torrent.resume": s.resume,
+		"torrent.remove": s.remove,
+		"torrent.peers":  s.peers,
+		"session.limits": s.setLimits,
+	}
+
+	return s
+}
+
+func (s *rpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// a web page can make the browser post to us, but only with a simple content type and always with
+	// its origin. JSON needs a preflight we never answer, and ctl sends no origin.
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "the content type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if r.Header.Get("Origin") != "" {
+		http.Error(w, "requests from web pages are not allowed", http.StatusForbidden)
+		return
+	}
+
+	resp := s.handle(r.Context(), http.MaxBytesReader(w, r.Body, maxRPCRequestSize))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *rpcServer) handle(ctx context.Context, body io.Reader) *rpcResponse {
+	resp := &rpcResponse{
+		JSONRPC: "2.0",
+		ID:      json.RawMessage("null"),
+	}
+
+	var req rpcRequest
+	err := json.NewDecoder(body).Decode(&req)
+	if err != nil {
+		resp.Error = &rpcError{Code: rpcErrParse, Message: err.Error()}
+		return resp
+	}
+
+	if len(req.ID) > 0 {
+		resp.ID = req.ID
+	}
+
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		resp.Error = &rpcError{Code: rpcErrInvalidRequest, Message: "expected a JSON-RPC 2.0 request"}
+		return resp
+	}
+
+	method, ok := s.methods[req.Method]
+	if !ok {
+		resp.Error = &rpcError{Code: rpcErrMethodNotFound, Message: fmt.Sprintf("unknown method %q", req.Method)}
+		return resp
+	}
+
+	result, err := method(ctx, req.Params)
+	if err != nil {
+		code := rpcErrServer
+
+		var paramsErr *invalidParamsError
+		if errors.As(err, &paramsErr) {
+			code = rpcErrInvalidParams
+		}
+
+		resp.Error = &rpcError{Code: code, Message: err.Error()}
+		return resp
+	}
+
+	resp.Result, err = json.Marshal(result)
+	if err != nil {
+		resp.Error = &rpcError{Code: rpcErrServer, Message: err.Error()}
+	}
+
+	return resp
+}
+
+// invalidParamsError is returned for params that don't decode or are missing
+type invalidParamsError struct {
+	err error
+}
+
+func (e *invalidParamsError) Error() string {
+	return "invalid params: " + e.err.Error()
+}
+
+func (e *invalidParamsError) Unwrap() error {
+	return e.err
+}
+
+func decodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 {
+		return nil
+	}
+
+	err := json.Unmarshal(params, v)
+	if err != nil {
+		return &invalidParamsError{err}
+	}
+
+	return nil
+}
+
+// torrent decodes the info hash of the params and returns its torrent
+func (s *rpcServer) torrent(params json.RawMessage) (*Torrent, error) {
+	var p infoHashParams
+	err := decodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	infoHash, err := parseInfoHash(p.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.session.lookup(infoHash)
+}
+
+func parseInfoHash(s string) ([]byte, error) {
+	infoHash, err := hex.DecodeString(s)
+	if err != nil || len(infoHash) != 20 {
+		return nil, &invalidParamsError{fmt.Errorf("info hash %q is not 40 hex characters", s)}
+	}
+
+	return infoHash, nil
+}
+
+func (s *rpcServer) add(ctx context.Context, params json.RawMessage) (any, error) {
+	var p addTorrentParams
+	err := decodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	var file *TorrentFile
+	switch {
+	case len(p.Metainfo) > 0:
+		file, err = ParseTorrentFile(p.Metainfo)
+	case p.Path != "":
+		file, err = NewTorrentFile(p.Path)
+	case p.Magnet != "":
+		var link *magnetLink
+		link, err = parseMagnet(p.Magnet)
+		if err != nil {
+			return nil, &invalidParamsError{err}
+		}
+
+		if t := s.session.Torrent(link.InfoHash); t != nil {
+			return newTorrentJSON(t.Status()), nil
+		}
+
+		file, err = s.session.ResolveMagnet(ctx, link)
+	default:
+		return nil, &invalidParamsError{errors.New("one of metainfo, path or magnet is required")}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	filePriorities, err := fileSelection(&file.Info, p.Files, p.Priorities)
+	if err != nil {
+		return nil, &invalidParamsError{err}
+	}
+
+	out := p.Output
+	if out == "" {
+		out = filepath.Join(s.downloadDir, file.Info.Name)
+	}
+
+	storage, err := newFileStorage(&file.Info, out, filePriorities)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := s.session.AddTorrent(file, storage, filePriorities)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	return newTorrentJSON(t.Status()), nil
+}
+
+func (s *rpcServer) list(ctx context.Context, params json.RawMessage) (any, error) {
+	torrents := []torrentJSON{}
+	for _, t := range s.session.Torrents() {
+		torrents = append(torrents, newTorrentJSON(t.Status()))
+	}
+
+	return torrents, nil
+}
+
+func (s *rpcServer) status(ctx context.Context, params json.RawMessage) (any, error) {
+	t, err := s.torrent(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTorrentJSON(t.Status()), nil
+}
+
+func (s *rpcServer) pause(ctx context.Context, params json.RawMessage) (any, error) {
+	t, err := s.torrent(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, s.session.Pause(t.InfoHash())
+}
+
+func (s *rpcServer) resume(ctx context.Context, params json.RawMessage) (any, error) {
+	t, err := s.torrent(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, s.session.Resume(t.InfoHash())
+}
+
+func (s *rpcServer) remove(ctx context.Context, params json.RawMessage) (any, error) {
+	t, err := s.torrent(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, s.session.Remove(t.InfoHash())
+}
+
+func (s *rpcServer) peers(ctx context.Context, params json.RawMessage) (any, error) {
+	t, err := s.torrent(params)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := []peerJSON{}
+	for _, p := range t.Peers() {
+		peers = append(peers, peerJSON{
+			Addr:          p.Addr,
+			PeerID:        string(p.PeerID),
+			Incoming:      p.Incoming,
+			Choked:        p.Choked,
+			Interested:    p.Interested,
+			FastExtension: p.FastExtension,
+			Pieces:        p.Pieces,
+		})
+	}
+
+	return peers, nil
+}
+
+func (s *rpcServer) setLimits(ctx context.Context, params json.RawMessage) (any, error) {
+	var p setLimitsParams
+	err := decodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	if (p.UploadRate != nil && *p.UploadRate < 0) || (p.DownloadRate != nil && *p.DownloadRate < 0) {
+		return nil, &invalidParamsError{errors.New("rates can't be negative")}
+	}
+
+	limiter := globalBandwidth
+	if p.InfoHash != "" {
+		infoHash, err := parseInfoHash(p.InfoHash)
+		if err != nil {
+			return nil, err
+		}
+
+		t, err := s.session.lookup(infoHash)
+		if err != nil {
+			return nil, err
+		}
+
+		limiter = t.Bandwidth()
+	}
+
+	if p.UploadRate != nil {
+		limiter.upload.SetLimit(*p.UploadRate)
+	}
+	if p.DownloadRate != nil {
+		limiter.download.SetLimit(*p.DownloadRate)
+	}
+
+	return nil, nil
+}
+
+// listenRPC listens on a TCP address, or on a unix socket for addresses like unix:/run/mybittorrent.sock
+func listenRPC(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	// a socket left behind by a daemon that didn't shut down cleanly
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("a daemon is already listening on %s", path)
+		}
+
+		os.Remove(path)
+	}
+
+	return net.Listen("unix", path)
+}
+
+// rpcClient calls the methods of a running daemon
+type rpcClient struct {
+	url        string
+	httpClient *http.Client
+	nextID     int
+}
+
+func newRPCClient(addr string) *rpcClient {
+	c := &rpcClient{
+		url:        "http://" + addr + rpcPath,
+		httpClient: &http.Client{Timeout: rpcTimeout},
+	}
+
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// the host of the URL is ignored, every request goes to the socket
+		c.url = "http://unix" + rpcPath
+		c.httpClient.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		}
+	}
+
+	return c
+}
+
+// Call calls the method and decodes its result into result, which may be nil
+func (c *rpcClient) Call(ctx context.Context, method string, params any, result any) error {
+	c.nextID++
+
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(rpcRequest{
+		JSONRPC: "2.0",
+		ID:      json.RawMessage(fmt.Sprint(c.nextID)),
+		Method:  method,
+		Params:  rawParams,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the daemon: %w", err)
+	}
+
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("daemon answered with status code %d", httpResp.StatusCode)
+	}
+
+	var resp rpcResponse
+	err = json.NewDecoder(httpResp.Body).Decode(&resp)
+	if err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	if result == nil || len(resp.Result) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(resp.Result, result)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRPCServerRejectsWebPages(t *testing.T) {
+	server := httptest.NewServer(newRPCServer(nil, t.TempDir()))
+	defer server.Close()
+
+	body := `{"jsonrpc":"2.0","id":1,"method":"unknown.method"}`
+
+	tests := []struct {
+		name        string
+		contentType string
+		origin      string
+		want        int
+	}{
+		{name: "ctl", contentType: "application/json", want: http.StatusOK},
+		{name: "charset", contentType: "application/json; charset=utf-8", want: http.StatusOK},
+		{name: "form without preflight", contentType: "text/plain", want: http.StatusUnsupportedMediaType},
+		{name: "no content type", want: http.StatusUnsupportedMediaType},
+		{name: "web page", contentType: "application/json", origin: "https://example.com", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, server.URL+rpcPath, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.want {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestRPCServerLimits(t *testing.T) {
+	server := httptest.NewServer(newRPCServer(nil, t.TempDir()))
+	defer server.Close()
+
+	client := newRPCClient(strings.TrimPrefix(server.URL, "http://"))
+
+	upload, download := globalBandwidth.upload.Limit(), globalBandwidth.download.Limit()
+	t.Cleanup(func() {
+		globalBandwidth.upload.SetLimit(upload)
+		globalBandwidth.download.SetLimit(download)
+	})
+
+	rate := func(r int64) *int64 { return &r }
+
+	err := client.Call(context.Background(), "session.limits", setLimitsParams{UploadRate: rate(1000), DownloadRate: rate(2000)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the direction that is left out keeps its limit
+	err = client.Call(context.Background(), "session.limits", setLimitsParams{UploadRate: rate(0)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := globalBandwidth.upload.Limit(); got != 0 {
+		t.Errorf("upload limited to %d, want unlimited", got)
+	}
+	if got := globalBandwidth.download.Limit(); got != 2000 {
+		t.Errorf("download limited to %d, want 2000", got)
+	}
+
+	err = client.Call(context.Background(), "session.limits", setLimitsParams{DownloadRate: rate(-1)}, nil)
+	if err == nil {
+		t.Fatal("negative rate was accepted")
+	}
+}
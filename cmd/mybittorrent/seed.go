@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// seeder uploads the pieces of a complete torrent to the peers that connect to us
+type seeder struct {
+	file    *TorrentFile
+	storage Storage
+
+	// the id we introduce ourselves with to the peers
+	peerID []byte
+
+	// reports which pieces we have while the torrent is still downloading, nil when we have all of them
+	hasPiece func(pieceIndex int) bool
+
+	// the connected peers are added to it, may be nil
+	peers *peerSet
+
+	// called with the size of every block we serve, may be nil
+	onUpload func(length int)
+
+	log *slog.Logger
+
+	// limits of the whole torrent
+	bandwidth *bandwidthLimiter
+
+	// upload limit of every single peer, zero for unlimited
+	peerUploadRate int64
+}
+
+func newSeeder(file *TorrentFile, storage Storage) *seeder {
+	return &seeder{
+		file:      file,
+		storage:   storage,
+		peerID:    localPeerID,
+		bandwidth: newBandwidthLimiter(realClock{}, 0, 0),
+		log:       torrentLogger(file),
+	}
+}
+
+// Serve accepts peers from the listener until the context is canceled
+func (s *seeder) Serve(ctx context.Context, ln net.Listener) error {
+	stop := context.AfterFunc(ctx, func() {
+		ln.Close()
+	})
+	defer stop()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return err
+		}
+
+		go s.handle(ctx, conn)
+	}
+}
+
+func (s *seeder) handle(ctx context.Context, conn net.Conn) {
+	handshakeCtx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+
+	theirs, err := ReadHandshake(handshakeCtx, conn)
+	if err != nil {
+		s.log.Debug("failed to read handshake", "peer", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+
+	if !bytes.Equal(theirs.InfoHash, s.file.Info.InfoHash) {
+		s.log.Debug("peer asked for an unknown torrent", "peer", conn.RemoteAddr(), "info_hash", fmt.Sprintf("%x", theirs.InfoHash))
+		conn.Close()
+		return
+	}
+
+	s.serve(ctx, conn, theirs)
+}
+
+// serve uploads to a peer whose handshake was already read
+func (s *seeder) serve(ctx context.Context, conn net.Conn, theirs *Handshake) {
+	handshakeCtx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+
+	peer, err := NewIncomingPeer(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	peer.sharedBandwidth = []*bandwidthLimiter{globalBandwidth, s.bandwidth}
+	peer.bandwidth.upload.SetLimit(s.peerUploadRate)
+	peer.log = s.log.With("peer", peer.String())
+	peer.serveBlock = s.readBlock
+	peer.localPeerID = s.peerID
+	peer.numPieces = len(s.file.Info.PiecesHash)
+
+	err = peer.Accept(handshakeCtx, theirs)
+	if err != nil {
+		peer.log.Debug("failed to accept peer", "err", err)
+		return
+	}
+
+	defer peer.Close()
+
+	if s.peers != nil {
+		s.peers.Add(peer)
+		defer s.peers.Remove(peer)
+	}
+
+	numPieces := len(s.file.Info.PiecesHash)
+	have := newBitfield(numPieces)
+	for i := 0; i < numPieces; i++ {
+		if s.hasPiece == nil || s.hasPiece(i) {
+			have.Set(i)
+		}
+	}
+
+	err = peer.SendBitfield(have, numPieces)
+	if err != nil {
+		return
+	}
+
+	peer.log.Info("seeding to peer")
+
+	select {
+	case <-peer.Done():
+	case <-ctx.Done():
+	}
+}
+
+func (s *seeder) readBlock(pieceIndex int, begin int64, length int) ([]byte, error) {
+	if s.hasPiece != nil && !s.hasPiece(pieceIndex) {
+		return nil, fmt.Errorf("we don't have piece %d", pieceIndex)
+	}
+
+	block := make([]byte, length)
+	_, err := s.storage.ReadAt(block, pieceIndex, begin)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.onUpload != nil {
+		s.onUpload(length)
+	}
+
+	return block, nil
+}
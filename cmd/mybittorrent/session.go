@@ -0,0 +1,1045 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// how often the transfer rates of the torrents are updated
+	rateInterval = time.Second
+)
+
+var (
+	errUnknownTorrent   = errors.New("unknown torrent")
+	errDuplicateTorrent = errors.New("torrent already added")
+	errSessionClosed    = errors.New("session closed")
+)
+
+// SessionConfig holds the limits shared by all the torrents of a session, zero means no limit
+type SessionConfig struct {
+	// address to accept peers on, over TCP and uTP
+	ListenAddr string
+
+	// connections to peers, incoming and outgoing, across all the torrents
+	MaxConnections int
+
+	// connections every torrent downloads from
+	MaxPeersPerTorrent int
+
+	// torrents that are checked or downloaded at the same time, the others wait in the queue
+	MaxActiveDownloads int
+
+	// torrents that are seeded at the same time
+	MaxActiveSeeds int
+
+	// limits of every single peer in bytes per second
+	PeerUploadRate   int64
+	PeerDownloadRate int64
+
+	Transport transportPolicy
+
+	// the id we introduce ourselves with, the id of the process when nil
+	PeerID []byte
+
+	// find the peers of the public torrents on the local network too
+	LocalDiscovery bool
+}
+
+// Session runs many torrents at the same time. It owns what they share: the listen socket,
+// our peer id, the tracker client and the connection limit. Incoming peers are routed to the
+// torrent they asked for by the info hash of their handshake.
+type Session struct {
+	config SessionConfig
+	peerID []byte
+
+	tcp     net.Listener
+	utp     *utpSocket
+	dialer  *peerDialer
+	tracker *trackerClient
+
+	// nil when local service discovery is off
+	lsd *lsdService
+
+	// a slot is taken for every open connection, nil for no limit
+	connSlots chan struct{}
+
+	// a slot is taken while a connection to a peer is set up
+	dialSlots chan struct{}
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	started time.Time
+
+	mu       sync.Mutex
+	closed   bool
+	torrents map[string]*Torrent
+
+	// the id of the next torrent that is added, ids are never reused
+	nextID int
+
+	// torrents in the order they were added, queued torrents are started in that order
+	order []*Torrent
+}
+
+// NewSession listens on the address of the config and starts accepting peers
+func NewSession(config SessionConfig) (*Session, error) {
+	tcp, err := net.Listen("tcp", config.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// uTP listens on the same port as TCP, which is the one we announce
+	utp, err := ListenUTP(tcp.Addr().String())
+	if err != nil {
+		tcp.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &Session{
+		config:   config,
+		peerID:   config.PeerID,
+		tcp:      tcp,
+		utp:      utp,
+		dialer:   newSocketDialer(config.Transport, utp),
+		ctx:      ctx,
+		cancel:   cancel,
+		started:  time.Now(),
+		torrents: make(map[string]*Torrent),
+
+		// dials of all the torrents wait for each other, or a session starting many would flood the network
+		dialSlots: make(chan struct{}, defaultMaxDials),
+	}
+
+	if s.peerID == nil {
+		s.peerID = localPeerID
+	}
+
+	s.tracker = defaultTracker.withIdentity(s.peerID, tcp.Addr().(*net.TCPAddr).Port)
+
+	if config.MaxConnections > 0 {
+		s.connSlots = make(chan struct{}, config.MaxConnections)
+	}
+
+	// multicast would tell the network about us, which the proxy is there to prevent
+	if config.LocalDiscovery && !proxyOnly {
+		s.lsd, err = newLSDService(tcp.Addr().(*net.TCPAddr).Port, s.localPeer)
+		if err != nil {
+			slog.Warn("local service discovery is off", "err", err)
+		}
+	}
+
+	if s.lsd != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.lsd.Run(ctx)
+		}()
+	}
+
+	for _, ln := range []net.Listener{tcp, utp} {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.acceptLoop(ln)
+		}()
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.updateRates()
+	}()
+
+	metrics.AddCollector(s.collectMetrics)
+
+	return s, nil
+}
+
+// collectMetrics counts the peers of every torrent
+func (s *Session) collectMetrics() {
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	for _, t := range s.Torrents() {
+		var choked, interested int
+
+		peers := t.Peers()
+		for _, p := range peers {
+			if p.Choked {
+				choked++
+			}
+			if p.Interested {
+				interested++
+			}
+		}
+
+		infoHash := hex.EncodeToString(t.InfoHash())
+		metricPeers.Set(float64(len(peers)), infoHash, "connected")
+		metricPeers.Set(float64(choked), infoHash, "choked")
+		metricPeers.Set(float64(interested), infoHash, "interested")
+	}
+}
+
+func (s *Session) updateRates() {
+	ticker := time.NewTicker(rateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, t := range s.Torrents() {
+			t.updateRates(rateInterval)
+		}
+	}
+}
+
+// Uptime is how long the session has been running
+func (s *Session) Uptime() time.Duration {
+	return time.Since(s.started)
+}
+
+// Addr is the address the session accepts peers on
+func (s *Session) Addr() net.Addr {
+	return s.tcp.Addr()
+}
+
+func (s *Session) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.ctx.Err() == nil {
+				slog.Error("failed to accept peer", "err", err)
+			}
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+// localPeer hands a peer found on the local network to the torrent it announced, if it's downloading it
+func (s *Session) localPeer(infoHash []byte, addr netip.AddrPort) {
+	t := s.Torrent(infoHash)
+	if t == nil || !t.file.Info.discoverable() || t.State() != TorrentDownloading {
+		return
+	}
+
+	t.log.Debug("found peer on the local network", "peer", addr)
+	t.downloader.AddPeers([]*Peer{NewPeer(addr)})
+}
+
+// handle reads the handshake of an incoming peer and hands it to the torrent it asked for
+func (s *Session) handle(conn net.Conn) {
+	handshakeCtx, cancel := context.WithTimeout(s.ctx, handshakeTimeout)
+	defer cancel()
+
+	theirs, err := ReadHandshake(handshakeCtx, conn)
+	if err != nil {
+		slog.Debug("failed to read handshake", "peer", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+
+	t := s.Torrent(theirs.InfoHash)
+	if t == nil {
+		slog.Debug("peer asked for an unknown torrent", "peer", conn.RemoteAddr(), "info_hash", fmt.Sprintf("%x", theirs.InfoHash))
+		conn.Close()
+		return
+	}
+
+	ctx, ok := t.serving()
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	if s.connSlots != nil {
+		select {
+		case s.connSlots <- struct{}{}:
+			defer func() { <-s.connSlots }()
+		default:
+			// too many connections, we don't wait for one to free up
+			conn.Close()
+			return
+		}
+	}
+
+	t.seeder.serve(ctx, conn, theirs)
+}
+
+// AddTorrent adds a torrent stored in storage, the session closes the storage when the torrent
+// is removed. filePriorities may be nil to download every file. The data that is already in the
+// storage is checked before anything is downloaded.
+func (s *Session) AddTorrent(file *TorrentFile, storage Storage, filePriorities []filePriority) (*Torrent, error) {
+	if filePriorities == nil {
+		filePriorities = make([]filePriority, len(file.Info.Files))
+		for i := range filePriorities {
+			filePriorities[i] = priorityNormal
+		}
+	}
+
+	t := &Torrent{
+		session:        s,
+		file:           file,
+		storage:        storage,
+		filePriorities: filePriorities,
+		added:          time.Now(),
+		have:           newBitfield(len(file.Info.PiecesHash)),
+		peers:          newPeerSet(),
+		log:            torrentLogger(file),
+		state:          TorrentQueued,
+	}
+
+	t.downloader = newDownloader(file, storage)
+	t.downloader.picker.SetPriorities(piecePriorities(&file.Info, filePriorities))
+	t.downloader.dialer = s.dialer
+	t.downloader.peerID = s.peerID
+	t.downloader.connSlots = s.connSlots
+	t.downloader.dialSlots = s.dialSlots
+	t.downloader.conns.maxPeers = s.config.MaxPeersPerTorrent
+	t.downloader.onPiece = func(pieceIndex int) {
+		t.downloaded.Add(file.Info.PieceSize(pieceIndex))
+		t.pieceDone(pieceIndex)
+	}
+	t.downloader.peers = t.peers
+	t.downloader.peerUploadRate = s.config.PeerUploadRate
+	t.downloader.peerDownloadRate = s.config.PeerDownloadRate
+
+	t.seeder = newSeeder(file, storage)
+	t.seeder.peerID = s.peerID
+	t.seeder.bandwidth = t.downloader.bandwidth
+	t.seeder.hasPiece = t.hasPiece
+	t.seeder.peers = t.peers
+	t.seeder.peerUploadRate = s.config.PeerUploadRate
+	t.seeder.onUpload = func(length int) {
+		t.uploaded.Add(int64(length))
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, errSessionClosed
+	}
+
+	key := string(file.Info.InfoHash)
+	if _, ok := s.torrents[key]; ok {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%x: %w", file.Info.InfoHash, errDuplicateTorrent)
+	}
+
+	s.nextID++
+	t.id = s.nextID
+
+	s.torrents[key] = t
+	s.order = append(s.order, t)
+	s.mu.Unlock()
+
+	s.schedule()
+
+	return t, nil
+}
+
+// TorrentByID returns the torrent with the id, nil if there is none
+func (s *Session) TorrentByID(id int) *Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.order {
+		if t.id == id {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// Torrent returns the torrent with the info hash, nil if it wasn't added
+func (s *Session) Torrent(infoHash []byte) *Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.torrents[string(infoHash)]
+}
+
+// Torrents returns every torrent in the order they were added
+func (s *Session) Torrents() []*Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	torrents := make([]*Torrent, len(s.order))
+	copy(torrents, s.order)
+
+	return torrents
+}
+
+func (s *Session) lookup(infoHash []byte) (*Torrent, error) {
+	t := s.Torrent(infoHash)
+	if t == nil {
+		return nil, fmt.Errorf("%x: %w", infoHash, errUnknownTorrent)
+	}
+
+	return t, nil
+}
+
+// Remove stops the torrent and closes its storage, the downloaded data is kept
+func (s *Session) Remove(infoHash []byte) error {
+	t, err := s.lookup(infoHash)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.torrents, string(infoHash))
+	for i, other := range s.order {
+		if other == t {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	t.stop(TorrentPaused)
+	s.schedule()
+
+	metricPeers.DeleteMatching("info_hash", hex.EncodeToString(infoHash))
+
+	return t.storage.Close()
+}
+
+// Pause stops the torrent until it's resumed, the pieces it already has are kept
+func (s *Session) Pause(infoHash []byte) error {
+	t, err := s.lookup(infoHash)
+	if err != nil {
+		return err
+	}
+
+	t.stop(TorrentPaused)
+	s.schedule()
+
+	return nil
+}
+
+// Resume puts a paused or failed torrent back in the queue
+func (s *Session) Resume(infoHash []byte) error {
+	t, err := s.lookup(infoHash)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	if t.state == TorrentPaused || t.state == TorrentFailed {
+		t.state = TorrentQueued
+		t.err = nil
+	}
+	t.mu.Unlock()
+
+	s.schedule()
+
+	return nil
+}
+
+// schedule starts the queued torrents while there are free slots. A torrent that wasn't checked
+// yet needs a download slot, since we don't know whether it's complete.
+func (s *Session) schedule() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	var downloads, seeds int
+	for _, t := range s.order {
+		switch t.State() {
+		case TorrentChecking, TorrentDownloading:
+			downloads++
+		case TorrentSeeding:
+			seeds++
+		}
+	}
+
+	for _, t := range s.order {
+		if t.State() != TorrentQueued {
+			continue
+		}
+
+		if t.complete() {
+			if s.config.MaxActiveSeeds > 0 && seeds >= s.config.MaxActiveSeeds {
+				continue
+			}
+			seeds++
+		} else {
+			if s.config.MaxActiveDownloads > 0 && downloads >= s.config.MaxActiveDownloads {
+				continue
+			}
+			downloads++
+		}
+
+		t.start(s.ctx)
+	}
+}
+
+// Close stops every torrent, closes their storage and stops accepting peers
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.closed = true
+	torrents := s.order
+	s.mu.Unlock()
+
+	s.cancel()
+
+	var errs []error
+	for _, t := range torrents {
+		t.stop(TorrentPaused)
+		errs = append(errs, t.storage.Close())
+		metricPeers.DeleteMatching("info_hash", hex.EncodeToString(t.InfoHash()))
+	}
+
+	errs = append(errs, s.tcp.Close(), s.utp.Close())
+	s.wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// TorrentState is where a torrent is in its life in the session
+type TorrentState int
+
+const (
+	// waiting for a download or seed slot
+	TorrentQueued TorrentState = iota
+
+	// hashing the data that is already in the storage
+	TorrentChecking
+
+	TorrentDownloading
+	TorrentSeeding
+	TorrentPaused
+
+	// stopped by an error, like the disk being full, until it's resumed
+	TorrentFailed
+)
+
+func (s TorrentState) String() string {
+	switch s {
+	case TorrentQueued:
+		return "queued"
+	case TorrentChecking:
+		return "checking"
+	case TorrentDownloading:
+		return "downloading"
+	case TorrentSeeding:
+		return "seeding"
+	case TorrentPaused:
+		return "paused"
+	case TorrentFailed:
+		return "failed"
+	default:
+		return "state " + strconv.Itoa(int(s))
+	}
+}
+
+// Torrent is a torrent added to a session
+type Torrent struct {
+	session *Session
+	file    *TorrentFile
+	storage Storage
+
+	// a small number that identifies the torrent in the session
+	id    int
+	added time.Time
+
+	filePriorities []filePriority
+
+	// verified bytes downloaded and bytes uploaded since the torrent was added
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+
+	// kept across pauses, so a resumed torrent continues where it stopped
+	downloader *downloader
+	seeder     *seeder
+
+	// the peers we are connected to for this torrent, in both directions
+	peers *peerSet
+
+	log *slog.Logger
+
+	// announces the torrent while it runs, nil before its first run
+	announcer *announcer
+
+	mu      sync.Mutex
+	state   TorrentState
+	err     error
+	checked bool
+	have    bitfield
+
+	// bytes per second over the last rate interval
+	downloadRate int64
+	uploadRate   int64
+
+	// the counters at the end of the last rate interval
+	lastDownloaded int64
+	lastUploaded   int64
+
+	// stops the current run, done is closed once it returned
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// TorrentStatus is a snapshot of a torrent
+type TorrentStatus struct {
+	ID       int
+	InfoHash string
+	Name     string
+	State    TorrentState
+	Added    time.Time
+	Private  bool
+
+	// the data that was in the storage when the torrent was added was checked
+	Checked bool
+
+	// the torrent was checked and has every piece that isn't skipped
+	Complete bool
+
+	// set when the torrent failed
+	Err error
+
+	// pieces we have and pieces in the torrent
+	Pieces      int
+	TotalPieces int
+
+	// bytes we have out of the length of the torrent
+	Completed int64
+	Length    int64
+
+	// bytes of the pieces that aren't skipped, and how many of them we have
+	Wanted          int64
+	WantedCompleted int64
+
+	Downloaded int64
+	Uploaded   int64
+
+	// bytes per second
+	DownloadRate int64
+	UploadRate   int64
+
+	// the last announce of the current or last run
+	Tracker TrackerStatus
+}
+
+// Peers returns a snapshot of the connected peers
+func (t *Torrent) Peers() []PeerStatus {
+	var peers []PeerStatus
+	for _, p := range t.peers.List() {
+		peers = append(peers, p.Status(len(t.file.Info.PiecesHash)))
+	}
+
+	return peers
+}
+
+// Bandwidth returns the limits shared by the peers of the torrent, they can be changed while it runs
+func (t *Torrent) Bandwidth() *bandwidthLimiter {
+	return t.downloader.bandwidth
+}
+
+func (t *Torrent) InfoHash() []byte {
+	return t.file.Info.InfoHash
+}
+
+func (t *Torrent) State() TorrentState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.state
+}
+
+func (t *Torrent) ID() int {
+	return t.id
+}
+
+// DataPath is where the torrent is saved, empty when it's not stored in files
+func (t *Torrent) DataPath() string {
+	if fs, ok := t.storage.(*fileStorage); ok {
+		return fs.out
+	}
+
+	return ""
+}
+
+// FilePriorities returns the priority of every file of the torrent
+func (t *Torrent) FilePriorities() []filePriority {
+	return t.filePriorities
+}
+
+func (t *Torrent) Status() TorrentStatus {
+	complete := t.complete()
+	wanted := piecePriorities(&t.file.Info, t.filePriorities)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := TorrentStatus{
+		ID:           t.id,
+		InfoHash:     hex.EncodeToString(t.file.Info.InfoHash),
+		Name:         t.file.Info.Name,
+		State:        t.state,
+		Added:        t.added,
+		Private:      t.file.Info.Private,
+		Checked:      t.checked,
+		Complete:     complete,
+		Err:          t.err,
+		TotalPieces:  len(t.file.Info.PiecesHash),
+		Length:       t.file.Info.Length,
+		Downloaded:   t.downloaded.Load(),
+		Uploaded:     t.uploaded.Load(),
+		DownloadRate: t.downloadRate,
+		UploadRate:   t.uploadRate,
+	}
+
+	if t.announcer != nil {
+		status.Tracker = t.announcer.Status()
+	} else {
+		status.Tracker = TrackerStatus{Seeders: -1, Leechers: -1}
+	}
+
+	for i := range t.file.Info.PiecesHash {
+		size := t.file.Info.PieceSize(i)
+
+		if wanted[i] != prioritySkip {
+			status.Wanted += size
+		}
+
+		if t.have.Has(i) {
+			status.Pieces++
+			status.Completed += size
+
+			if wanted[i] != prioritySkip {
+				status.WantedCompleted += size
+			}
+		}
+	}
+
+	return status
+}
+
+// updateRates computes the transfer rates over the interval that just ended
+func (t *Torrent) updateRates(interval time.Duration) {
+	downloaded, uploaded := t.downloaded.Load(), t.uploaded.Load()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.downloadRate = int64(float64(downloaded-t.lastDownloaded) / interval.Seconds())
+	t.uploadRate = int64(float64(uploaded-t.lastUploaded) / interval.Seconds())
+	t.lastDownloaded, t.lastUploaded = downloaded, uploaded
+}
+
+// complete reports whether every wanted piece was checked or downloaded
+func (t *Torrent) complete() bool {
+	t.mu.Lock()
+	checked := t.checked
+	t.mu.Unlock()
+
+	return checked && t.downloader.picker.Complete()
+}
+
+func (t *Torrent) hasPiece(pieceIndex int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.have.Has(pieceIndex)
+}
+
+func (t *Torrent) pieceDone(pieceIndex int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.have.Set(pieceIndex)
+}
+
+// serving returns the context of the current run if the torrent accepts peers
+func (t *Torrent) serving() (context.Context, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state != TorrentDownloading && t.state != TorrentSeeding {
+		return nil, false
+	}
+
+	return t.ctx, true
+}
+
+// start runs the torrent in the background. Must be called on a queued torrent.
+func (t *Torrent) start(ctx context.Context) {
+	complete := t.complete()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case !t.checked:
+		t.state = TorrentChecking
+	case !complete:
+		t.state = TorrentDownloading
+	default:
+		t.state = TorrentSeeding
+	}
+
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	t.done = make(chan struct{})
+
+	t.log.Info("torrent started", "state", t.state)
+
+	go t.run(t.ctx, t.done)
+}
+
+// stop cancels the current run, waits for it to return and leaves the torrent in state
+func (t *Torrent) stop(state TorrentState) {
+	t.mu.Lock()
+	cancel, done := t.cancel, t.done
+	t.cancel, t.done = nil, nil
+	t.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+
+	t.mu.Lock()
+	t.state = state
+	t.mu.Unlock()
+}
+
+func (t *Torrent) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	err := t.work(ctx)
+
+	// a canceled run was paused or removed, stop sets the state
+	if ctx.Err() != nil {
+		return
+	}
+
+	t.mu.Lock()
+
+	// stop took over the torrent in the meantime
+	if t.done != done {
+		t.mu.Unlock()
+		return
+	}
+
+	if err != nil {
+		t.state = TorrentFailed
+		t.err = err
+		t.log.Error("torrent failed", "err", err)
+	} else {
+		// complete, waits for a seed slot
+		t.state = TorrentQueued
+		t.log.Info("torrent complete")
+	}
+	t.cancel()
+	t.cancel, t.done = nil, nil
+	t.mu.Unlock()
+
+	t.session.schedule()
+}
+
+func (t *Torrent) work(ctx context.Context) error {
+	if t.State() == TorrentChecking {
+		err := t.check(ctx)
+		if err != nil {
+			return err
+		}
+
+		if t.complete() {
+			return nil
+		}
+
+		t.mu.Lock()
+		t.state = TorrentDownloading
+		t.mu.Unlock()
+	}
+
+	// the tracker knows about us for as long as the torrent runs
+	a := newAnnouncer(t.session.tracker, t.file, t.announceStats, t.log)
+
+	a.onPeers = t.downloader.AddPeers
+
+	t.mu.Lock()
+	t.announcer = a
+	t.mu.Unlock()
+
+	// the peers of private torrents only come from their trackers
+	if lsd := t.session.lsd; lsd != nil && t.file.Info.discoverable() {
+		lsd.Add(t.file.Info.InfoHash)
+		defer lsd.Remove(t.file.Info.InfoHash)
+	}
+
+	announceCtx, stopAnnounce := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a.Run(announceCtx)
+	}()
+
+	defer func() {
+		stopAnnounce()
+		wg.Wait()
+	}()
+
+	if t.State() != TorrentDownloading {
+		<-ctx.Done()
+		return nil
+	}
+
+	err := t.download(ctx, a)
+	if err == nil {
+		a.Completed()
+	}
+
+	return err
+}
+
+// announceStats are the counters of the torrent for the tracker
+func (t *Torrent) announceStats() announceStats {
+	status := t.Status()
+
+	return announceStats{
+		Uploaded:   status.Uploaded,
+		Downloaded: status.Downloaded,
+		Left:       status.Wanted - status.WantedCompleted,
+	}
+}
+
+// check hashes the wanted pieces that are already in the storage, so they aren't downloaded again
+func (t *Torrent) check(ctx context.Context) error {
+	info := &t.file.Info
+
+	for i, pieceHash := range info.PiecesHash {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		piece := getPieceBuffer(info, i)
+
+		// missing and short files just mean the piece wasn't downloaded
+		_, err := t.storage.ReadAt(piece, i, 0)
+		if err != nil {
+			putPieceBuffer(piece)
+			continue
+		}
+
+		hash := sha1.Sum(piece)
+		putPieceBuffer(piece)
+		if hex.EncodeToString(hash[:]) != pieceHash {
+			continue
+		}
+
+		err = t.storage.MarkComplete(i)
+		if err != nil {
+			return err
+		}
+
+		t.downloader.picker.Done(i)
+		t.pieceDone(i)
+	}
+
+	t.mu.Lock()
+	t.checked = true
+	t.mu.Unlock()
+
+	t.log.Info("checked existing data", "pieces", t.Status().Pieces)
+
+	return nil
+}
+
+// download runs the downloader with the peers of the announces until every wanted piece is there
+func (t *Torrent) download(ctx context.Context, a *announcer) error {
+	for {
+		// the peers are added to the downloader as they are found, the ones of a paused run are still there
+		if !t.downloader.conns.dialable() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-t.downloader.conns.added:
+			}
+		}
+
+		err := t.downloader.Run(ctx, nil)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		// the storage failed, more peers won't help
+		if fatal := t.downloader.fatal(); fatal != nil {
+			return fatal
+		}
+
+		t.log.Warn("download stalled, asking the tracker again", "err", err)
+		a.MorePeers()
+	}
+}
+
+// peerSet holds the connected peers of a torrent
+type peerSet struct {
+	mu    sync.Mutex
+	peers map[*Peer]struct{}
+}
+
+func newPeerSet() *peerSet {
+	return &peerSet{
+		peers: make(map[*Peer]struct{}),
+	}
+}
+
+func (ps *peerSet) Add(p *Peer) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.peers[p] = struct{}{}
+}
+
+func (ps *peerSet) Remove(p *Peer) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	delete(ps.peers, p)
+}
+
+func (ps *peerSet) List() []*Peer {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	peers := make([]*Peer, 0, len(ps.peers))
+	for p := range ps.peers {
+		peers = append(peers, p)
+	}
+
+	return peers
+}
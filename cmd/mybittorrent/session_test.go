@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// quietTracker answers every announce without peers, so the torrents of a session stay where they are
+func quietTracker(t *testing.T) string {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bencode.Marshal(w, map[string]any{"interval": int64(3600), "peers": ""})
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL + "/announce"
+}
+
+// sessionTorrent is a torrent of random data in memory storage, which holds the data already when complete is set
+func sessionTorrent(t *testing.T, announce, name string, complete bool) (*TorrentFile, Storage) {
+	t.Helper()
+
+	data := make([]byte, 40)
+	rand.Read(data)
+
+	infoHash := sha1.Sum(data)
+	file := &TorrentFile{
+		Announce: announce,
+		Info: Info{
+			Name:        name,
+			Length:      int64(len(data)),
+			Files:       []FileInfo{{Length: int64(len(data)), Path: []string{name}}},
+			PieceLength: 16,
+			InfoHash:    infoHash[:],
+		},
+	}
+
+	for begin := 0; begin < len(data); begin += 16 {
+		hash := sha1.Sum(data[begin:min(begin+16, len(data))])
+		file.Info.PiecesHash = append(file.Info.PiecesHash, hex.EncodeToString(hash[:]))
+	}
+
+	storage := newMemoryStorage(&file.Info)
+	if complete {
+		for i := range file.Info.PiecesHash {
+			if _, err := storage.WriteAt(data[i*16:min(i*16+16, len(data))], i, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return file, storage
+}
+
+func assertStates(t *testing.T, s *Session, want map[string]TorrentState) {
+	t.Helper()
+
+	eventually(t, "the torrents settle", func() bool {
+		for _, torrent := range s.Torrents() {
+			if state, ok := want[torrent.file.Info.Name]; ok && torrent.State() != state {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestSessionQueue(t *testing.T) {
+	s, err := NewSession(SessionConfig{
+		ListenAddr:         "127.0.0.1:0",
+		MaxActiveDownloads: 1,
+		MaxActiveSeeds:     1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	announce := quietTracker(t)
+
+	add := func(name string, complete bool) *Torrent {
+		file, storage := sessionTorrent(t, announce, name, complete)
+		torrent, err := s.AddTorrent(file, storage, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return torrent
+	}
+
+	// complete torrents are checked one at a time in the download slot, then wait for the seed slot
+	seed1 := add("seed1", true)
+	seed2 := add("seed2", true)
+	assertStates(t, s, map[string]TorrentState{"seed1": TorrentSeeding, "seed2": TorrentQueued})
+
+	if !seed2.Status().Checked {
+		t.Fatal("queued seed wasn't checked")
+	}
+
+	// the check is done, so the download slot is free again
+	download1 := add("download1", false)
+	download2 := add("download2", false)
+	assertStates(t, s, map[string]TorrentState{"download1": TorrentDownloading, "download2": TorrentQueued})
+
+	// a freed slot goes to the next torrent in the queue
+	if err := s.Pause(seed1.InfoHash()); err != nil {
+		t.Fatal(err)
+	}
+	assertStates(t, s, map[string]TorrentState{"seed1": TorrentPaused, "seed2": TorrentSeeding})
+
+	if err := s.Pause(download1.InfoHash()); err != nil {
+		t.Fatal(err)
+	}
+	assertStates(t, s, map[string]TorrentState{"download1": TorrentPaused, "download2": TorrentDownloading})
+
+	// a resumed torrent waits behind the one that took its slot
+	if err := s.Resume(download1.InfoHash()); err != nil {
+		t.Fatal(err)
+	}
+	assertStates(t, s, map[string]TorrentState{"download1": TorrentQueued, "download2": TorrentDownloading})
+
+	if err := s.Remove(download2.InfoHash()); err != nil {
+		t.Fatal(err)
+	}
+	assertStates(t, s, map[string]TorrentState{"download1": TorrentDownloading})
+
+	if err := s.Resume(seed1.InfoHash()); err != nil {
+		t.Fatal(err)
+	}
+	assertStates(t, s, map[string]TorrentState{"seed1": TorrentQueued, "seed2": TorrentSeeding})
+
+	if got := len(s.Torrents()); got != 3 {
+		t.Fatalf("session has %d torrents after a remove, want 3", got)
+	}
+
+	if _, err := s.AddTorrent(seed2.file, newMemoryStorage(&seed2.file.Info), nil); err == nil {
+		t.Fatal("the same torrent was added twice")
+	}
+}
+
+func TestSessionLocalPeersOfPrivateTorrents(t *testing.T) {
+	s, err := NewSession(SessionConfig{ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	announce := quietTracker(t)
+
+	public, storage := sessionTorrent(t, announce, "public", false)
+	if _, err := s.AddTorrent(public, storage, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	private, storage := sessionTorrent(t, announce, "private", false)
+	private.Info.Private = true
+	if _, err := s.AddTorrent(private, storage, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	assertStates(t, s, map[string]TorrentState{"public": TorrentDownloading, "private": TorrentDownloading})
+
+	// a port nothing listens on, the peer stays a candidate after failing
+	addr := netip.MustParseAddrPort("127.0.0.1:1")
+	s.localPeer(public.Info.InfoHash, addr)
+	s.localPeer(private.Info.InfoHash, addr)
+
+	known := func(file *TorrentFile) bool {
+		conns := s.Torrent(file.Info.InfoHash).downloader.conns
+		conns.mu.Lock()
+		defer conns.mu.Unlock()
+
+		_, ok := conns.candidates[addr]
+		return ok
+	}
+
+	if !known(public) {
+		t.Fatal("peer found on the local network wasn't given to the public torrent")
+	}
+	if known(private) {
+		t.Fatal("peer found on the local network was given to the private torrent")
+	}
+}
+
+func TestSessionResumeWithTheSameSwarm(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the seeder is only dialed again after its backoff")
+	}
+
+	store, tracker := testTrackerServer()
+	server := httptest.NewServer(tracker)
+	t.Cleanup(server.Close)
+
+	newSession := func() *Session {
+		s, err := NewSession(SessionConfig{ListenAddr: "127.0.0.1:0", PeerID: newPeerID(), Transport: transportTCPOnly})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+
+	file, storage := sessionTorrent(t, server.URL+"/announce", "shared", true)
+	seeder := newSession()
+	leecher := newSession()
+
+	// the seeder is in the swarm before it has the torrent, so the first dial fails and the peer backs off
+	seederAddr := netip.MustParseAddrPort(seeder.tcp.Addr().String())
+	store.Announce(swarmAnnounce{InfoHash: string(file.Info.InfoHash), PeerID: string(seeder.peerID), NumWant: -1, V4: seederAddr}, time.Now())
+
+	torrent, err := leecher.AddTorrent(file, newMemoryStorage(&file.Info), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "the seeder is dialed", func() bool {
+		conns := torrent.downloader.conns
+		conns.mu.Lock()
+		defer conns.mu.Unlock()
+
+		c := conns.candidates[seederAddr]
+		return c != nil && c.failures > 0
+	})
+
+	if _, err := seeder.AddTorrent(file, storage, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// resumed, the tracker only gives peers the torrent already knows
+	if err := leecher.Pause(file.Info.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+	assertStates(t, leecher, map[string]TorrentState{"shared": TorrentPaused})
+
+	if err := leecher.Resume(file.Info.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(initialPeerBackoff + 5*time.Second)
+	for torrent.State() != TorrentSeeding {
+		if time.Now().After(deadline) {
+			t.Fatalf("resumed torrent is %v", torrent.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SOCKS5 as described in https://www.rfc-editor.org/rfc/rfc1928 with the username and password
+// authentication of https://www.rfc-editor.org/rfc/rfc1929
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	socks5PasswordVersion = 0x01
+
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded = 0x00
+)
+
+var socks5ReplyErrors = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+var errSocks5Auth = errors.New("socks5 proxy refused the credentials")
+
+// socks5Proxy connects to peers through a SOCKS5 proxy, over TCP with CONNECT and over UDP with UDP ASSOCIATE
+type socks5Proxy struct {
+	addr string
+
+	// empty when the proxy needs no authentication
+	username string
+	password string
+}
+
+// parseSOCKS5Proxy accepts socks5://[user:password@]host:port or host:port
+func parseSOCKS5Proxy(s string) (*socks5Proxy, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		u, err = url.Parse("socks5://" + s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %w", s, err)
+		}
+	}
+
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("invalid proxy %q, expected a socks5:// URL", s)
+	}
+
+	if u.Port() == "" {
+		return nil, fmt.Errorf("invalid proxy %q, the port is missing", s)
+	}
+
+	p := &socks5Proxy{addr: u.Host}
+
+	if u.User != nil {
+		p.username = u.User.Username()
+		p.password, _ = u.User.Password()
+
+		if len(p.username) > 255 || len(p.password) > 255 {
+			return nil, errors.New("socks5 username and password are limited to 255 bytes")
+		}
+	}
+
+	return p, nil
+}
+
+// URL is the proxy as the HTTP client of the trackers expects it, names are resolved by the proxy
+func (p *socks5Proxy) URL() string {
+	u := url.URL{Scheme: "socks5h", Host: p.addr}
+	if p.username != "" {
+		u.User = url.UserPassword(p.username, p.password)
+	}
+
+	return u.String()
+}
+
+// DialContext opens a TCP connection to addr through the proxy
+func (p *socks5Proxy) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	conn, _, err := p.request(ctx, socks5CmdConnect, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// ListenPacket asks the proxy to relay UDP datagrams for us. The association lasts
+// as long as the TCP connection that requested it, closing the packet connection closes both.
+func (p *socks5Proxy) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	// we don't know the address we send from, the proxy accepts the datagrams of any address then
+	control, relay, err := p.request(ctx, socks5CmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+
+	// a relay on an unspecified address is reached at the address of the proxy
+	if relay.Addr().IsUnspecified() {
+		host, ok := control.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			control.Close()
+			return nil, errors.New("socks5 proxy gave no address for the UDP relay")
+		}
+
+		relay = netip.AddrPortFrom(host.AddrPort().Addr().Unmap(), relay.Port())
+	}
+
+	udp, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(relay))
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	pc := &socks5PacketConn{
+		control: control,
+		udp:     udp,
+	}
+
+	// the proxy drops the association by closing the control connection
+	go func() {
+		io.Copy(io.Discard, control)
+		pc.Close()
+	}()
+
+	return pc, nil
+}
+
+// request negotiates with the proxy and sends a command, it returns the connection
+// to the proxy and the address the proxy bound for the command
+func (p *socks5Proxy) request(ctx context.Context, cmd byte, addr string) (net.Conn, netip.AddrPort, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, netip.AddrPort{}, fmt.Errorf("failed to reach socks5 proxy: %w", err)
+	}
+
+	var bound netip.AddrPort
+	err = withDeadline(ctx, conn, func() error {
+		err := p.authenticate(conn)
+		if err != nil {
+			return err
+		}
+
+		req, err := appendSOCKS5Addr([]byte{socks5Version, cmd, 0x00}, addr)
+		if err != nil {
+			return err
+		}
+
+		_, err = conn.Write(req)
+		if err != nil {
+			return err
+		}
+
+		bound, err = readSOCKS5Reply(conn)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, netip.AddrPort{}, err
+	}
+
+	return conn, bound, nil
+}
+
+func (p *socks5Proxy) authenticate(conn net.Conn) error {
+	methods := []byte{socks5AuthNone}
+	if p.username != "" {
+		methods = []byte{socks5AuthPassword}
+	}
+
+	_, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	_, err = io.ReadFull(conn, reply[:])
+	if err != nil {
+		return err
+	}
+
+	if reply[0] != socks5Version {
+		return fmt.Errorf("not a socks5 proxy, version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socks5AuthNone:
+		return nil
+
+	case socks5AuthPassword:
+		if p.username == "" {
+			return errSocks5Auth
+		}
+
+		req := []byte{socks5PasswordVersion, byte(len(p.username))}
+		req = append(req, p.username...)
+		req = append(req, byte(len(p.password)))
+		req = append(req, p.password...)
+
+		_, err = conn.Write(req)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.ReadFull(conn, reply[:])
+		if err != nil {
+			return err
+		}
+
+		if reply[1] != 0x00 {
+			return errSocks5Auth
+		}
+
+		return nil
+
+	case socks5AuthNoAcceptable:
+		return errSocks5Auth
+
+	default:
+		return fmt.Errorf("socks5 proxy chose unknown authentication method %d", reply[1])
+	}
+}
+
+// appendSOCKS5Addr appends the address type, address and port, names are sent as they are for the proxy to resolve
+func appendSOCKS5Addr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+
+	ip, err := netip.ParseAddr(host)
+	switch {
+	case err != nil:
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %q", host)
+		}
+		b = append(b, socks5AddrDomain, byte(len(host)))
+		b = append(b, host...)
+	case ip.Unmap().Is4():
+		b = append(b, socks5AddrIPv4)
+		b = append(b, ip.Unmap().AsSlice()...)
+	default:
+		b = append(b, socks5AddrIPv6)
+		b = append(b, ip.AsSlice()...)
+	}
+
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// readSOCKS5Addr reads the address type, address and port at the start of b and returns the rest
+func readSOCKS5Addr(b []byte) (netip.AddrPort, []byte, error) {
+	if len(b) < 1 {
+		return netip.AddrPort{}, nil, io.ErrUnexpectedEOF
+	}
+
+	var size int
+	switch b[0] {
+	case socks5AddrIPv4:
+		size = 4
+	case socks5AddrIPv6:
+		size = 16
+	case socks5AddrDomain:
+		// peers and relays are addressed by ip, names only come from misbehaving proxies
+		return netip.AddrPort{}, nil, errors.New("socks5 proxy answered with a host name")
+	default:
+		return netip.AddrPort{}, nil, fmt.Errorf("unknown socks5 address type %d", b[0])
+	}
+
+	if len(b) < 1+size+2 {
+		return netip.AddrPort{}, nil, io.ErrUnexpectedEOF
+	}
+
+	ip, _ := netip.AddrFromSlice(b[1 : 1+size])
+	port := binary.BigEndian.Uint16(b[1+size:])
+
+	return netip.AddrPortFrom(ip, port), b[1+size+2:], nil
+}
+
+func readSOCKS5Reply(r io.Reader) (netip.AddrPort, error) {
+	var header [4]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	if header[0] != socks5Version {
+		return netip.AddrPort{}, fmt.Errorf("not a socks5 proxy, version %d", header[0])
+	}
+
+	if header[1] != socks5ReplySucceeded {
+		reason, ok := socks5ReplyErrors[header[1]]
+		if !ok {
+			reason = "error " + strconv.Itoa(int(header[1]))
+		}
+		return netip.AddrPort{}, fmt.Errorf("socks5 proxy: %s", reason)
+	}
+
+	var size int
+	switch header[3] {
+	case socks5AddrIPv4:
+		size = 4
+	case socks5AddrIPv6:
+		size = 16
+	case socks5AddrDomain:
+		var length [1]byte
+		_, err = io.ReadFull(r, length[:])
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+
+		// a bound name isn't of any use to us, it's read to keep the stream in sync
+		_, err = io.ReadFull(r, make([]byte, int(length[0])+2))
+		return netip.AddrPort{}, err
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unknown socks5 address type %d", header[3])
+	}
+
+	buf := make([]byte, 1+size+2)
+	buf[0] = header[3]
+	_, err = io.ReadFull(r, buf[1:])
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	bound, _, err := readSOCKS5Addr(buf)
+	return bound, err
+}
+
+// socks5PacketConn sends datagrams through the UDP relay of the proxy, every datagram
+// carries the address of the peer in a header
+type socks5PacketConn struct {
+	control net.Conn
+	udp     *net.UDPConn
+
+	closeOnce sync.Once
+}
+
+func (c *socks5PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+262)
+	for {
+		n, err := c.udp.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		// reserved bytes, then the fragment number, fragments aren't supported and are dropped
+		if n < 3 || buf[2] != 0 {
+			continue
+		}
+
+		from, payload, err := readSOCKS5Addr(buf[3:n])
+		if err != nil {
+			continue
+		}
+
+		return copy(b, payload), net.UDPAddrFromAddrPort(from), nil
+	}
+}
+
+func (c *socks5PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	packet, err := appendSOCKS5Addr([]byte{0, 0, 0}, addr.String())
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = c.udp.Write(append(packet, b...))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *socks5PacketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = errors.Join(c.udp.Close(), c.control.Close())
+	})
+
+	return err
+}
+
+func (c *socks5PacketConn) LocalAddr() net.Addr {
+	return c.udp.LocalAddr()
+}
+
+func (c *socks5PacketConn) SetDeadline(t time.Time) error {
+	return c.udp.SetDeadline(t)
+}
+
+func (c *socks5PacketConn) SetReadDeadline(t time.Time) error {
+	return c.udp.SetReadDeadline(t)
+}
+
+func (c *socks5PacketConn) SetWriteDeadline(t time.Time) error {
+	return c.udp.SetWriteDeadline(t)
+}
+
+// proxyFlags send the peer connections, and the announces unless they have a proxy of their own, through a SOCKS5 proxy
+type proxyFlags struct {
+	proxy string
+	only  bool
+}
+
+func addProxyFlags(fs *flag.FlagSet) *proxyFlags {
+	p := &proxyFlags{}
+	fs.StringVar(&p.proxy, "proxy", "", "socks5://[user:password@]host:port proxy to connect to peers and trackers through")
+	fs.BoolVar(&p.only, "proxy-only", false, "never connect directly when the proxy fails, and don't reveal our addresses")
+	return p
+}
+
+// peerProxy is the proxy of every peer connection, nil to connect directly
+var peerProxy *socks5Proxy
+
+// proxyOnly refuses direct connections so our address doesn't leak
+var proxyOnly bool
+
+// apply installs the proxy, it must be called before the dialers and the tracker client are created
+func (p *proxyFlags) apply() error {
+	if p.only && p.proxy == "" {
+		return errors.New("-proxy-only needs a -proxy")
+	}
+
+	if p.proxy == "" {
+		return nil
+	}
+
+	proxy, err := parseSOCKS5Proxy(p.proxy)
+	if err != nil {
+		return err
+	}
+
+	peerProxy, proxyOnly = proxy, p.only
+	defaultDialer = newPeerDialer(transportPreferTCP)
+
+	return nil
+}
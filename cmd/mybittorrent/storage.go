@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage is where the piece data of a torrent lives. Offsets are relative to the start of the piece.
+type Storage interface {
+	ReadAt(p []byte, pieceIndex int, offset int64) (int, error)
+	WriteAt(p []byte, pieceIndex int, offset int64) (int, error)
+
+	// MarkComplete is called once the piece was written and its hash verified
+	MarkComplete(pieceIndex int) error
+
+	Close() error
+}
+
+var errPieceOutOfRange = errors.New("piece out of range")
+
+func checkPieceRange(info *Info, pieceIndex int, offset int64, size int) error {
+	if pieceIndex < 0 || pieceIndex >= len(info.PiecesHash) {
+		return fmt.Errorf("piece %d: %w", pieceIndex, errPieceOutOfRange)
+	}
+
+	if offset < 0 || offset+int64(size) > info.PieceSize(pieceIndex) {
+		return fmt.Errorf("block %d+%d of piece %d: %w", offset, size, pieceIndex, errPieceOutOfRange)
+	}
+
+	return nil
+}
+
+// memoryStorage keeps the pieces in memory, it's meant for tests and small torrents
+type memoryStorage struct {
+	info *Info
+
+	mu       sync.Mutex
+	pieces   [][]byte
+	complete bitfield
+}
+
+func newMemoryStorage(info *Info) *memoryStorage {
+	return &memoryStorage{
+		info:     info,
+		pieces:   make([][]byte, len(info.PiecesHash)),
+		complete: newBitfield(len(info.PiecesHash)),
+	}
+}
+
+func (m *memoryStorage) ReadAt(p []byte, pieceIndex int, offset int64) (int, error) {
+	err := checkPieceRange(m.info, pieceIndex, offset, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	piece := m.pieces[pieceIndex]
+	if piece == nil {
+		return 0, fmt.Errorf("piece %d was not written", pieceIndex)
+	}
+
+	return copy(p, piece[offset:]), nil
+}
+
+func (m *memoryStorage) WriteAt(p []byte, pieceIndex int, offset int64) (int, error) {
+	err := checkPieceRange(m.info, pieceIndex, offset, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.pieces[pieceIndex] == nil {
+		m.pieces[pieceIndex] = make([]byte, m.info.PieceSize(pieceIndex))
+	}
+
+	return copy(m.pieces[pieceIndex][offset:], p), nil
+}
+
+func (m *memoryStorage) MarkComplete(pieceIndex int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.complete.Set(pieceIndex)
+	return nil
+}
+
+func (m *memoryStorage) Close() error {
+	return nil
+}
+
+// fileStorage keeps the pieces in the files of the torrent. Pieces that overlap several
+// files are split between them, and the parts of files that are skipped are dropped.
+type fileStorage struct {
+	info *Info
+	out  string
+
+	// files with the skip priority are never created
+	wanted []filePriority
+
+	// set the files to their full size when they are created
+	preallocate bool
+
+	mu       sync.Mutex
+	files    map[int]*os.File
+	writable map[int]bool
+	complete bitfield
+}
+
+// newFileStorage stores the torrent at out, a file for single-file torrents and a directory otherwise.
+// wanted may be nil to keep every file.
+func newFileStorage(info *Info, out string, wanted []filePriority) (*fileStorage, error) {
+	if wanted == nil {
+		wanted = make([]filePriority, len(info.Files))
+		for i := range wanted {
+			wanted[i] = priorityNormal
+		}
+	}
+
+	s := &fileStorage{
+		info:     info,
+		out:      out,
+		wanted:   wanted,
+		files:    make(map[int]*os.File),
+		writable: make(map[int]bool),
+		complete: newBitfield(len(info.PiecesHash)),
+	}
+
+	// empty files have no pieces, so nothing else would create them
+	for i, file := range info.Files {
+		if file.Length == 0 && wanted[i] != prioritySkip {
+			_, err := s.open(i, true)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// newSparseFileStorage creates every wanted file at its full size up front. The files are sparse,
+// so the disk space is only used as pieces are written, but running out of space is noticed early
+// and the files don't fragment as they grow.
+func newSparseFileStorage(info *Info, out string, wanted []filePriority) (*fileStorage, error) {
+	s, err := newFileStorage(info, out, wanted)
+	if err != nil {
+		return nil, err
+	}
+
+	s.preallocate = true
+
+	for i := range info.Files {
+		if s.wanted[i] == prioritySkip {
+			continue
+		}
+
+		_, err := s.open(i, true)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// open returns the file, reopening it for writing if needed. Must be called with mu held or before the storage is shared.
+func (s *fileStorage) open(fileIndex int, write bool) (*os.File, error) {
+	if f, ok := s.files[fileIndex]; ok && (s.writable[fileIndex] || !write) {
+		return f, nil
+	}
+
+	filePath := outputPath(s.info, s.out, fileIndex)
+
+	if !write {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return nil, err
+		}
+
+		s.files[fileIndex] = f
+		return f, nil
+	}
+
+	// a file that was opened for reading is reopened for writing
+	if f, ok := s.files[fileIndex]; ok {
+		f.Close()
+		delete(s.files, fileIndex)
+	}
+
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.preallocate {
+		err = f.Truncate(s.info.Files[fileIndex].Length)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	s.files[fileIndex] = f
+	s.writable[fileIndex] = true
+	return f, nil
+}
+
+// segments returns the parts of the files that the range of the piece covers
+func (s *fileStorage) segments(pieceIndex int, offset int64, size int) []fileSegment {
+	var segments []fileSegment
+	end := offset + int64(size)
+
+	for _, segment := range s.info.PieceSegments(pieceIndex) {
+		segmentEnd := segment.pieceOffset + segment.length
+		if segmentEnd <= offset || segment.pieceOffset >= end {
+			continue
+		}
+
+		start := max(segment.pieceOffset, offset)
+		stop := min(segmentEnd, end)
+
+		segments = append(segments, fileSegment{
+			fileIndex:   segment.fileIndex,
+			fileOffset:  segment.fileOffset + start - segment.pieceOffset,
+			pieceOffset: start - offset,
+			length:      stop - start,
+		})
+	}
+
+	return segments
+}
+
+func (s *fileStorage) ReadAt(p []byte, pieceIndex int, offset int64) (int, error) {
+	err := checkPieceRange(s.info, pieceIndex, offset, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int
+	for _, segment := range s.segments(pieceIndex, offset, len(p)) {
+		if s.wanted[segment.fileIndex] == prioritySkip {
+			return n, fmt.Errorf("file %d is not downloaded", segment.fileIndex)
+		}
+
+		f, err := s.open(segment.fileIndex, false)
+		if err != nil {
+			return n, err
+		}
+
+		read, err := f.ReadAt(p[segment.pieceOffset:segment.pieceOffset+segment.length], segment.fileOffset)
+		n += read
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (s *fileStorage) WriteAt(p []byte, pieceIndex int, offset int64) (int, error) {
+	err := checkPieceRange(s.info, pieceIndex, offset, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int
+	for _, segment := range s.segments(pieceIndex, offset, len(p)) {
+
+		// the parts of the boundary pieces that belong to skipped files are dropped
+		if s.wanted[segment.fileIndex] == prioritySkip {
+			n += int(segment.length)
+			continue
+		}
+
+		f, err := s.open(segment.fileIndex, true)
+		if err != nil {
+			return n, err
+		}
+
+		written, err := f.WriteAt(p[segment.pieceOffset:segment.pieceOffset+segment.length], segment.fileOffset)
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// MarkComplete flushes the files that have all their pieces
+func (s *fileStorage) MarkComplete(pieceIndex int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.complete.Set(pieceIndex)
+
+	for _, segment := range s.info.PieceSegments(pieceIndex) {
+		f, ok := s.files[segment.fileIndex]
+		if !ok || !s.writable[segment.fileIndex] {
+			continue
+		}
+
+		first, last := s.info.FilePieces(segment.fileIndex)
+		done := true
+		for i := first; i <= last; i++ {
+			if !s.complete.Has(i) {
+				done = false
+				break
+			}
+		}
+
+		if done {
+			err := f.Sync()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *fileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for fileIndex, f := range s.files {
+		errs = append(errs, f.Close())
+		delete(s.files, fileIndex)
+		delete(s.writable, fileIndex)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// storageBackends are the storages a torrent can be kept in, each keeping every file
+var storageBackends = []struct {
+	name string
+	new  func(t *testing.T, info *Info) Storage
+}{
+	{name: "memory", new: func(t *testing.T, info *Info) Storage {
+		return newMemoryStorage(info)
+	}},
+	{name: "file", new: func(t *testing.T, info *Info) Storage {
+		s, err := newFileStorage(info, t.TempDir(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}},
+	{name: "sparse", new: func(t *testing.T, info *Info) Storage {
+		s, err := newSparseFileStorage(info, t.TempDir(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}},
+}
+
+func TestStorage(t *testing.T) {
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			info := testMultiFileInfo()
+
+			s := backend.new(t, info)
+			defer s.Close()
+
+			data := make([]byte, info.Length)
+			rand.Read(data)
+
+			// the blocks arrive out of order and don't line up with the files
+			const block = 12
+			for i := len(info.PiecesHash) - 1; i >= 0; i-- {
+				piece := data[int64(i)*info.PieceLength : int64(i)*info.PieceLength+info.PieceSize(i)]
+
+				for begin := (len(piece) - 1) / block * block; begin >= 0; begin -= block {
+					end := min(begin+block, len(piece))
+					n, err := s.WriteAt(piece[begin:end], i, int64(begin))
+					if err != nil || n != end-begin {
+						t.Fatalf("wrote %d bytes of block %d of piece %d: %v", n, begin, i, err)
+					}
+				}
+
+				if err := s.MarkComplete(i); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i := range info.PiecesHash {
+				got := make([]byte, info.PieceSize(i))
+				n, err := s.ReadAt(got, i, 0)
+				if err != nil || n != len(got) {
+					t.Fatalf("read %d bytes of piece %d: %v", n, i, err)
+				}
+
+				if want := data[int64(i)*info.PieceLength:][:len(got)]; !bytes.Equal(got, want) {
+					t.Fatalf("piece %d changed in the storage", i)
+				}
+			}
+
+			// a block in the middle of the piece shared by three files
+			got := make([]byte, 20)
+			if _, err := s.ReadAt(got, 3, 2); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data[3*32+2:][:20]) {
+				t.Fatal("block across files changed in the storage")
+			}
+
+			for _, r := range []struct {
+				piece  int
+				offset int64
+				size   int
+			}{
+				{piece: -1, size: 1},
+				{piece: len(info.PiecesHash), size: 1},
+				{piece: 0, offset: -1, size: 1},
+				{piece: 0, offset: 30, size: 3},
+				{piece: 4, offset: 0, size: 33},
+			} {
+				buf := make([]byte, r.size)
+				if _, err := s.ReadAt(buf, r.piece, r.offset); !errors.Is(err, errPieceOutOfRange) {
+					t.Errorf("read of %d+%d in piece %d: %v", r.offset, r.size, r.piece, err)
+				}
+				if _, err := s.WriteAt(buf, r.piece, r.offset); !errors.Is(err, errPieceOutOfRange) {
+					t.Errorf("write of %d+%d in piece %d: %v", r.offset, r.size, r.piece, err)
+				}
+			}
+
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFileStorageSkippedFiles(t *testing.T) {
+	for _, sparse := range []bool{false, true} {
+		info := testMultiFileInfo()
+		out := t.TempDir()
+
+		wanted := []filePriority{priorityNormal, prioritySkip, priorityNormal, priorityHigh}
+
+		newStorage := newFileStorage
+		if sparse {
+			newStorage = newSparseFileStorage
+		}
+
+		s, err := newStorage(info, out, wanted)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the empty file is there before any piece
+		if fi, err := os.Stat(outputPath(info, out, 2)); err != nil || fi.Size() != 0 {
+			t.Fatalf("sparse %v: empty file: %v", sparse, err)
+		}
+
+		if sparse {
+			if fi, err := os.Stat(outputPath(info, out, 3)); err != nil || fi.Size() != 50 {
+				t.Fatalf("sparse file wasn't allocated: %v", err)
+			}
+		}
+
+		// the part of the boundary piece that belongs to the skipped file is dropped
+		piece := bytes.Repeat([]byte{7}, 32)
+		if n, err := s.WriteAt(piece, 3, 0); err != nil || n != len(piece) {
+			t.Fatalf("sparse %v: wrote %d bytes: %v", sparse, n, err)
+		}
+
+		if _, err := s.ReadAt(make([]byte, 32), 3, 0); err == nil {
+			t.Fatalf("sparse %v: read of a skipped file succeeded", sparse)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(outputPath(info, out, 1)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("sparse %v: skipped file was created: %v", sparse, err)
+		}
+
+		got, err := os.ReadFile(filepath.Join(out, "extras", "cover.jpg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got[:18], piece[:18]) {
+			t.Fatalf("sparse %v: file starts with %v", sparse, got[:18])
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// pieces after the read cursor that are downloaded before anything else
+	defaultReadahead = 8
+)
+
+// torrentStream makes a file of a torrent readable while it downloads.
+// The pieces around the read cursors of the readers are downloaded first,
+// and reads block until the pieces they need arrive.
+type torrentStream struct {
+	info    *Info
+	storage Storage
+	picker  *piecePicker
+
+	// the streamed file
+	fileIndex int
+
+	// number of pieces after a cursor that get the highest priority
+	readahead int
+
+	mu sync.Mutex
+
+	have bitfield
+
+	// closed and replaced whenever a piece arrives or the download fails
+	changed chan struct{}
+	err     error
+
+	// where every open reader is reading, in bytes from the start of the torrent
+	cursors map[*streamReader]int64
+}
+
+func newTorrentStream(info *Info, storage Storage, picker *piecePicker, fileIndex int) *torrentStream {
+	s := &torrentStream{
+		info:      info,
+		storage:   storage,
+		picker:    picker,
+		fileIndex: fileIndex,
+		readahead: defaultReadahead,
+		have:      newBitfield(len(info.PiecesHash)),
+		changed:   make(chan struct{}),
+		cursors:   make(map[*streamReader]int64),
+	}
+
+	s.reprioritize()
+
+	return s
+}
+
+// PieceDone wakes up the readers waiting for the piece
+func (s *torrentStream) PieceDone(pieceIndex int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.have.Set(pieceIndex)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Fail makes the readers that wait for pieces return err
+func (s *torrentStream) Fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *torrentStream) waitPiece(ctx context.Context, pieceIndex int) error {
+	for {
+		s.mu.Lock()
+		if s.have.Has(pieceIndex) {
+			s.mu.Unlock()
+			return nil
+		}
+
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return err
+		}
+
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// reprioritize gives the highest priority to the readahead window of every cursor, then to the
+// rest of the file after the cursors, and downloads what was already read last. Must be called with mu held.
+func (s *torrentStream) reprioritize() {
+	priorities := make([]filePriority, len(s.info.PiecesHash))
+
+	first, last := s.info.FilePieces(s.fileIndex)
+	for i := first; i <= last; i++ {
+		priorities[i] = priorityNormal
+
+		if len(s.cursors) == 0 {
+			continue
+		}
+
+		// behind every cursor until a cursor needs it
+		priorities[i] = priorityLow
+
+		for _, cursor := range s.cursors {
+			cursorPiece := int(cursor / s.info.PieceLength)
+
+			switch {
+			case i >= cursorPiece && i < cursorPiece+s.readahead:
+				priorities[i] = priorityHigh
+			case i >= cursorPiece:
+				priorities[i] = max(priorities[i], priorityNormal)
+			}
+		}
+	}
+
+	s.picker.SetPriorities(priorities)
+}
+
+func (s *torrentStream) setCursor(r *streamReader, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cursors[r] = offset
+	s.reprioritize()
+}
+
+func (s *torrentStream) removeCursor(r *streamReader) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.cursors, r)
+	s.reprioritize()
+}
+
+// NewReader returns a reader of the streamed file, reads are canceled with the context
+func (s *torrentStream) NewReader(ctx context.Context) *streamReader {
+	r := &streamReader{
+		stream: s,
+		ctx:    ctx,
+		file:   s.info.Files[s.fileIndex],
+	}
+	s.setCursor(r, r.file.Offset)
+
+	return r
+}
+
+// streamReader is an io.ReadSeeker over the streamed file
+type streamReader struct {
+	stream *torrentStream
+	ctx    context.Context
+	file   FileInfo
+
+	// position in the file
+	pos int64
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	if r.pos >= r.file.Length {
+		return 0, io.EOF
+	}
+
+	// read at most up to the end of the piece
+	offset := r.file.Offset + r.pos
+	pieceIndex := int(offset / r.stream.info.PieceLength)
+	pieceOffset := offset % r.stream.info.PieceLength
+
+	size := min(int64(len(p)), r.stream.info.PieceSize(pieceIndex)-pieceOffset, r.file.Length-r.pos)
+
+	err := r.stream.waitPiece(r.ctx, pieceIndex)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := r.stream.storage.ReadAt(p[:size], pieceIndex, pieceOffset)
+	r.pos += int64(n)
+	r.stream.setCursor(r, r.file.Offset+r.pos)
+
+	return n, err
+}
+
+// Seek moves the cursor, the pieces at the new position are downloaded first
+func (r *streamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.file.Length
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.pos = offset
+	r.stream.setCursor(r, r.file.Offset+r.pos)
+
+	return offset, nil
+}
+
+// Close stops prioritizing the pieces of the reader
+func (r *streamReader) Close() error {
+	r.stream.removeCursor(r)
+	return nil
+}
+
+// ServeHTTP serves the streamed file, with support for Range requests
+func (s *torrentStream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r := s.NewReader(req.Context())
+	defer r.Close()
+
+	name := s.info.Files[s.fileIndex].Path[len(s.info.Files[s.fileIndex].Path)-1]
+
+	// ServeContent would sniff the type from the start of the file, which waits for its first piece whatever the range
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	http.ServeContent(w, req, name, time.Time{}, r)
+}
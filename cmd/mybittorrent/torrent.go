@@ -2,13 +2,10 @@ package main
 
 import (
 	"bytes"
-	"context"
 	"crypto/sha1"
-	"encoding/binary"
 	"fmt"
-	"net/http"
-	"net/url"
 	"os"
+	"path"
 	"strings"
 
 	bencode "github.com/jackpal/bencode-go"
@@ -19,13 +16,23 @@ type TorrentFile struct {
 	// URL to a "tracker", which is a central server that keeps track of peers participating in the sharing of a torrent.
 	Announce string
 
+	// tiers of tracker URLs from the announce-list, empty when the torrent has none
+	// https://www.bittorrent.org/beps/bep_0012.html
+	AnnounceList [][]string
+
 	Info Info
 }
 
 type Info struct {
-	// size of the file in bytes, for single-file torrents
+	// size of the file in bytes, for multi-file torrents the sum of all the files
 	Length int64
 
+	// the files of the torrent, a single-file torrent has one file named after the torrent
+	Files []FileInfo
+
+	// the torrent has a files list and is saved as a directory
+	MultiFile bool
+
 	// suggested name to save the file / directory as
 	Name string
 
@@ -39,6 +46,31 @@ type Info struct {
 	InfoHash []byte
 
 	PiecesHash []string
+
+	// peers of a private torrent only come from its trackers, never from DHT, PEX or local service discovery
+	// https://www.bittorrent.org/beps/bep_0027.html
+	Private bool
+}
+
+// discoverable tells if peers may be found outside of the trackers of the torrent
+func (i *Info) discoverable() bool {
+	return !i.Private
+}
+
+type FileInfo struct {
+	// size of the file in bytes
+	Length int64
+
+	// path of the file inside the torrent directory, the last element is the file name
+	Path []string
+
+	// where the file starts when all the files of the torrent are concatenated
+	Offset int64
+}
+
+// DisplayPath is the path of the file with forward slashes, as used to select files
+func (f FileInfo) DisplayPath() string {
+	return path.Join(f.Path...)
 }
 
 // NewTorrentFile builds the torrent file from the decoded content of the torrent file
@@ -49,8 +81,13 @@ func NewTorrentFile(filePath string) (*TorrentFile, error) {
 		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
 
+	return ParseTorrentFile(content)
+}
+
+// ParseTorrentFile builds the torrent file from the content of a .torrent file
+func ParseTorrentFile(content []byte) (*TorrentFile, error) {
 	// Decode the file contents
-	reader := bytes.NewReader([]byte(content))
+	reader := bytes.NewReader(content)
 	decoded, err := bencode.Decode(reader)
 	if err != nil {
 		return nil, fmt.Errorf("decode error: %w", err)
@@ -60,7 +97,8 @@ func NewTorrentFile(filePath string) (*TorrentFile, error) {
 	if !ok {
 		return nil, fmt.Errorf("wrong format, expected a map")
 	}
-	if _, ok := decodedMap["announce"]; !ok {
+	announce, ok := decodedMap["announce"].(string)
+	if !ok {
 		return nil, fmt.Errorf("wrong format, announce not present")
 	}
 
@@ -68,12 +106,38 @@ func NewTorrentFile(filePath string) (*TorrentFile, error) {
 		return nil, fmt.Errorf("wrong format, info not present")
 	}
 
-	// TODO: validate that info is a map
-	infoMap := decodedMap["info"].(map[string]any)
-	length := infoMap["length"].(int64)
-	name := infoMap["name"].(string)
-	pieceLength := infoMap["piece length"].(int64)
-	pieces := infoMap["pieces"].(string)
+	infoMap, ok := decodedMap["info"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("wrong format, info is not a map")
+	}
+
+	name, ok := infoMap["name"].(string)
+	if !ok {
+		return nil, fmt.Errorf("wrong format, name not present")
+	}
+
+	// the name is the file or the directory the torrent is saved as
+	if !validPathElement(name) {
+		return nil, fmt.Errorf("wrong format, invalid name %q", name)
+	}
+
+	pieceLength, ok := infoMap["piece length"].(int64)
+	if !ok || pieceLength <= 0 {
+		return nil, fmt.Errorf("wrong format, piece length not present")
+	}
+
+	pieces, ok := infoMap["pieces"].(string)
+	if !ok || len(pieces)%20 != 0 {
+		return nil, fmt.Errorf("wrong format, pieces must be a multiple of 20 bytes")
+	}
+
+	// anything but 1 is a public torrent, the key is still part of the info hash
+	private, _ := infoMap["private"].(int64)
+
+	files, length, err := parseFiles(infoMap, name)
+	if err != nil {
+		return nil, err
+	}
 
 	// calculate the sha of the encoded info dictionary
 
@@ -96,133 +160,177 @@ func NewTorrentFile(filePath string) (*TorrentFile, error) {
 	}
 
 	file := &TorrentFile{
-
-		// TODO: improve this
-		Announce: decodedMap["announce"].(string),
+		Announce: announce,
 		Info: Info{
 			Length:      length,
+			Files:       files,
+			MultiFile:   infoMap["files"] != nil,
 			Name:        name,
 			PieceLength: pieceLength,
 			Pieces:      pieces,
 			InfoHash:    infoHash,
 			PiecesHash:  piecesHash,
+			Private:     private == 1,
 		},
 	}
 
-	return file, nil
+	file.AnnounceList = parseAnnounceList(decodedMap["announce-list"])
 
-}
+	if int64(len(piecesHash)) != (length+pieceLength-1)/pieceLength {
+		return nil, fmt.Errorf("wrong format, %d pieces for %d bytes", len(piecesHash), length)
+	}
+
+	return file, nil
 
-type DiscoverPeersRequest struct {
 }
 
-type DiscoverPeersResponse struct {
-	// indicating how often your client should make a request to the tracker.
-	interval int64
+// parseAnnounceList reads the tiers of trackers, entries that aren't strings are ignored
+// as the list is optional and the announce URL is enough to use the torrent
+func parseAnnounceList(value any) [][]string {
+	tiers, ok := value.([]any)
+	if !ok {
+		return nil
+	}
 
-	// A string, which contains list of peers that your client can connect to.
-	// Each peer is represented using 6 bytes.
-	//  The first 4 bytes are the peer's IP address and the last 2 bytes are the peer's port number.
-	peers []*Peer
-}
+	var announceList [][]string
+	for _, tier := range tiers {
+		urls, ok := tier.([]any)
+		if !ok {
+			continue
+		}
 
-func (tf *TorrentFile) DiscoverPeers(ctx context.Context) (*DiscoverPeersResponse, error) {
+		var tierURLs []string
+		for _, u := range urls {
+			if u, ok := u.(string); ok && u != "" {
+				tierURLs = append(tierURLs, u)
+			}
+		}
 
-	u, err := url.Parse(tf.Announce)
-	if err != nil {
-		return nil, err
+		if len(tierURLs) > 0 {
+			announceList = append(announceList, tierURLs)
+		}
 	}
 
-	q := u.Query()
+	return announceList
+}
 
-	q.Set("info_hash", string(tf.Info.InfoHash))
+// validPathElement tells if a name of the torrent is a single file name, so the torrent can't write outside of its directory
+func validPathElement(element string) bool {
+	return element != "" && element != "." && element != ".." && !strings.ContainsAny(element, "/\\")
+}
 
-	// unique identifier for your client
-	// A string of length 20 that you get to pick.
-	q.Set("peer_id", "00112233445566778899")
+// parseFiles reads the files of the torrent, either the single file described by length
+// or the list of files of a multi-file torrent
+func parseFiles(infoMap map[string]any, name string) ([]FileInfo, int64, error) {
+	if length, ok := infoMap["length"].(int64); ok {
+		return []FileInfo{{Length: length, Path: []string{name}}}, length, nil
+	}
 
-	// the port your client is listening on
-	// you will not have to support this functionality during this challenge.
-	q.Set("port", "6881")
+	filesList, ok := infoMap["files"].([]any)
+	if !ok {
+		return nil, 0, fmt.Errorf("wrong format, neither length nor files present")
+	}
 
-	// the total amount uploaded so far
-	// Since your client hasn't uploaded anything yet, you can set this to 0.
-	q.Set("uploaded", "0")
+	var files []FileInfo
+	var offset int64
+	for i, entry := range filesList {
+		fileMap, ok := entry.(map[string]any)
+		if !ok {
+			return nil, 0, fmt.Errorf("wrong format, file %d is not a map", i)
+		}
 
-	// the total amount downloaded so far
-	// Since your client hasn't downloaded anything yet, you can set this to 0
-	q.Set("downloaded", "0")
+		length, ok := fileMap["length"].(int64)
+		if !ok || length < 0 {
+			return nil, 0, fmt.Errorf("wrong format, file %d has no length", i)
+		}
 
-	// the number of bytes left to download
-	// Since you client hasn't downloaded anything yet, this'll be the total length of the file
-	q.Set("left", fmt.Sprintf("%d", tf.Info.Length))
+		pathList, ok := fileMap["path"].([]any)
+		if !ok || len(pathList) == 0 {
+			return nil, 0, fmt.Errorf("wrong format, file %d has no path", i)
+		}
 
-	// whether the peer list should use the compact representation
-	q.Set("compact", "1")
+		var filePath []string
+		for _, element := range pathList {
+			element, ok := element.(string)
 
-	u.RawQuery = q.Encode()
+			if !ok || !validPathElement(element) {
+				return nil, 0, fmt.Errorf("wrong format, file %d has an invalid path %v", i, pathList)
+			}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
+			filePath = append(filePath, element)
+		}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+		files = append(files, FileInfo{
+			Length: length,
+			Path:   filePath,
+			Offset: offset,
+		})
+		offset += length
 	}
 
-	defer resp.Body.Close()
+	return files, offset, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("status code %d", resp.StatusCode)
+// PieceSize returns the size of the piece, the last piece is usually shorter than the others
+func (info *Info) PieceSize(pieceIndex int) int64 {
+	if pieceIndex == len(info.PiecesHash)-1 {
+		if lastSize := info.Length % info.PieceLength; lastSize != 0 {
+			return lastSize
+		}
 	}
 
-	decodedResp, err := bencode.Decode(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+	return info.PieceLength
+}
 
-	if _, ok := decodedResp.(map[string]any); !ok {
-		return nil, fmt.Errorf("response in the wrong format")
-	}
+// fileSegment is the part of a piece that belongs to a single file
+type fileSegment struct {
+	fileIndex int
 
-	decodedRespMap := decodedResp.(map[string]any)
+	// where the segment starts in the file
+	fileOffset int64
 
-	if _, ok := decodedRespMap["interval"]; !ok {
-		// use mininterval if interval doesn't exist
-		decodedRespMap["interval"] = decodedRespMap["mininterval"]
-	}
+	// where the segment starts in the piece
+	pieceOffset int64
 
-	if _, ok := decodedRespMap["interval"].(int64); !ok {
-		return nil, fmt.Errorf("expected interval to be a int64: %+v", decodedRespMap)
-	}
+	length int64
+}
 
-	discoverResp := &DiscoverPeersResponse{
-		interval: decodedRespMap["interval"].(int64),
-	}
+// PieceSegments splits the piece into the parts of the files it overlaps
+func (info *Info) PieceSegments(pieceIndex int) []fileSegment {
+	pieceStart := int64(pieceIndex) * info.PieceLength
+	pieceEnd := pieceStart + info.PieceSize(pieceIndex)
 
-	if _, ok := decodedRespMap["peers"].(string); !ok {
-		return nil, fmt.Errorf("expected peers to be a string")
-	}
+	var segments []fileSegment
+	for i, file := range info.Files {
+		fileEnd := file.Offset + file.Length
 
-	peers := decodedRespMap["peers"].(string)
+		if fileEnd <= pieceStart || file.Offset >= pieceEnd || file.Length == 0 {
+			continue
+		}
 
-	var i int
+		start := max(pieceStart, file.Offset)
+		end := min(pieceEnd, fileEnd)
 
-	// every 6 bytes is a new peer
-	for i < len(peers) {
+		segments = append(segments, fileSegment{
+			fileIndex:   i,
+			fileOffset:  start - file.Offset,
+			pieceOffset: start - pieceStart,
+			length:      end - start,
+		})
+	}
 
-		var buf bytes.Buffer
-		for j := 0; j < 4; j++ {
-			buf.WriteString(fmt.Sprintf("%+v.", peers[j+i]))
-		}
-		port := binary.BigEndian.Uint16([]byte(peers[i+4 : i+6]))
+	return segments
+}
 
-		discoverResp.peers = append(discoverResp.peers, NewPeer(port, strings.TrimSuffix(buf.String(), ".")))
-		i += 6
-	}
+// FilePieces returns the range of pieces that overlap the file, last included
+func (info *Info) FilePieces(fileIndex int) (int, int) {
+	file := info.Files[fileIndex]
+	first := int(file.Offset / info.PieceLength)
 
-	return discoverResp, nil
+	if file.Length == 0 {
+		return first, first - 1
+	}
 
+	last := int((file.Offset + file.Length - 1) / info.PieceLength)
+	return first, last
 }
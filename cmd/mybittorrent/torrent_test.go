@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+func TestParseTorrentFileRejectsEscapingNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "payload.bin", valid: true},
+		{name: "..hidden", valid: true},
+		{name: ""},
+		{name: "."},
+		{name: ".."},
+		{name: "../../.ssh/authorized_keys"},
+		{name: "/etc/passwd"},
+		{name: `..\windows`},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		err := bencode.Marshal(&buf, map[string]any{
+			"announce": "http://127.0.0.1/announce",
+			"info": map[string]any{
+				"name":         tt.name,
+				"length":       int64(10),
+				"piece length": int64(16384),
+				"pieces":       strings.Repeat("x", 20),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = ParseTorrentFile(buf.Bytes())
+		if tt.valid && err != nil {
+			t.Errorf("name %q: %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("name %q was accepted", tt.name)
+		}
+	}
+}
+
+func TestParseTorrentFileRejectsMalformed(t *testing.T) {
+	info := func() map[string]any {
+		return map[string]any{
+			"name":         "payload.bin",
+			"length":       int64(10),
+			"piece length": int64(16384),
+			"pieces":       strings.Repeat("x", 20),
+		}
+	}
+
+	tests := []struct {
+		name    string
+		torrent map[string]any
+	}{
+		{name: "no announce", torrent: map[string]any{"info": info()}},
+		{name: "announce that isn't a string", torrent: map[string]any{"announce": int64(1), "info": info()}},
+		{name: "announce list instead of announce", torrent: map[string]any{"announce": []any{"http://127.0.0.1/announce"}, "info": info()}},
+		{name: "no info", torrent: map[string]any{"announce": "http://127.0.0.1/announce"}},
+		{name: "info that isn't a dictionary", torrent: map[string]any{"announce": "http://127.0.0.1/announce", "info": "x"}},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := bencode.Marshal(&buf, tt.torrent); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ParseTorrentFile(buf.Bytes()); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
+
+func TestParseTorrentFilePrivate(t *testing.T) {
+	tests := []struct {
+		name    string
+		private any
+		want    bool
+	}{
+		{name: "no flag"},
+		{name: "private", private: int64(1), want: true},
+		{name: "public", private: int64(0)},
+		{name: "flag that isn't 1", private: int64(2)},
+		{name: "flag that isn't an integer", private: "1"},
+	}
+
+	for _, tt := range tests {
+		info := map[string]any{
+			"name":         "payload.bin",
+			"length":       int64(10),
+			"piece length": int64(16384),
+			"pieces":       strings.Repeat("x", 20),
+		}
+		if tt.private != nil {
+			info["private"] = tt.private
+		}
+
+		var buf bytes.Buffer
+		if err := bencode.Marshal(&buf, map[string]any{"announce": "http://127.0.0.1/announce", "info": info}); err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := ParseTorrentFile(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if file.Info.Private != tt.want || file.Info.discoverable() == tt.want {
+			t.Errorf("%s: private %v, discoverable %v", tt.name, file.Info.Private, file.Info.discoverable())
+		}
+	}
+}
@@ -0,0 +1,845 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+const (
+	// used until the tracker tells us its interval, and after a failed announce
+	announceRetryInterval = 30 * time.Second
+
+	// completed and stopped are sent even when we are shutting down, so they don't get to wait long
+	eventAnnounceTimeout = 5 * time.Second
+
+	defaultTrackerTimeout = 30 * time.Second
+
+	// peers we ask for in every announce
+	defaultNumWant = 50
+
+	trackerUserAgent = "mybittorrent/0.1"
+
+	maxTrackerRedirects = 5
+
+	// trackers don't send more than that, protects us from decoding whatever they send
+	maxTrackerResponseSize = 4 << 20
+)
+
+// trackerFailureError is returned when the tracker refuses the announce with a failure reason
+type trackerFailureError struct {
+	Reason string
+}
+
+func (e *trackerFailureError) Error() string {
+	return "tracker failure: " + e.Reason
+}
+
+// trackerStatusError is returned when the tracker answers with another HTTP status than 200
+type trackerStatusError struct {
+	StatusCode int
+}
+
+func (e *trackerStatusError) Error() string {
+	return fmt.Sprintf("tracker answered with status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// trackerEvent tells the tracker why we announce, periodic announces have none
+type trackerEvent string
+
+const (
+	eventNone      trackerEvent = ""
+	eventStarted   trackerEvent = "started"
+	eventCompleted trackerEvent = "completed"
+	eventStopped   trackerEvent = "stopped"
+)
+
+// announceStats are the counters of the torrent that are reported in every announce
+type announceStats struct {
+	Uploaded   int64
+	Downloaded int64
+
+	// bytes we still have to download
+	Left int64
+}
+
+type DiscoverPeersRequest struct {
+	Event trackerEvent
+	Stats announceStats
+
+	// sent back to the tracker when it gave us one
+	TrackerID string
+}
+
+type DiscoverPeersResponse struct {
+	// indicating how often your client should make a request to the tracker.
+	interval int64
+
+	// we shouldn't announce more often than that, zero when the tracker doesn't say
+	minInterval int64
+
+	// to send in the next announces
+	trackerID string
+
+	// the tracker answered but wants us to know something
+	warning string
+
+	// number of seeders and leechers, -1 when the tracker doesn't say
+	complete   int64
+	incomplete int64
+
+	// the peers of the peers and peers6 fields, IPv4 first
+	peers []*Peer
+}
+
+// trackerClient announces torrents to their trackers on behalf of our peer
+type trackerClient struct {
+	peerID []byte
+
+	// the port we accept peers on
+	port int
+
+	// random, proves to the tracker that we are the same client when our address changes
+	key string
+
+	numWant   int
+	userAgent string
+
+	// behind a proxy only, our addresses aren't sent and the names of peers aren't resolved
+	hideAddrs bool
+
+	httpClient *http.Client
+}
+
+// trackerClientConfig configures the HTTP requests to the trackers, the zero value uses the defaults
+type trackerClientConfig struct {
+	Timeout   time.Duration
+	UserAgent string
+
+	// http, https, socks5 or socks5h URL of the proxy, the proxy of the environment when empty
+	Proxy string
+
+	NumWant int
+
+	// don't reveal our addresses, nor look up names outside of the proxy
+	HideAddrs bool
+}
+
+func newTrackerClient(peerID []byte, port int, config trackerClientConfig) (*trackerClient, error) {
+	proxy := http.ProxyFromEnvironment
+	if config.Proxy != "" {
+		u, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tracker proxy: %w", err)
+		}
+
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("invalid tracker proxy %q, expected an http, https or socks5 URL", config.Proxy)
+		}
+
+		proxy = http.ProxyURL(u)
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultTrackerTimeout
+	}
+
+	userAgent := config.UserAgent
+	if userAgent == "" {
+		userAgent = trackerUserAgent
+	}
+
+	numWant := config.NumWant
+	if numWant <= 0 {
+		numWant = defaultNumWant
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+
+	key := make([]byte, 4)
+	rand.Read(key)
+
+	return &trackerClient{
+		peerID:    peerID,
+		port:      port,
+		key:       hex.EncodeToString(key),
+		numWant:   numWant,
+		userAgent: userAgent,
+		hideAddrs: config.HideAddrs,
+		httpClient: &http.Client{
+			Transport:     transport,
+			Timeout:       timeout,
+			CheckRedirect: checkTrackerRedirect,
+		},
+	}, nil
+}
+
+// withIdentity returns a client that shares the HTTP client but announces another peer
+func (c *trackerClient) withIdentity(peerID []byte, port int) *trackerClient {
+	client := *c
+	client.peerID = peerID
+	client.port = port
+	return &client
+}
+
+// checkTrackerRedirect follows a few redirects, but never from https to http
+// as the URLs of private trackers carry the passkey of the user
+func checkTrackerRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxTrackerRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxTrackerRedirects)
+	}
+
+	if via[0].URL.Scheme == "https" && req.URL.Scheme != "https" {
+		return fmt.Errorf("refusing to follow a redirect from https to %s", req.URL.Scheme)
+	}
+
+	return nil
+}
+
+// defaultTracker is used by the commands that don't run a session, without a proxy it can't fail
+var defaultTracker, _ = newTrackerClient(localPeerID, 6881, trackerClientConfig{})
+
+// trackerFlags configure the HTTP client of the trackers
+type trackerFlags struct {
+	config trackerClientConfig
+}
+
+func addTrackerFlags(fs *flag.FlagSet) *trackerFlags {
+	t := &trackerFlags{}
+	fs.DurationVar(&t.config.Timeout, "tracker-timeout", defaultTrackerTimeout, "how long to wait for a tracker to answer")
+	fs.StringVar(&t.config.UserAgent, "user-agent", trackerUserAgent, "User-Agent header of the announces")
+	fs.StringVar(&t.config.Proxy, "tracker-proxy", "", "http://, https:// or socks5:// URL of the proxy to reach trackers through, the environment's proxy when empty")
+	fs.IntVar(&t.config.NumWant, "numwant", defaultNumWant, "number of peers to ask the trackers for")
+	return t
+}
+
+// apply replaces the default tracker client, after our peer id and the proxy of the peers are set.
+// The trackers are reached through the proxy of the peers unless they have one of their own.
+func (t *trackerFlags) apply() error {
+	config := t.config
+	if config.Proxy == "" && peerProxy != nil {
+		config.Proxy = peerProxy.URL()
+	}
+	config.HideAddrs = proxyOnly
+
+	client, err := newTrackerClient(localPeerID, defaultTracker.port, config)
+	if err != nil {
+		return err
+	}
+
+	defaultTracker = client
+	return nil
+}
+
+// DiscoverPeers asks the tracker for peers once, without telling it we joined the swarm
+func (tf *TorrentFile) DiscoverPeers(ctx context.Context) (*DiscoverPeersResponse, error) {
+	return defaultTracker.Announce(ctx, tf, DiscoverPeersRequest{
+		Stats: announceStats{Left: tf.Info.Length},
+	})
+}
+
+// Announce asks the tracker of the torrent for peers
+func (c *trackerClient) Announce(ctx context.Context, tf *TorrentFile, req DiscoverPeersRequest) (*DiscoverPeersResponse, error) {
+	tracker := tf.Announce
+	if u, err := url.Parse(tf.Announce); err == nil {
+		tracker = u.Host
+	}
+
+	start := time.Now()
+	resp, err := c.announce(ctx, tf, req)
+	metricAnnounceDuration.Observe(time.Since(start).Seconds(), tracker)
+
+	if err != nil {
+		metricAnnounceErrors.Inc(tracker)
+	}
+
+	return resp, err
+}
+
+func (c *trackerClient) announce(ctx context.Context, tf *TorrentFile, announceReq DiscoverPeersRequest) (*DiscoverPeersResponse, error) {
+
+	q := url.Values{}
+
+	q.Set("info_hash", string(tf.Info.InfoHash))
+
+	// unique identifier for your client
+	// A string of length 20 that you get to pick.
+	q.Set("peer_id", string(c.peerID))
+
+	// the port your client is listening on
+	q.Set("port", strconv.Itoa(c.port))
+
+	// the total amount uploaded and downloaded since we started
+	q.Set("uploaded", strconv.FormatInt(announceReq.Stats.Uploaded, 10))
+	q.Set("downloaded", strconv.FormatInt(announceReq.Stats.Downloaded, 10))
+
+	// the number of bytes left to download
+	q.Set("left", strconv.FormatInt(announceReq.Stats.Left, 10))
+
+	// whether the peer list should use the compact representation
+	q.Set("compact", "1")
+
+	q.Set("key", c.key)
+
+	// the answer to stopped has no use for peers
+	numWant := c.numWant
+	if announceReq.Event == eventStopped {
+		numWant = 0
+	}
+	q.Set("numwant", strconv.Itoa(numWant))
+
+	if announceReq.Event != eventNone {
+		q.Set("event", string(announceReq.Event))
+	}
+
+	if announceReq.TrackerID != "" {
+		q.Set("trackerid", announceReq.TrackerID)
+	}
+
+	// the tracker only sees the address we connect from, these tell it about the other family
+	// https://www.bittorrent.org/beps/bep_0007.html
+	if !c.hideAddrs {
+		ipv4, ipv6 := publicAddrs()
+		if ipv4.IsValid() {
+			q.Set("ipv4", ipv4.String())
+		}
+		if ipv6.IsValid() {
+			q.Set("ipv6", ipv6.String())
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, announceURL(tf.Announce, q), nil)
+	if err != nil {
+		return nil, redactURLError(err)
+	}
+
+	req.Header.Set("User-Agent", c.userAgent)
+
+	// asked for explicitly, so the body isn't decompressed for us
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, redactURLError(err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &trackerStatusError{StatusCode: resp.StatusCode}
+	}
+
+	var body io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip response: %w", err)
+		}
+		defer gz.Close()
+
+		body = gz
+	}
+
+	decodedResp, err := bencode.Decode(io.LimitReader(body, maxTrackerResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker response: %w", err)
+	}
+
+	if _, ok := decodedResp.(map[string]any); !ok {
+		return nil, fmt.Errorf("response in the wrong format")
+	}
+
+	decodedRespMap := decodedResp.(map[string]any)
+
+	// nothing else is in the response when the tracker refuses the announce
+	if reason, ok := decodedRespMap["failure reason"].(string); ok {
+		return nil, &trackerFailureError{Reason: reason}
+	}
+
+	discoverResp := &DiscoverPeersResponse{
+		complete:   -1,
+		incomplete: -1,
+	}
+
+	discoverResp.minInterval, _ = decodedRespMap["min interval"].(int64)
+
+	interval, ok := decodedRespMap["interval"].(int64)
+	if !ok {
+		// use min interval if interval doesn't exist
+		interval = discoverResp.minInterval
+	}
+
+	// the answer to stopped is only an acknowledgement
+	if interval <= 0 && announceReq.Event != eventStopped {
+		return nil, fmt.Errorf("expected interval to be a positive int64: %+v", decodedRespMap)
+	}
+
+	discoverResp.interval = interval
+
+	discoverResp.trackerID, _ = decodedRespMap["tracker id"].(string)
+	discoverResp.warning, _ = decodedRespMap["warning message"].(string)
+
+	if complete, ok := decodedRespMap["complete"].(int64); ok {
+		discoverResp.complete = complete
+	}
+
+	if incomplete, ok := decodedRespMap["incomplete"].(int64); ok {
+		discoverResp.incomplete = incomplete
+	}
+
+	discoverResp.peers, err = c.parsePeers(ctx, decodedRespMap)
+	if err != nil {
+		return nil, err
+	}
+
+	return discoverResp, nil
+
+}
+
+// announceURL appends our parameters to the announce URL as it is in the torrent, private trackers
+// expect their passkey and parameters to come back byte for byte so the URL isn't parsed and encoded again
+func announceURL(announce string, params url.Values) string {
+	announce, _, _ = strings.Cut(announce, "#")
+
+	switch {
+	case !strings.Contains(announce, "?"):
+		return announce + "?" + params.Encode()
+	case strings.HasSuffix(announce, "?"), strings.HasSuffix(announce, "&"):
+		return announce + params.Encode()
+	default:
+		return announce + "&" + params.Encode()
+	}
+}
+
+// redactURLError keeps the path and query of the announce URL out of the errors, they often hold a passkey
+func redactURLError(err error) error {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return err
+	}
+
+	if u, parseErr := url.Parse(urlErr.URL); parseErr == nil {
+		urlErr.URL = u.Scheme + "://" + u.Host
+	}
+
+	return urlErr
+}
+
+const (
+	compactIPv4PeerSize = 6
+	compactIPv6PeerSize = 18
+)
+
+// parsePeers reads the peers of the response, in the compact model of peers and peers6
+// or in the dictionary model where every peer has an ip, a port and a peer id
+func (c *trackerClient) parsePeers(ctx context.Context, decodedRespMap map[string]any) ([]*Peer, error) {
+	var peers []*Peer
+
+	switch value := decodedRespMap["peers"].(type) {
+	case nil:
+		// the answer to stopped and trackers that only know IPv6 peers may leave it out
+
+	case string:
+		compact, err := parseCompactPeers(value, compactIPv4PeerSize)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, compact...)
+
+	case []any:
+		for i, entry := range value {
+			peerMap, ok := entry.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("wrong format, peer %d is not a map", i)
+			}
+
+			peer, err := c.parsePeer(ctx, peerMap)
+			if err != nil {
+				slog.Debug("ignoring peer from the tracker", "err", err)
+				continue
+			}
+
+			if peer != nil {
+				peers = append(peers, peer)
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("expected peers to be a string or a list, got %T", value)
+	}
+
+	// https://www.bittorrent.org/beps/bep_0007.html
+	if value, ok := decodedRespMap["peers6"].(string); ok {
+		compact, err := parseCompactPeers(value, compactIPv6PeerSize)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, compact...)
+	}
+
+	return peers, nil
+}
+
+// parseCompactPeers reads the address followed by the port in network order of every peer
+func parseCompactPeers(peers string, size int) ([]*Peer, error) {
+	if len(peers)%size != 0 {
+		return nil, fmt.Errorf("compact peers must be a multiple of %d bytes, got %d", size, len(peers))
+	}
+
+	var result []*Peer
+	for i := 0; i < len(peers); i += size {
+		entry := []byte(peers[i : i+size])
+
+		addr, ok := netip.AddrFromSlice(entry[:size-2])
+		if !ok {
+			return nil, fmt.Errorf("invalid compact peer %x", entry)
+		}
+		port := binary.BigEndian.Uint16(entry[size-2:])
+
+		result = append(result, NewPeer(netip.AddrPortFrom(addr, port)))
+	}
+
+	return result, nil
+}
+
+// parsePeer reads a peer of the dictionary model, the ip may be a hostname that is resolved.
+// We are sometimes given to ourselves, that peer is nil.
+func (c *trackerClient) parsePeer(ctx context.Context, peerMap map[string]any) (*Peer, error) {
+	host, ok := peerMap["ip"].(string)
+	if !ok || host == "" {
+		return nil, fmt.Errorf("peer without ip: %v", peerMap)
+	}
+
+	port, ok := peerMap["port"].(int64)
+	if !ok || port <= 0 || port > 0xffff {
+		return nil, fmt.Errorf("peer %s has an invalid port %v", host, peerMap["port"])
+	}
+
+	if peerID, ok := peerMap["peer id"].(string); ok && peerID == string(c.peerID) {
+		return nil, nil
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil && c.hideAddrs {
+		// the lookup would go around the proxy
+		return nil, fmt.Errorf("not resolving peer %s without the proxy", host)
+	}
+	if err != nil {
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve peer %s: %w", host, err)
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("peer %s has no address", host)
+		}
+
+		addr = addrs[0]
+	}
+
+	return NewPeer(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// publicAddrs returns the addresses we would reach the internet from, when they are public.
+// Connecting a UDP socket only picks the route, nothing is sent.
+func publicAddrs() (ipv4, ipv6 netip.Addr) {
+	lookup := func(network, remote string) netip.Addr {
+		conn, err := net.Dial(network, remote)
+		if err != nil {
+			return netip.Addr{}
+		}
+		defer conn.Close()
+
+		addr, err := netip.ParseAddrPort(conn.LocalAddr().String())
+		if err != nil {
+			return netip.Addr{}
+		}
+
+		ip := addr.Addr().Unmap()
+		if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+			return netip.Addr{}
+		}
+
+		return ip
+	}
+
+	return lookup("udp4", "198.51.100.1:6881"), lookup("udp6", "[2001:db8::1]:6881")
+}
+
+// TrackerStatus is what the tracker told us in the last announce
+type TrackerStatus struct {
+	LastAnnounce time.Time
+	NextAnnounce time.Time
+
+	// the last announce failed
+	Err     error
+	Warning string
+
+	// -1 when the tracker doesn't say
+	Seeders  int64
+	Leechers int64
+}
+
+// announcer keeps a torrent announced while it runs: started first, then on the interval of the
+// tracker, completed when the download finishes and stopped when the context is canceled
+type announcer struct {
+	client *trackerClient
+	file   *TorrentFile
+	log    *slog.Logger
+
+	// counters of the torrent, read for every announce
+	stats func() announceStats
+
+	// called with the peers of every successful announce
+	onPeers func([]*Peer)
+
+	// wake up the loop before the interval is over
+	completedCh chan struct{}
+	moreCh      chan struct{}
+
+	mu      sync.Mutex
+	started bool
+
+	// the tracker was told we have everything, by started or completed
+	seeding bool
+
+	trackerID   string
+	interval    time.Duration
+	minInterval time.Duration
+	status      TrackerStatus
+}
+
+func newAnnouncer(client *trackerClient, file *TorrentFile, stats func() announceStats, log *slog.Logger) *announcer {
+	return &announcer{
+		client:      client,
+		file:        file,
+		log:         log,
+		stats:       stats,
+		onPeers:     func([]*Peer) {},
+		completedCh: make(chan struct{}, 1),
+		moreCh:      make(chan struct{}, 1),
+		interval:    announceRetryInterval,
+		status:      TrackerStatus{Seeders: -1, Leechers: -1},
+	}
+}
+
+// Status returns what the tracker told us in the last announce
+func (a *announcer) Status() TrackerStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.status
+}
+
+// Completed sends the completed event, it must only be called when the download finished while running
+func (a *announcer) Completed() {
+	select {
+	case a.completedCh <- struct{}{}:
+	default:
+	}
+}
+
+// MorePeers announces as soon as the min interval of the tracker allows it
+func (a *announcer) MorePeers() {
+	select {
+	case a.moreCh <- struct{}{}:
+	default:
+	}
+}
+
+// Start sends the started event and returns the peers, Run retries if it fails
+func (a *announcer) Start(ctx context.Context) ([]*Peer, error) {
+	resp, err := a.announce(ctx, eventStarted)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.peers, nil
+}
+
+// Run announces until the context is canceled, then tells the tracker we stopped
+func (a *announcer) Run(ctx context.Context) {
+	for {
+		a.mu.Lock()
+		started, next := a.started, a.status.NextAnnounce
+		a.mu.Unlock()
+
+		if !started {
+			_, err := a.announce(ctx, eventStarted)
+			if ctx.Err() != nil {
+				return
+			}
+			if err == nil {
+				continue
+			}
+
+			a.mu.Lock()
+			next = a.status.NextAnnounce
+			a.mu.Unlock()
+		}
+
+		timer := time.NewTimer(time.Until(next))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			a.stop()
+			return
+
+		case <-timer.C:
+			if started {
+				a.announce(ctx, eventNone)
+			}
+
+		case <-a.completedCh:
+			timer.Stop()
+			a.complete(ctx)
+
+		case <-a.moreCh:
+			timer.Stop()
+
+			// trackers without a min interval aren't asked more often than after a failure
+			a.mu.Lock()
+			wait := time.Until(a.status.LastAnnounce.Add(max(a.minInterval, announceRetryInterval)))
+			a.mu.Unlock()
+
+			if wait > 0 {
+				select {
+				case <-ctx.Done():
+					a.stop()
+					return
+				case <-time.After(wait):
+				}
+			}
+
+			if started {
+				a.announce(ctx, eventNone)
+			}
+		}
+	}
+}
+
+// stop sends the stopped event if the tracker knows about us
+func (a *announcer) stop() {
+	a.mu.Lock()
+	started := a.started
+	a.mu.Unlock()
+
+	if !started {
+		return
+	}
+
+	// the download may have finished right before the stop
+	select {
+	case <-a.completedCh:
+		a.complete(context.Background())
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), eventAnnounceTimeout)
+	defer cancel()
+
+	a.announce(ctx, eventStopped)
+}
+
+// complete sends the completed event unless the tracker already knows we have everything
+func (a *announcer) complete(ctx context.Context) {
+	a.mu.Lock()
+	started, seeding := a.started, a.seeding
+	a.mu.Unlock()
+
+	if !started || seeding {
+		return
+	}
+
+	// the download is over, stopping the torrent right after must not cancel the announce
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), eventAnnounceTimeout)
+	defer cancel()
+
+	a.announce(ctx, eventCompleted)
+}
+
+func (a *announcer) announce(ctx context.Context, event trackerEvent) (*DiscoverPeersResponse, error) {
+	a.mu.Lock()
+	trackerID := a.trackerID
+	a.mu.Unlock()
+
+	stats := a.stats()
+	resp, err := a.client.Announce(ctx, a.file, DiscoverPeersRequest{
+		Event:     event,
+		Stats:     stats,
+		TrackerID: trackerID,
+	})
+
+	a.mu.Lock()
+
+	now := time.Now()
+	a.status.LastAnnounce = now
+	a.status.Err = err
+
+	if err != nil {
+		a.status.NextAnnounce = now.Add(announceRetryInterval)
+		a.mu.Unlock()
+
+		if ctx.Err() == nil {
+			a.log.Warn("failed to announce", "event", event, "err", err, "retry_in", announceRetryInterval)
+		}
+		return nil, err
+	}
+
+	a.interval = time.Duration(resp.interval) * time.Second
+	a.minInterval = time.Duration(resp.minInterval) * time.Second
+	if resp.trackerID != "" {
+		a.trackerID = resp.trackerID
+	}
+
+	// the same warning usually comes with every announce
+	if resp.warning != "" && resp.warning != a.status.Warning {
+		a.log.Warn("tracker warning", "warning", resp.warning)
+	}
+
+	a.status.NextAnnounce = now.Add(a.interval)
+	a.status.Warning = resp.warning
+	a.status.Seeders = resp.complete
+	a.status.Leechers = resp.incomplete
+
+	a.log.Debug("announced", "event", event, "peers", len(resp.peers), "seeders", resp.complete, "leechers", resp.incomplete, "interval", a.interval)
+
+	switch event {
+	case eventStarted:
+		a.started = true
+		a.seeding = stats.Left == 0
+	case eventCompleted:
+		a.seeding = true
+	case eventStopped:
+		a.started = false
+	}
+
+	a.mu.Unlock()
+
+	if event != eventStopped && len(resp.peers) > 0 {
+		a.onPeers(resp.peers)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+const testPasskey = "0123456789abcdef"
+
+// testTorrent is a torrent of the tracker at announce
+func testTorrent(announce string) *TorrentFile {
+	return &TorrentFile{
+		Announce: announce,
+		Info: Info{
+			InfoHash: make([]byte, 20),
+			Length:   5,
+		},
+	}
+}
+
+// writeAnnounce answers an announce with a peer at 127.0.0.1:6881
+func writeAnnounce(w http.ResponseWriter) {
+	bencode.Marshal(w, map[string]any{
+		"interval": int64(60),
+		"peers":    "\x7f\x00\x00\x01\x1a\xe1",
+	})
+}
+
+// testTrackerServer is our tracker, announcing every minute
+func testTrackerServer() (*swarmStore, *trackerServer) {
+	store := newSwarmStore(time.Minute, nil)
+	return store, newTrackerServer(store, time.Minute, time.Minute)
+}
+
+func TestTrackerClientAnnounce(t *testing.T) {
+	store, tracker := testTrackerServer()
+
+	// a peer already in the swarm, seeding what we download
+	store.Announce(swarmAnnounce{
+		InfoHash: string(make([]byte, 20)),
+		PeerID:   "-XX0000-000000000000",
+		NumWant:  -1,
+		V4:       netip.MustParseAddrPort("127.0.0.1:6881"),
+	}, time.Now())
+
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		tracker.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	client, err := newTrackerClient(localPeerID, 6881, trackerClientConfig{UserAgent: "test/1.0", NumWant: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tf := testTorrent(server.URL + "/announce?uid=1%2f2")
+	resp, err := client.Announce(context.Background(), tf, DiscoverPeersRequest{Event: eventStarted, Stats: announceStats{Left: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the parameters of the tracker come back byte for byte, before ours
+	if got.URL.Path != "/announce" || !strings.HasPrefix(got.URL.RawQuery, "uid=1%2f2&") {
+		t.Errorf("announced to %s", got.URL)
+	}
+
+	if ua := got.Header.Get("User-Agent"); ua != "test/1.0" {
+		t.Errorf("got user agent %q", ua)
+	}
+
+	q := got.URL.Query()
+	if q.Get("numwant") != "7" || q.Get("event") != "started" || q.Get("left") != "5" || q.Get("compact") != "1" {
+		t.Errorf("got query %s", got.URL.RawQuery)
+	}
+
+	if resp.interval != 60 || len(resp.peers) != 1 || resp.peers[0].addr != netip.MustParseAddrPort("127.0.0.1:6881") {
+		t.Errorf("got interval %d and peers %v", resp.interval, resp.peers)
+	}
+}
+
+func TestTrackerClientSwarm(t *testing.T) {
+	store, tracker := testTrackerServer()
+	server := httptest.NewServer(tracker)
+	defer server.Close()
+
+	tf := testTorrent(server.URL + "/announce")
+
+	newClient := func(peerID string, port int) *trackerClient {
+		client, err := newTrackerClient([]byte(peerID), port, trackerClientConfig{HideAddrs: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	seeder := newClient("-XX0000-seederseeder", 7001)
+	leecher := newClient("-XX0000-leecherleech", 7002)
+
+	resp, err := seeder.Announce(context.Background(), tf, DiscoverPeersRequest{Event: eventStarted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.interval != 60 || len(resp.peers) != 0 {
+		t.Fatalf("first peer got interval %d and peers %v", resp.interval, resp.peers)
+	}
+
+	resp, err = leecher.Announce(context.Background(), tf, DiscoverPeersRequest{Event: eventStarted, Stats: announceStats{Left: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.peers) != 1 || resp.peers[0].addr != netip.MustParseAddrPort("127.0.0.1:7001") {
+		t.Fatalf("leecher got peers %v", resp.peers)
+	}
+
+	_, err = leecher.Announce(context.Background(), tf, DiscoverPeersRequest{Event: eventCompleted})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = seeder.Announce(context.Background(), tf, DiscoverPeersRequest{Event: eventStopped})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := store.Scrape(nil)[string(tf.Info.InfoHash)]
+	if st != (swarmStats{Complete: 1, Downloaded: 1}) {
+		t.Fatalf("swarm after the announces: %+v", st)
+	}
+}
+
+func TestTrackerClientGzip(t *testing.T) {
+	var accepted string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepted = r.Header.Get("Accept-Encoding")
+
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		bencode.Marshal(gz, map[string]any{
+			"interval": int64(60),
+			"peers":    "\x7f\x00\x00\x01\x1a\xe1\x7f\x00\x00\x02\x1a\xe1",
+		})
+		gz.Close()
+	}))
+	defer server.Close()
+
+	resp, err := defaultTracker.Announce(context.Background(), testTorrent(server.URL+"/announce"), DiscoverPeersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if accepted != "gzip" {
+		t.Errorf("announce accepts encoding %q", accepted)
+	}
+
+	if len(resp.peers) != 2 {
+		t.Fatalf("got %d peers from the gzipped response, want 2", len(resp.peers))
+	}
+}
+
+func TestTrackerClientErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/failure":
+			bencode.Marshal(w, map[string]any{"failure reason": "unregistered torrent"})
+		case "/missing":
+			http.NotFound(w, r)
+		case "/broken":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write([]byte("not gzip"))
+		}
+	}))
+	defer server.Close()
+
+	announce := func(path string) error {
+		_, err := defaultTracker.Announce(context.Background(), testTorrent(server.URL+path), DiscoverPeersRequest{})
+		return err
+	}
+
+	var failure *trackerFailureError
+	if err := announce("/failure"); !errors.As(err, &failure) || failure.Reason != "unregistered torrent" {
+		t.Errorf("announce refused with a failure reason: %v", err)
+	}
+
+	var status *trackerStatusError
+	if err := announce("/missing"); !errors.As(err, &status) || status.StatusCode != http.StatusNotFound {
+		t.Errorf("announce answered with 404: %v", err)
+	}
+
+	if err := announce("/broken"); err == nil {
+		t.Error("a response that isn't gzip was accepted")
+	}
+}
+
+func TestTrackerClientTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	client, err := newTrackerClient(localPeerID, 6881, trackerClientConfig{Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = client.Announce(context.Background(), testTorrent(server.URL+"/"+testPasskey+"/announce"), DiscoverPeersRequest{})
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("announce to a tracker that doesn't answer: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("announce gave up after %v", elapsed)
+	}
+
+	// the errors end up in the logs and the status of the torrents
+	if strings.Contains(err.Error(), testPasskey) {
+		t.Fatalf("error reveals the passkey: %v", err)
+	}
+}
+
+func TestTrackerClientRedactsPasskey(t *testing.T) {
+	// a port nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	for _, announce := range []string{
+		"http://" + addr + "/" + testPasskey + "/announce",
+		"http://" + addr + "/announce?passkey=" + testPasskey,
+	} {
+		_, err := defaultTracker.Announce(context.Background(), testTorrent(announce), DiscoverPeersRequest{})
+		if err == nil {
+			t.Fatalf("announce to %s succeeded", addr)
+		}
+
+		if strings.Contains(err.Error(), testPasskey) {
+			t.Errorf("error reveals the passkey: %v", err)
+		}
+		if !strings.Contains(err.Error(), addr) {
+			t.Errorf("error doesn't tell which tracker failed: %v", err)
+		}
+	}
+}
+
+func TestTrackerClientProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		writeAnnounce(w)
+	}))
+	defer proxy.Close()
+
+	client, err := newTrackerClient(localPeerID, 6881, trackerClientConfig{Proxy: proxy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the name is only resolved by the proxy
+	_, err = client.Announce(context.Background(), testTorrent("http://tracker.invalid/announce"), DiscoverPeersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(proxied, "http://tracker.invalid/announce?") {
+		t.Fatalf("proxy got %q", proxied)
+	}
+
+	for _, url := range []string{"ftp://127.0.0.1:21", "127.0.0.1:8080"} {
+		if _, err := newTrackerClient(localPeerID, 6881, trackerClientConfig{Proxy: url}); err == nil {
+			t.Errorf("proxy %q was accepted", url)
+		}
+	}
+}
+
+func TestTrackerClientRefusesDowngrade(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAnnounce(w)
+	}))
+	defer plain.Close()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, plain.URL+r.URL.RequestURI(), http.StatusFound)
+	}))
+	defer server.Close()
+
+	client, err := newTrackerClient(localPeerID, 6881, trackerClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.httpClient.Transport = server.Client().Transport
+
+	_, err = client.Announce(context.Background(), testTorrent(server.URL+"/announce?passkey="+testPasskey), DiscoverPeersRequest{})
+	if err == nil {
+		t.Fatal("followed a redirect from https to http")
+	}
+
+	if strings.Contains(err.Error(), testPasskey) {
+		t.Fatalf("error reveals the passkey: %v", err)
+	}
+}
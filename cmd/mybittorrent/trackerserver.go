@@ -0,0 +1,776 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+const (
+	defaultServerInterval    = 30 * time.Minute
+	defaultServerMinInterval = time.Minute
+
+	// the most peers we give in one answer, whatever numwant asks for
+	maxServerNumWant = 200
+)
+
+var (
+	errTorrentNotAllowed = errors.New("torrent not allowed on this tracker")
+	errPeerIDInUse       = errors.New("peer id in use by another peer")
+)
+
+// swarmStore keeps the peers of every torrent announced to our tracker, the HTTP and UDP trackers share it
+type swarmStore struct {
+	mu     sync.Mutex
+	swarms map[string]*swarm
+
+	// nil when every torrent is allowed
+	allowed map[string]bool
+
+	// peers that didn't announce for that long are dropped
+	timeout time.Duration
+}
+
+// swarm is the peers of a torrent, by peer id
+type swarm struct {
+	peers map[string]*swarmPeer
+
+	// completed events received, the downloaded of scrape
+	downloaded int64
+}
+
+type swarmPeer struct {
+	id string
+
+	// the key the peer announced with, to tell it from another peer using the same id
+	key string
+
+	// a peer may be reachable over both families
+	v4 netip.AddrPort
+	v6 netip.AddrPort
+
+	left int64
+	seen time.Time
+}
+
+func (p *swarmPeer) seeding() bool {
+	return p.left == 0
+}
+
+// label names the event in the metrics, periodic announces have none
+func (e trackerEvent) label() string {
+	if e == eventNone {
+		return "none"
+	}
+	return string(e)
+}
+
+// swarmAnnounce is an announce as it's received by any of our trackers
+type swarmAnnounce struct {
+	InfoHash string
+	PeerID   string
+	Key      string
+	Event    trackerEvent
+	Left     int64
+	NumWant  int
+
+	// the addresses the peer can be reached on, the one it announced from and the one it told us about
+	V4 netip.AddrPort
+	V6 netip.AddrPort
+}
+
+// swarmAnswer is what the announcing peer is told
+type swarmAnswer struct {
+	Complete   int
+	Incomplete int
+	Peers      []swarmPeer
+}
+
+// swarmStats is the scrape of a torrent
+type swarmStats struct {
+	Complete   int
+	Downloaded int64
+	Incomplete int
+}
+
+// newSwarmStore tolerates one lost announce before dropping a peer. Only the allowed
+// info hashes are tracked when some are given.
+func newSwarmStore(interval time.Duration, allowed [][]byte) *swarmStore {
+	s := &swarmStore{
+		swarms:  make(map[string]*swarm),
+		timeout: 2 * interval,
+	}
+
+	if len(allowed) > 0 {
+		s.allowed = make(map[string]bool, len(allowed))
+		for _, infoHash := range allowed {
+			s.allowed[string(infoHash)] = true
+		}
+	}
+
+	return s
+}
+
+// Announce records the peer and returns other peers of the swarm
+func (s *swarmStore) Announce(req swarmAnnounce, now time.Time) (swarmAnswer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.allowed != nil && !s.allowed[req.InfoHash] {
+		return swarmAnswer{}, errTorrentNotAllowed
+	}
+
+	sw := s.swarms[req.InfoHash]
+	if sw == nil {
+		sw = &swarm{peers: make(map[string]*swarmPeer)}
+		s.swarms[req.InfoHash] = sw
+	}
+
+	// the same peer comes back with its key or from one of its addresses, a missing address matches nothing
+	peer := sw.peers[req.PeerID]
+	if peer != nil && now.Sub(peer.seen) < s.timeout {
+		sameAddr := (req.V4.IsValid() && req.V4 == peer.v4) || (req.V6.IsValid() && req.V6 == peer.v6)
+		if peer.key != req.Key && !sameAddr {
+			return swarmAnswer{}, errPeerIDInUse
+		}
+	}
+
+	if req.Event == eventStopped {
+		delete(sw.peers, req.PeerID)
+		return sw.answer(nil, 0), nil
+	}
+
+	// a peer that was already a seeder doesn't count twice
+	if req.Event == eventCompleted && (peer == nil || !peer.seeding()) {
+		sw.downloaded++
+	}
+
+	if peer == nil {
+		peer = &swarmPeer{id: req.PeerID}
+		sw.peers[req.PeerID] = peer
+	}
+
+	peer.key = req.Key
+	peer.left = req.Left
+	peer.seen = now
+	if req.V4.IsValid() {
+		peer.v4 = req.V4
+	}
+	if req.V6.IsValid() {
+		peer.v6 = req.V6
+	}
+
+	numWant := req.NumWant
+	if numWant < 0 {
+		numWant = defaultNumWant
+	}
+	numWant = min(numWant, maxServerNumWant)
+
+	return sw.answer(peer, numWant), nil
+}
+
+// answer picks up to numWant random peers other than the one asking, seeders have no use for other seeders
+func (sw *swarm) answer(asking *swarmPeer, numWant int) swarmAnswer {
+	var answer swarmAnswer
+	var candidates []*swarmPeer
+
+	for _, peer := range sw.peers {
+		if peer.seeding() {
+			answer.Complete++
+		} else {
+			answer.Incomplete++
+		}
+
+		if asking == nil || peer == asking || (asking.seeding() && peer.seeding()) {
+			continue
+		}
+
+		candidates = append(candidates, peer)
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	for _, peer := range candidates[:min(numWant, len(candidates))] {
+		answer.Peers = append(answer.Peers, *peer)
+	}
+
+	return answer
+}
+
+// Scrape returns the stats of the torrents, of all of them when none is given
+func (s *swarmStore) Scrape(infoHashes []string) map[string]swarmStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(infoHashes) == 0 {
+		for infoHash := range s.swarms {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+
+	stats := make(map[string]swarmStats, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		if s.allowed != nil && !s.allowed[infoHash] {
+			continue
+		}
+
+		var st swarmStats
+		if sw := s.swarms[infoHash]; sw != nil {
+			answer := sw.answer(nil, 0)
+			st = swarmStats{Complete: answer.Complete, Downloaded: sw.downloaded, Incomplete: answer.Incomplete}
+		}
+
+		stats[infoHash] = st
+	}
+
+	return stats
+}
+
+// Expire drops the peers that stopped announcing, and the swarms nobody ever completed once they are empty
+func (s *swarmStore) Expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for infoHash, sw := range s.swarms {
+		for id, peer := range sw.peers {
+			if now.Sub(peer.seen) >= s.timeout {
+				delete(sw.peers, id)
+			}
+		}
+
+		if len(sw.peers) == 0 && sw.downloaded == 0 {
+			delete(s.swarms, infoHash)
+		}
+	}
+}
+
+type swarmJSON struct {
+	InfoHash   string          `json:"info_hash"`
+	Downloaded int64           `json:"downloaded"`
+	Peers      []swarmPeerJSON `json:"peers"`
+}
+
+type swarmPeerJSON struct {
+	PeerID string         `json:"peer_id"`
+	Key    string         `json:"key,omitempty"`
+	IPv4   netip.AddrPort `json:"ipv4"`
+	IPv6   netip.AddrPort `json:"ipv6"`
+	Left   int64          `json:"left"`
+	Seen   time.Time      `json:"seen"`
+}
+
+// Save writes the swarms to path, through a temporary file so a crash doesn't leave half of them
+func (s *swarmStore) Save(path string) error {
+	s.mu.Lock()
+	state := make([]swarmJSON, 0, len(s.swarms))
+	for infoHash, sw := range s.swarms {
+		swJSON := swarmJSON{
+			InfoHash:   hex.EncodeToString([]byte(infoHash)),
+			Downloaded: sw.downloaded,
+			Peers:      make([]swarmPeerJSON, 0, len(sw.peers)),
+		}
+
+		for _, peer := range sw.peers {
+			swJSON.Peers = append(swJSON.Peers, swarmPeerJSON{
+				PeerID: hex.EncodeToString([]byte(peer.id)),
+				Key:    peer.key,
+				IPv4:   peer.v4,
+				IPv6:   peer.v6,
+				Left:   peer.left,
+				Seen:   peer.seen,
+			})
+		}
+
+		state = append(state, swJSON)
+	}
+	s.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to save tracker state: %w", err)
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Load reads the swarms saved at path, a missing file is an empty tracker
+func (s *swarmStore) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state []swarmJSON
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return fmt.Errorf("invalid tracker state %s: %w", path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, swJSON := range state {
+		infoHash, err := hex.DecodeString(swJSON.InfoHash)
+		if err != nil {
+			return fmt.Errorf("invalid tracker state %s: %w", path, err)
+		}
+
+		sw := &swarm{
+			peers:      make(map[string]*swarmPeer, len(swJSON.Peers)),
+			downloaded: swJSON.Downloaded,
+		}
+
+		for _, peerJSON := range swJSON.Peers {
+			id, err := hex.DecodeString(peerJSON.PeerID)
+			if err != nil {
+				return fmt.Errorf("invalid tracker state %s: %w", path, err)
+			}
+
+			sw.peers[string(id)] = &swarmPeer{
+				id:   string(id),
+				key:  peerJSON.Key,
+				v4:   peerJSON.IPv4,
+				v6:   peerJSON.IPv6,
+				left: peerJSON.Left,
+				seen: peerJSON.Seen,
+			}
+		}
+
+		s.swarms[string(infoHash)] = sw
+	}
+
+	return nil
+}
+
+// trackerServer answers announces and scrapes over HTTP
+// https://www.bittorrent.org/beps/bep_0003.html#trackers
+// https://www.bittorrent.org/beps/bep_0048.html
+type trackerServer struct {
+	store *swarmStore
+
+	interval    time.Duration
+	minInterval time.Duration
+
+	mux *http.ServeMux
+}
+
+const (
+	trackerAnnouncePath = "/announce"
+	trackerScrapePath   = "/scrape"
+)
+
+func newTrackerServer(store *swarmStore, interval, minInterval time.Duration) *trackerServer {
+	t := &trackerServer{
+		store:       store,
+		interval:    interval,
+		minInterval: minInterval,
+		mux:         http.NewServeMux(),
+	}
+
+	t.mux.HandleFunc(trackerAnnouncePath, t.announce)
+	t.mux.HandleFunc(trackerScrapePath, t.scrape)
+
+	return t
+}
+
+func (t *trackerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mux.ServeHTTP(w, r)
+}
+
+func (t *trackerServer) announce(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	req, err := parseAnnounceQuery(q, r.RemoteAddr)
+	if err != nil {
+		writeTrackerFailure(w, err)
+		return
+	}
+
+	answer, err := t.store.Announce(req, time.Now())
+	if err != nil {
+		writeTrackerFailure(w, err)
+		return
+	}
+
+	metricTrackerServerAnnounces.Inc(req.Event.label(), "http")
+	slog.Debug("announce", "info_hash", hex.EncodeToString([]byte(req.InfoHash)), "event", req.Event, "v4", req.V4, "v6", req.V6, "left", req.Left)
+
+	resp := map[string]any{
+		"interval":     int64(t.interval.Seconds()),
+		"min interval": int64(t.minInterval.Seconds()),
+		"complete":     int64(answer.Complete),
+		"incomplete":   int64(answer.Incomplete),
+	}
+
+	// compact is the default, the dictionary model is only given to the clients that ask for it
+	// https://www.bittorrent.org/beps/bep_0023.html
+	if q.Get("compact") == "0" {
+		noPeerID := q.Get("no_peer_id") == "1"
+
+		peers := []any{}
+		for _, peer := range answer.Peers {
+			for _, addr := range []netip.AddrPort{peer.v4, peer.v6} {
+				if !addr.IsValid() {
+					continue
+				}
+
+				peerMap := map[string]any{"ip": addr.Addr().String(), "port": int64(addr.Port())}
+				if !noPeerID {
+					peerMap["peer id"] = peer.id
+				}
+				peers = append(peers, peerMap)
+			}
+		}
+
+		resp["peers"] = peers
+	} else {
+		var peers, peers6 []byte
+		for _, peer := range answer.Peers {
+			if peer.v4.IsValid() {
+				peers = append(peers, peer.v4.Addr().AsSlice()...)
+				peers = binary.BigEndian.AppendUint16(peers, peer.v4.Port())
+			}
+			if peer.v6.IsValid() {
+				peers6 = append(peers6, peer.v6.Addr().AsSlice()...)
+				peers6 = binary.BigEndian.AppendUint16(peers6, peer.v6.Port())
+			}
+		}
+
+		resp["peers"] = string(peers)
+		if len(peers6) > 0 {
+			resp["peers6"] = string(peers6)
+		}
+	}
+
+	writeBencode(w, resp)
+}
+
+// parseAnnounceQuery reads an announce, the peer is reached on the address it announced from
+// and on the addresses it tells us about with ipv4 and ipv6. The ip parameter isn't trusted,
+// it would let anyone add someone else to a swarm.
+func parseAnnounceQuery(q map[string][]string, remoteAddr string) (swarmAnnounce, error) {
+	get := func(key string) string {
+		if values := q[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	req := swarmAnnounce{
+		InfoHash: get("info_hash"),
+		PeerID:   get("peer_id"),
+		Key:      get("key"),
+		Event:    trackerEvent(get("event")),
+		NumWant:  -1,
+	}
+
+	if len(req.InfoHash) != 20 {
+		return req, errors.New("invalid info_hash")
+	}
+
+	if len(req.PeerID) != peerIDSize {
+		return req, errors.New("invalid peer_id")
+	}
+
+	port, err := strconv.ParseUint(get("port"), 10, 16)
+	if err != nil || port == 0 {
+		return req, errors.New("invalid port")
+	}
+
+	req.Left, err = strconv.ParseInt(get("left"), 10, 64)
+	if err != nil || req.Left < 0 {
+		return req, errors.New("invalid left")
+	}
+
+	switch req.Event {
+	case eventNone, eventStarted, eventCompleted, eventStopped:
+	case "empty":
+		req.Event = eventNone
+	default:
+		return req, fmt.Errorf("invalid event %q", req.Event)
+	}
+
+	if numWant := get("numwant"); numWant != "" {
+		req.NumWant, err = strconv.Atoi(numWant)
+		if err != nil || req.NumWant < 0 {
+			return req, errors.New("invalid numwant")
+		}
+	}
+
+	// the address we see comes first, the others only add the family we don't see
+	var addrs []string
+	if remote, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		addrs = append(addrs, remote.Addr().String())
+	}
+	addrs = append(addrs, get("ipv4"), get("ipv6"))
+
+	for _, s := range addrs {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			// ipv4 and ipv6 may come with a port of their own
+			addrPort, err := netip.ParseAddrPort(s)
+			if err != nil {
+				continue
+			}
+
+			addr = addrPort.Addr()
+		}
+
+		addr = addr.Unmap()
+		if addr.Is4() && !req.V4.IsValid() {
+			req.V4 = netip.AddrPortFrom(addr, uint16(port))
+		} else if addr.Is6() && !req.V6.IsValid() {
+			req.V6 = netip.AddrPortFrom(addr, uint16(port))
+		}
+	}
+
+	if !req.V4.IsValid() && !req.V6.IsValid() {
+		return req, errors.New("no address to reach the peer on")
+	}
+
+	return req, nil
+}
+
+func (t *trackerServer) scrape(w http.ResponseWriter, r *http.Request) {
+	infoHashes := r.URL.Query()["info_hash"]
+	for _, infoHash := range infoHashes {
+		if len(infoHash) != 20 {
+			writeTrackerFailure(w, errors.New("invalid info_hash"))
+			return
+		}
+	}
+
+	files := map[string]any{}
+	for infoHash, st := range t.store.Scrape(infoHashes) {
+		files[infoHash] = map[string]any{
+			"complete":   int64(st.Complete),
+			"downloaded": st.Downloaded,
+			"incomplete": int64(st.Incomplete),
+		}
+	}
+
+	writeBencode(w, map[string]any{"files": files})
+}
+
+// writeTrackerFailure answers with a failure reason, with a 200 status so clients read it
+func writeTrackerFailure(w http.ResponseWriter, err error) {
+	writeBencode(w, map[string]any{"failure reason": err.Error()})
+}
+
+func writeBencode(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "text/plain")
+
+	err := bencode.Marshal(w, v)
+	if err != nil {
+		slog.Warn("failed to write tracker response", "err", err)
+	}
+}
+
+// readInfoHashes reads an allowlist, one info hash in hex per line, # starts a comment
+func readInfoHashes(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var infoHashes [][]byte
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		infoHash, err := parseInfoHash(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	return infoHashes, scanner.Err()
+}
+
+// TrackerCmd runs a tracker until it's interrupted
+func TrackerCmd(args []string) error {
+
+	fs := flag.NewFlagSet("tracker", flag.ExitOnError)
+	listenAddr := fs.String("listen", ":6969", "address to answer announces and scrapes on over HTTP, empty to only serve UDP")
+	udpAddr := fs.String("udp", ":6969", "address to answer announces and scrapes on over UDP, empty to only serve HTTP")
+	udpRate := fs.Float64("udp-rate", defaultUDPTrackerRate, "requests per second allowed from one address over UDP")
+	interval := fs.Duration("interval", defaultServerInterval, "how often peers should announce, they are dropped after missing two announces")
+	minInterval := fs.Duration("min-interval", defaultServerMinInterval, "how often peers may announce when they need more peers")
+	allowPath := fs.String("allow", "", "file of the info hashes to track, one per line, every torrent when empty")
+	statePath := fs.String("state", "", "file to keep the swarms in across restarts, in memory only when empty")
+	fs.Parse(args)
+
+	if *interval <= 0 || *minInterval <= 0 {
+		return errors.New("-interval and -min-interval must be positive")
+	}
+
+	if *listenAddr == "" && *udpAddr == "" {
+		return errors.New("-listen and -udp can't both be empty")
+	}
+
+	var allowed [][]byte
+	if *allowPath != "" {
+		var err error
+		allowed, err = readInfoHashes(*allowPath)
+		if err != nil {
+			return err
+		}
+
+		if len(allowed) == 0 {
+			return fmt.Errorf("no info hash in %s", *allowPath)
+		}
+	}
+
+	store := newSwarmStore(*interval, allowed)
+	if *statePath != "" {
+		err := store.Load(*statePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	defer wg.Wait()
+
+	// the first server to fail stops the others
+	serve := func(f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stop()
+			errs <- f()
+		}()
+	}
+
+	if *listenAddr != "" {
+		ln, err := net.Listen("tcp", *listenAddr)
+		if err != nil {
+			return err
+		}
+
+		mux := http.NewServeMux()
+		tracker := newTrackerServer(store, *interval, *minInterval)
+		mux.Handle(trackerAnnouncePath, tracker)
+		mux.Handle(trackerScrapePath, tracker)
+		mux.Handle(metricsPath, metrics)
+
+		server := &http.Server{
+			Handler: mux,
+		}
+
+		context.AfterFunc(ctx, func() {
+			server.Close()
+		})
+
+		serve(func() error {
+			err := server.Serve(ln)
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+			return err
+		})
+	}
+
+	if *udpAddr != "" {
+		pc, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			return err
+		}
+
+		tracker := newUDPTrackerServer(store, *interval, *udpRate)
+		serve(func() error {
+			return tracker.Serve(ctx, pc)
+		})
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		maintainSwarms(ctx, store, *interval, *statePath)
+	}()
+
+	slog.Info("tracker started", "http", *listenAddr, "udp", *udpAddr, "interval", *interval, "allowed", len(allowed))
+
+	<-ctx.Done()
+
+	for {
+		select {
+		case err := <-errs:
+			if err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// maintainSwarms drops the peers that stopped announcing and saves the swarms, until the context is canceled
+func maintainSwarms(ctx context.Context, store *swarmStore, interval time.Duration, statePath string) {
+	save := func() {
+		if statePath == "" {
+			return
+		}
+
+		err := store.Save(statePath)
+		if err != nil {
+			slog.Warn("failed to save the tracker state", "err", err)
+		}
+	}
+
+	ticker := time.NewTicker(min(interval/2, time.Minute))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			save()
+			return
+
+		case now := <-ticker.C:
+			store.Expire(now)
+			save()
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+var (
+	testSwarmHash  = strings.Repeat("h", 20)
+	testSwarmStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// testSwarmPeer is the announce of a peer with an id made of c, at 10.0.0.n
+func testSwarmPeer(c byte, n byte, left int64, event trackerEvent) swarmAnnounce {
+	return swarmAnnounce{
+		InfoHash: testSwarmHash,
+		PeerID:   strings.Repeat(string(c), peerIDSize),
+		Key:      string(c),
+		Event:    event,
+		Left:     left,
+		NumWant:  -1,
+		V4:       netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, n}), 6881),
+	}
+}
+
+func TestSwarmStoreAnnounce(t *testing.T) {
+	store := newSwarmStore(time.Minute, nil)
+	now := testSwarmStart
+
+	announce := func(req swarmAnnounce) swarmAnswer {
+		t.Helper()
+
+		answer, err := store.Announce(req, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return answer
+	}
+
+	seeder := testSwarmPeer('s', 1, 0, eventStarted)
+	leecher := testSwarmPeer('l', 2, 100, eventStarted)
+	other := testSwarmPeer('o', 3, 100, eventStarted)
+
+	if answer := announce(seeder); len(answer.Peers) != 0 || answer.Complete != 1 {
+		t.Fatalf("first peer got %+v", answer)
+	}
+
+	answer := announce(leecher)
+	if len(answer.Peers) != 1 || answer.Peers[0].v4 != seeder.V4 || answer.Complete != 1 || answer.Incomplete != 1 {
+		t.Fatalf("leecher got %+v", answer)
+	}
+
+	announce(other)
+
+	// seeders only get the leechers
+	if answer := announce(seeder); len(answer.Peers) != 2 {
+		t.Fatalf("seeder got %d peers, want the 2 leechers", len(answer.Peers))
+	}
+
+	// numwant bounds the answer
+	limited := leecher
+	limited.NumWant = 1
+	if answer := announce(limited); len(answer.Peers) != 1 {
+		t.Fatalf("numwant 1 got %d peers", len(answer.Peers))
+	}
+
+	// completed is counted once, a peer that was already seeding doesn't count again
+	leecher.Event = eventCompleted
+	leecher.Left = 0
+	announce(leecher)
+	announce(leecher)
+	seeder.Event = eventCompleted
+	announce(seeder)
+
+	if st := store.Scrape([]string{testSwarmHash})[testSwarmHash]; st != (swarmStats{Complete: 2, Downloaded: 1, Incomplete: 1}) {
+		t.Fatalf("got stats %+v", st)
+	}
+
+	// another peer can't take over an id that is in use
+	thief := testSwarmPeer('l', 9, 100, eventNone)
+	thief.Key = "thief"
+	if _, err := store.Announce(thief, now); !errors.Is(err, errPeerIDInUse) {
+		t.Fatalf("announce with the id of another peer: %v", err)
+	}
+
+	other.Event = eventStopped
+	if answer := announce(other); answer.Incomplete != 0 || len(answer.Peers) != 0 {
+		t.Fatalf("stopped peer got %+v", answer)
+	}
+
+	// the scrape of everything includes the swarms nobody asked about
+	if stats := store.Scrape(nil); len(stats) != 1 {
+		t.Fatalf("scrape of every torrent got %d", len(stats))
+	}
+}
+
+func TestSwarmStoreExpire(t *testing.T) {
+	store := newSwarmStore(time.Minute, nil)
+
+	store.Announce(testSwarmPeer('a', 1, 100, eventStarted), testSwarmStart)
+	store.Announce(testSwarmPeer('b', 2, 100, eventStarted), testSwarmStart.Add(90*time.Second))
+
+	// a peer may miss one announce
+	store.Expire(testSwarmStart.Add(119 * time.Second))
+	if st := store.Scrape(nil)[testSwarmHash]; st.Incomplete != 2 {
+		t.Fatalf("got %d peers, want 2", st.Incomplete)
+	}
+
+	store.Expire(testSwarmStart.Add(2 * time.Minute))
+	if st := store.Scrape(nil)[testSwarmHash]; st.Incomplete != 1 {
+		t.Fatalf("got %d peers, want 1", st.Incomplete)
+	}
+
+	// once an expired peer's id is free another one can announce with it
+	thief := testSwarmPeer('a', 9, 100, eventNone)
+	thief.Key = "thief"
+	if _, err := store.Announce(thief, testSwarmStart.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	// empty swarms are dropped, unless someone completed them
+	store.Expire(testSwarmStart.Add(time.Hour))
+	if stats := store.Scrape(nil); len(stats) != 0 {
+		t.Fatalf("empty swarm is still there: %+v", stats)
+	}
+
+	completed := testSwarmPeer('c', 3, 0, eventCompleted)
+	store.Announce(completed, testSwarmStart)
+	store.Expire(testSwarmStart.Add(time.Hour))
+	if st, ok := store.Scrape(nil)[testSwarmHash]; !ok || st.Downloaded != 1 {
+		t.Fatalf("completed swarm got %+v", st)
+	}
+}
+
+func TestSwarmStoreAllowed(t *testing.T) {
+	store := newSwarmStore(time.Minute, [][]byte{[]byte(testSwarmHash)})
+
+	if _, err := store.Announce(testSwarmPeer('a', 1, 0, eventStarted), testSwarmStart); err != nil {
+		t.Fatal(err)
+	}
+
+	unknown := testSwarmPeer('a', 1, 0, eventStarted)
+	unknown.InfoHash = strings.Repeat("u", 20)
+	if _, err := store.Announce(unknown, testSwarmStart); !errors.Is(err, errTorrentNotAllowed) {
+		t.Fatalf("announce of a torrent that isn't allowed: %v", err)
+	}
+
+	stats := store.Scrape([]string{testSwarmHash, unknown.InfoHash})
+	if _, ok := stats[unknown.InfoHash]; ok || len(stats) != 1 {
+		t.Fatalf("scrape got %+v", stats)
+	}
+}
+
+func TestSwarmStoreSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	// a missing state is an empty tracker
+	loaded := newSwarmStore(time.Minute, nil)
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	store := newSwarmStore(time.Minute, nil)
+
+	// peer ids are bytes, not text
+	dual := testSwarmPeer('d', 1, 0, eventCompleted)
+	dual.PeerID = "\xff\x00" + dual.PeerID[2:]
+	dual.V6 = netip.MustParseAddrPort("[2001:db8::1]:6881")
+	store.Announce(dual, testSwarmStart)
+	store.Announce(testSwarmPeer('b', 2, 100, eventStarted), testSwarmStart)
+
+	if err := store.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if st := loaded.Scrape(nil)[testSwarmHash]; st != (swarmStats{Complete: 1, Downloaded: 1, Incomplete: 1}) {
+		t.Fatalf("loaded stats %+v", st)
+	}
+
+	peer := loaded.swarms[testSwarmHash].peers[dual.PeerID]
+	if peer == nil || peer.key != dual.Key || peer.v4 != dual.V4 || peer.v6 != dual.V6 || !peer.seen.Equal(testSwarmStart) {
+		t.Fatalf("loaded peer %+v", peer)
+	}
+}
+
+// trackerGet sends a request to the tracker and decodes its answer
+func trackerGet(t *testing.T, server *httptest.Server, path string, q url.Values) map[string]any {
+	t.Helper()
+
+	resp, err := http.Get(server.URL + path + "?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	decoded, err := bencode.Decode(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return decoded.(map[string]any)
+}
+
+func TestTrackerServerAnnounce(t *testing.T) {
+	store := newSwarmStore(time.Minute, nil)
+	server := httptest.NewServer(newTrackerServer(store, time.Minute, 10*time.Second))
+	defer server.Close()
+
+	seeder := testSwarmPeer('s', 1, 0, eventStarted)
+	seeder.V6 = netip.MustParseAddrPort("[2001:db8::1]:6881")
+	store.Announce(seeder, time.Now())
+
+	query := func(params ...string) url.Values {
+		q := url.Values{
+			"info_hash": {testSwarmHash},
+			"peer_id":   {strings.Repeat("l", peerIDSize)},
+			"port":      {"7000"},
+			"left":      {"100"},
+		}
+		for i := 0; i < len(params); i += 2 {
+			q.Set(params[i], params[i+1])
+		}
+		return q
+	}
+
+	resp := trackerGet(t, server, trackerAnnouncePath, query("event", "started"))
+	if resp["interval"] != int64(60) || resp["min interval"] != int64(10) || resp["complete"] != int64(1) || resp["incomplete"] != int64(1) {
+		t.Fatalf("got %v", resp)
+	}
+
+	if resp["peers"] != "\x0a\x00\x00\x01\x1a\xe1" || resp["peers6"] != string(seeder.V6.Addr().AsSlice())+"\x1a\xe1" {
+		t.Fatalf("got compact peers %q and %q", resp["peers"], resp["peers6"])
+	}
+
+	// the dictionary model lists every address of a peer
+	resp = trackerGet(t, server, trackerAnnouncePath, query("compact", "0"))
+	peers, _ := resp["peers"].([]any)
+	if len(peers) != 2 {
+		t.Fatalf("got peers %v", resp["peers"])
+	}
+
+	first := peers[0].(map[string]any)
+	if first["ip"] != "10.0.0.1" || first["port"] != int64(6881) || first["peer id"] != seeder.PeerID {
+		t.Fatalf("got peer %v", first)
+	}
+
+	resp = trackerGet(t, server, trackerAnnouncePath, query("compact", "0", "no_peer_id", "1"))
+	if _, ok := resp["peers"].([]any)[0].(map[string]any)["peer id"]; ok {
+		t.Fatal("got the peer id with no_peer_id")
+	}
+
+	// the peer is reached on the address it announced from, with the port it gave
+	peer := store.swarms[testSwarmHash].peers[strings.Repeat("l", peerIDSize)]
+	if peer == nil || peer.v4 != netip.MustParseAddrPort("127.0.0.1:7000") {
+		t.Fatalf("announcing peer stored as %+v", peer)
+	}
+
+	for _, q := range []url.Values{
+		query("info_hash", "short"),
+		query("peer_id", "short"),
+		query("port", "0"),
+		query("left", "-1"),
+		query("event", "paused"),
+		query("numwant", "lots"),
+	} {
+		if resp := trackerGet(t, server, trackerAnnouncePath, q); resp["failure reason"] == nil {
+			t.Errorf("announce %s got %v", q.Encode(), resp)
+		}
+	}
+}
+
+func TestTrackerServerScrape(t *testing.T) {
+	store := newSwarmStore(time.Minute, nil)
+	server := httptest.NewServer(newTrackerServer(store, time.Minute, 10*time.Second))
+	defer server.Close()
+
+	store.Announce(testSwarmPeer('s', 1, 0, eventCompleted), time.Now())
+	store.Announce(testSwarmPeer('l', 2, 100, eventStarted), time.Now())
+
+	unknown := strings.Repeat("u", 20)
+	resp := trackerGet(t, server, trackerScrapePath, url.Values{"info_hash": {testSwarmHash, unknown}})
+
+	files := resp["files"].(map[string]any)
+	st, _ := files[testSwarmHash].(map[string]any)
+	if st["complete"] != int64(1) || st["downloaded"] != int64(1) || st["incomplete"] != int64(1) {
+		t.Fatalf("got stats %v", st)
+	}
+
+	// a torrent nobody announced has empty stats
+	if empty, _ := files[unknown].(map[string]any); empty["complete"] != int64(0) || len(files) != 2 {
+		t.Fatalf("got files %v", files)
+	}
+
+	if resp := trackerGet(t, server, trackerScrapePath, url.Values{"info_hash": {"short"}}); resp["failure reason"] == nil {
+		t.Fatalf("scrape of an invalid info hash got %v", resp)
+	}
+}
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the subset of the Transmission RPC protocol that dashboards and scripts use, see
+// https://github.com/transmission/transmission/blob/main/docs/rpc-spec.md
+const (
+	transmissionPath = "/transmission/rpc"
+
+	// the header carrying the CSRF token, a request without the right one gets a 409 that tells the token
+	transmissionSessionHeader = "X-Transmission-Session-Id"
+
+	transmissionRPCVersion = 15
+	transmissionVersion    = "mybittorrent 0.1"
+
+	// largest .torrent file fetched from a URL
+	maxTorrentFileSize = 16 << 20
+)
+
+// the torrent status values of Transmission
+const (
+	trStatusStopped = iota
+	trStatusCheckWait
+	trStatusCheck
+	trStatusDownloadWait
+	trStatusDownload
+	trStatusSeedWait
+	trStatusSeed
+)
+
+// the error values of Transmission, local errors like a full disk win over the tracker's
+const (
+	trErrorNone           = 0
+	trErrorTrackerWarning = 1
+	trErrorTrackerError   = 2
+	trErrorLocal          = 3
+)
+
+type transmissionRequest struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+type transmissionResponse struct {
+	// "success", or the error message
+	Result    string          `json:"result"`
+	Arguments any             `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+// transmissionServer exposes a session over the Transmission RPC protocol
+type transmissionServer struct {
+	session     *Session
+	downloadDir string
+
+	// the CSRF token the clients have to send back
+	sessionID string
+
+	// host names the server is reached by, besides localhost and IP addresses
+	hostWhitelist []string
+
+	methods map[string]func(ctx context.Context, args json.RawMessage) (any, error)
+}
+
+func newTransmissionServer(session *Session, downloadDir string) *transmissionServer {
+	id := make([]byte, 24)
+	rand.Read(id)
+
+	s := &transmissionServer{
+		session:     session,
+		downloadDir: downloadDir,
+		sessionID:   hex.EncodeToString(id),
+	}
+
+	s.methods = map[string]func(ctx context.Context, args json.RawMessage) (any, error){
+		"torrent-add":    s.torrentAdd,
+		"torrent-get":    s.torrentGet,
+		"torrent-start":  s.torrentStart,
+		"torrent-stop":   s.torrentStop,
+		"torrent-remove": s.torrentRemove,
+		"session-get":    s.sessionGet,
+		"session-stats":  s.sessionStats,
+	}
+
+	return s
+}
+
+func (s *transmissionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.allowedHost(r) {
+		http.Error(w, "unknown host "+r.Host+", add it to the host whitelist", http.StatusMisdirectedRequest)
+		return
+	}
+
+	w.Header().Set(transmissionSessionHeader, s.sessionID)
+
+	if r.Header.Get(transmissionSessionHeader) != s.sessionID {
+		http.Error(w, "missing or outdated "+transmissionSessionHeader, http.StatusConflict)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req transmissionRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRPCRequestSize)).Decode(&req)
+	if err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := transmissionResponse{
+		Result:    "success",
+		Arguments: struct{}{},
+		Tag:       req.Tag,
+	}
+
+	method, ok := s.methods[req.Method]
+	if !ok {
+		resp.Result = "method name not recognized"
+	} else {
+		result, err := method(r.Context(), req.Arguments)
+		if err != nil {
+			resp.Result = err.Error()
+		} else if result != nil {
+			resp.Arguments = result
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// allowedHost protects against DNS rebinding. A web page whose name was pointed at us is on the same
+// origin as the server, so it could read the session id and send requests. Like the rpc-host-whitelist
+// of Transmission, only IP addresses, localhost and the whitelisted names are accepted as the host.
+func (s *transmissionServer) allowedHost(r *http.Request) bool {
+	// nothing on the web reaches a unix socket
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+		return true
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+
+	if _, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return true
+	}
+
+	for _, allowed := range s.hostWhitelist {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func decodeArguments(args json.RawMessage, v any) error {
+	if len(args) == 0 || string(args) == "null" {
+		return nil
+	}
+
+	err := json.Unmarshal(args, v)
+	if err != nil {
+		return fmt.Errorf("invalid arguments: %w", err)
+	}
+
+	return nil
+}
+
+// torrents returns the torrents the ids select. ids is a single id, a list of ids and hash
+// strings, "recently-active", or missing for every torrent.
+func (s *transmissionServer) torrents(ids json.RawMessage) ([]*Torrent, error) {
+	all := s.session.Torrents()
+	if len(ids) == 0 || string(ids) == "null" {
+		return all, nil
+	}
+
+	var decoded any
+	err := json.Unmarshal(ids, &decoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ids: %w", err)
+	}
+
+	var selectors []any
+	switch v := decoded.(type) {
+	case float64:
+		selectors = []any{v}
+	case string:
+		// we don't track activity, every torrent that is running counts as recently active
+		if v == "recently-active" {
+			var active []*Torrent
+			for _, t := range all {
+				state := t.State()
+				if state == TorrentChecking || state == TorrentDownloading || state == TorrentSeeding {
+					active = append(active, t)
+				}
+			}
+			return active, nil
+		}
+		selectors = []any{v}
+	case []any:
+		selectors = v
+	default:
+		return nil, fmt.Errorf("invalid ids: %s", ids)
+	}
+
+	var torrents []*Torrent
+	for _, selector := range selectors {
+		var t *Torrent
+
+		switch v := selector.(type) {
+		case float64:
+			t = s.session.TorrentByID(int(v))
+		case string:
+			infoHash, err := hex.DecodeString(v)
+			if err == nil {
+				t = s.session.Torrent(infoHash)
+			}
+		default:
+			return nil, fmt.Errorf("invalid id %v", selector)
+		}
+
+		// unknown ids are ignored like Transmission does
+		if t != nil {
+			torrents = append(torrents, t)
+		}
+	}
+
+	return torrents, nil
+}
+
+type transmissionAddArgs struct {
+	// path or URL of a .torrent file, or a magnet link
+	Filename string `json:"filename"`
+
+	// base64 content of a .torrent file
+	Metainfo []byte `json:"metainfo"`
+
+	DownloadDir string `json:"download-dir"`
+	Paused      bool   `json:"paused"`
+
+	// indexes of files
+	FilesUnwanted  []int `json:"files-unwanted"`
+	PriorityHigh   []int `json:"priority-high"`
+	PriorityLow    []int `json:"priority-low"`
+	PriorityNormal []int `json:"priority-normal"`
+}
+
+func (s *transmissionServer) torrentAdd(ctx context.Context, args json.RawMessage) (any, error) {
+	var a transmissionAddArgs
+	err := decodeArguments(args, &a)
+	if err != nil {
+		return nil, err
+	}
+
+	var file *TorrentFile
+	content := a.Metainfo
+	switch {
+	case len(content) > 0:
+	case strings.HasPrefix(a.Filename, "magnet:"):
+		link, err := parseMagnet(a.Filename)
+		if err != nil {
+			return nil, err
+		}
+
+		if t := s.session.Torrent(link.InfoHash); t != nil {
+			return map[string]any{"torrent-duplicate": addedTorrent(t)}, nil
+		}
+
+		file, err = s.session.ResolveMagnet(ctx, link)
+	case strings.HasPrefix(a.Filename, "http://"), strings.HasPrefix(a.Filename, "https://"):
+		content, err = fetchTorrentFile(ctx, a.Filename)
+	case a.Filename != "":
+		content, err = os.ReadFile(a.Filename)
+	default:
+		return nil, errors.New("filename or metainfo is required")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if file == nil {
+		file, err = ParseTorrentFile(content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if t := s.session.Torrent(file.Info.InfoHash); t != nil {
+		return map[string]any{"torrent-duplicate": addedTorrent(t)}, nil
+	}
+
+	filePriorities := make([]filePriority, len(file.Info.Files))
+	for i := range filePriorities {
+		filePriorities[i] = priorityNormal
+	}
+
+	for _, files := range []struct {
+		indexes  []int
+		priority filePriority
+	}{
+		{a.PriorityNormal, priorityNormal},
+		{a.PriorityLow, priorityLow},
+		{a.PriorityHigh, priorityHigh},
+		{a.FilesUnwanted, prioritySkip},
+	} {
+		for _, i := range files.indexes {
+			if i < 0 || i >= len(filePriorities) {
+				return nil, fmt.Errorf("file index %d out of range, the torrent has %d files", i, len(filePriorities))
+			}
+
+			filePriorities[i] = files.priority
+		}
+	}
+
+	dir := a.DownloadDir
+	if dir == "" {
+		dir = s.downloadDir
+	}
+
+	storage, err := newFileStorage(&file.Info, filepath.Join(dir, file.Info.Name), filePriorities)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := s.session.AddTorrent(file, storage, filePriorities)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	if a.Paused {
+		err = s.session.Pause(t.InfoHash())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return map[string]any{"torrent-added": addedTorrent(t)}, nil
+}
+
+func addedTorrent(t *Torrent) map[string]any {
+	return map[string]any{
+		"id":         t.ID(),
+		"name":       t.file.Info.Name,
+		"hashString": hex.EncodeToString(t.InfoHash()),
+	}
+}
+
+func fetchTorrentFile(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: status code %d", url, resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxTorrentFileSize))
+}
+
+type transmissionGetArgs struct {
+	IDs    json.RawMessage `json:"ids"`
+	Fields []string        `json:"fields"`
+}
+
+func (s *transmissionServer) torrentGet(ctx context.Context, args json.RawMessage) (any, error) {
+	var a transmissionGetArgs
+	err := decodeArguments(args, &a)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(a.Fields) == 0 {
+		return nil, errors.New("fields is required")
+	}
+
+	torrents, err := s.torrents(a.IDs)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []map[string]any{}
+	for _, t := range torrents {
+		fields := torrentFields(t)
+
+		// unknown fields are left out like Transmission does
+		selected := make(map[string]any)
+		for _, name := range a.Fields {
+			if value, ok := fields[name]; ok {
+				selected[name] = value
+			}
+		}
+
+		result = append(result, selected)
+	}
+
+	return map[string]any{"torrents": result}, nil
+}
+
+// torrentFields returns every field of the torrent that we support
+func torrentFields(t *Torrent) map[string]any {
+	status := t.Status()
+	info := &t.file.Info
+
+	var trStatus int
+	switch status.State {
+	case TorrentQueued:
+		switch {
+		case status.Complete:
+			trStatus = trStatusSeedWait
+		case !status.Checked:
+			trStatus = trStatusCheckWait
+		default:
+			trStatus = trStatusDownloadWait
+		}
+	case TorrentChecking:
+		trStatus = trStatusCheck
+	case TorrentDownloading:
+		trStatus = trStatusDownload
+	case TorrentSeeding:
+		trStatus = trStatusSeed
+	default:
+		trStatus = trStatusStopped
+	}
+
+	tracker := status.Tracker
+
+	trError, errorString := trErrorNone, ""
+	switch {
+	case status.Err != nil:
+		trError, errorString = trErrorLocal, status.Err.Error()
+	case tracker.Err != nil:
+		trError, errorString = trErrorTrackerError, tracker.Err.Error()
+	case tracker.Warning != "":
+		trError, errorString = trErrorTrackerWarning, tracker.Warning
+	}
+
+	lastAnnounceResult := "Success"
+	if tracker.Err != nil {
+		lastAnnounceResult = tracker.Err.Error()
+	}
+
+	var lastAnnounce, nextAnnounce int64
+	if !tracker.LastAnnounce.IsZero() {
+		lastAnnounce, nextAnnounce = tracker.LastAnnounce.Unix(), tracker.NextAnnounce.Unix()
+	}
+
+	trackerStats := []map[string]any{{
+		"id":                    0,
+		"tier":                  0,
+		"announce":              t.file.Announce,
+		"hasAnnounced":          lastAnnounce != 0,
+		"lastAnnounceTime":      lastAnnounce,
+		"lastAnnounceSucceeded": lastAnnounce != 0 && tracker.Err == nil,
+		"lastAnnounceResult":    lastAnnounceResult,
+		"nextAnnounceTime":      nextAnnounce,
+		"seederCount":           tracker.Seeders,
+		"leecherCount":          tracker.Leechers,
+	}}
+
+	percentDone := 1.0
+	if status.Wanted > 0 {
+		percentDone = float64(status.WantedCompleted) / float64(status.Wanted)
+	}
+
+	downloadDir := filepath.Dir(t.DataPath())
+
+	var files, fileStats []map[string]any
+	priorities := t.FilePriorities()
+	for i, f := range info.Files {
+		var completed int64
+		for _, segment := range fileSegments(info, i) {
+			if t.hasPiece(segment.pieceIndex) {
+				completed += segment.length
+			}
+		}
+
+		name := f.DisplayPath()
+		if info.MultiFile {
+			name = info.Name + "/" + name
+		}
+
+		files = append(files, map[string]any{
+			"name":           name,
+			"length":         f.Length,
+			"bytesCompleted": completed,
+		})
+
+		priority := 0
+		switch priorities[i] {
+		case priorityLow:
+			priority = -1
+		case priorityHigh:
+			priority = 1
+		}
+
+		fileStats = append(fileStats, map[string]any{
+			"bytesCompleted": completed,
+			"wanted":         priorities[i] != prioritySkip,
+			"priority":       priority,
+		})
+	}
+
+	return map[string]any{
+		"id":             status.ID,
+		"hashString":     status.InfoHash,
+		"name":           status.Name,
+		"isPrivate":      status.Private,
+		"status":         trStatus,
+		"error":          trError,
+		"errorString":    errorString,
+		"percentDone":    percentDone,
+		"totalSize":      status.Length,
+		"sizeWhenDone":   status.Wanted,
+		"leftUntilDone":  status.Wanted - status.WantedCompleted,
+		"haveValid":      status.Completed,
+		"isFinished":     status.Complete,
+		"downloadDir":    downloadDir,
+		"addedDate":      status.Added.Unix(),
+		"pieceCount":     status.TotalPieces,
+		"pieceSize":      info.PieceLength,
+		"peersConnected": len(t.peers.List()),
+		"rateDownload":   status.DownloadRate,
+		"rateUpload":     status.UploadRate,
+		"downloadedEver": status.Downloaded,
+		"uploadedEver":   status.Uploaded,
+		"files":          files,
+		"fileStats":      fileStats,
+		"trackerStats":   trackerStats,
+	}
+}
+
+// filePieceSegment is the part of a file that a piece covers
+type filePieceSegment struct {
+	pieceIndex int
+	length     int64
+}
+
+func fileSegments(info *Info, fileIndex int) []filePieceSegment {
+	var segments []filePieceSegment
+
+	first, last := info.FilePieces(fileIndex)
+	for i := first; i <= last; i++ {
+		for _, segment := range info.PieceSegments(i) {
+			if segment.fileIndex == fileIndex {
+				segments = append(segments, filePieceSegment{pieceIndex: i, length: segment.length})
+			}
+		}
+	}
+
+	return segments
+}
+
+type transmissionIDsArgs struct {
+	IDs json.RawMessage `json:"ids"`
+
+	// only used by torrent-remove
+	DeleteLocalData bool `json:"delete-local-data"`
+}
+
+func (s *transmissionServer) torrentStart(ctx context.Context, args json.RawMessage) (any, error) {
+	return nil, s.forEach(args, func(t *Torrent, _ transmissionIDsArgs) error {
+		return s.session.Resume(t.InfoHash())
+	})
+}
+
+func (s *transmissionServer) torrentStop(ctx context.Context, args json.RawMessage) (any, error) {
+	return nil, s.forEach(args, func(t *Torrent, _ transmissionIDsArgs) error {
+		return s.session.Pause(t.InfoHash())
+	})
+}
+
+func (s *transmissionServer) torrentRemove(ctx context.Context, args json.RawMessage) (any, error) {
+	return nil, s.forEach(args, func(t *Torrent, a transmissionIDsArgs) error {
+		dataPath := t.DataPath()
+
+		err := s.session.Remove(t.InfoHash())
+		if err != nil {
+			return err
+		}
+
+		if a.DeleteLocalData && dataPath != "" {
+			return removeTorrentData(&t.file.Info, dataPath)
+		}
+
+		return nil
+	})
+}
+
+func (s *transmissionServer) forEach(args json.RawMessage, f func(t *Torrent, a transmissionIDsArgs) error) error {
+	var a transmissionIDsArgs
+	err := decodeArguments(args, &a)
+	if err != nil {
+		return err
+	}
+
+	torrents, err := s.torrents(a.IDs)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, t := range torrents {
+		errs = append(errs, f(t, a))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *transmissionServer) sessionGet(ctx context.Context, args json.RawMessage) (any, error) {
+	config := s.session.config
+
+	// Transmission speaks kB/s
+	uploadLimit := globalBandwidth.upload.Limit()
+	downloadLimit := globalBandwidth.download.Limit()
+
+	return map[string]any{
+		"version":                  transmissionVersion,
+		"rpc-version":              transmissionRPCVersion,
+		"rpc-version-minimum":      transmissionRPCVersion,
+		"session-id":               s.sessionID,
+		"download-dir":             s.downloadDir,
+		"peer-port":                s.session.Addr().(*net.TCPAddr).Port,
+		"peer-limit-global":        config.MaxConnections,
+		"download-queue-enabled":   config.MaxActiveDownloads > 0,
+		"download-queue-size":      config.MaxActiveDownloads,
+		"seed-queue-enabled":       config.MaxActiveSeeds > 0,
+		"seed-queue-size":          config.MaxActiveSeeds,
+		"speed-limit-up-enabled":   uploadLimit > 0,
+		"speed-limit-up":           uploadLimit / 1000,
+		"speed-limit-down-enabled": downloadLimit > 0,
+		"speed-limit-down":         downloadLimit / 1000,
+		"utp-enabled":              config.Transport != transportTCPOnly,
+		"dht-enabled":              false,
+		"pex-enabled":              false,
+		"lpd-enabled":              false,
+	}, nil
+}
+
+func (s *transmissionServer) sessionStats(ctx context.Context, args json.RawMessage) (any, error) {
+	var active, paused int
+	var downloadSpeed, uploadSpeed, downloaded, uploaded int64
+
+	torrents := s.session.Torrents()
+	for _, t := range torrents {
+		status := t.Status()
+
+		switch status.State {
+		case TorrentChecking, TorrentDownloading, TorrentSeeding:
+			active++
+		case TorrentPaused:
+			paused++
+		}
+
+		downloadSpeed += status.DownloadRate
+		uploadSpeed += status.UploadRate
+		downloaded += status.Downloaded
+		uploaded += status.Uploaded
+	}
+
+	// we don't keep statistics across restarts, so the cumulative stats are the current ones
+	stats := map[string]any{
+		"downloadedBytes": downloaded,
+		"uploadedBytes":   uploaded,
+		"filesAdded":      len(torrents),
+		"sessionCount":    1,
+		"secondsActive":   int64(s.session.Uptime().Seconds()),
+	}
+
+	return map[string]any{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": paused,
+		"torrentCount":       len(torrents),
+		"downloadSpeed":      downloadSpeed,
+		"uploadSpeed":        uploadSpeed,
+		"current-stats":      stats,
+		"cumulative-stats":   stats,
+	}, nil
+}
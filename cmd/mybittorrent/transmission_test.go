@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransmissionServerRejectsUnknownHosts(t *testing.T) {
+	ts := newTransmissionServer(nil, t.TempDir())
+	ts.hostWhitelist = []string{"seedbox.lan"}
+
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{host: "localhost:9091", allowed: true},
+		{host: "LOCALHOST.", allowed: true},
+		{host: "127.0.0.1:9091", allowed: true},
+		{host: "[::1]:9091", allowed: true},
+		{host: "192.168.1.5", allowed: true},
+		{host: "seedbox.lan:9091", allowed: true},
+		{host: "evil.example:9091"},
+		{host: "localhost.evil.example"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodPost, server.URL+transmissionPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = tt.host
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		// allowed hosts get on to the check of the session id
+		want := http.StatusConflict
+		if !tt.allowed {
+			want = http.StatusMisdirectedRequest
+		}
+
+		if resp.StatusCode != want {
+			t.Errorf("host %q: got status %d, want %d", tt.host, resp.StatusCode, want)
+		}
+
+		if !tt.allowed && resp.Header.Get(transmissionSessionHeader) != "" {
+			t.Errorf("host %q was told the session id", tt.host)
+		}
+	}
+}
+
+func TestRemoveTorrentData(t *testing.T) {
+	info := testMultiFileInfo()
+	out := filepath.Join(t.TempDir(), "movie")
+
+	storage, err := newSparseFileStorage(info, out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	// something the user put in a directory of the torrent
+	notes := filepath.Join(out, "film", "notes.txt")
+	if err := os.WriteFile(notes, []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeTorrentData(info, out); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range info.Files {
+		if _, err := os.Stat(outputPath(info, out, i)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("file %d is still there: %v", i, err)
+		}
+	}
+
+	for _, dir := range []string{filepath.Join(out, "film", "subs"), filepath.Join(out, "extras")} {
+		if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("empty directory %s is still there: %v", dir, err)
+		}
+	}
+
+	if _, err := os.Stat(notes); err != nil {
+		t.Fatalf("file of the user was removed: %v", err)
+	}
+
+	// once the user's file is gone the directory of the torrent goes with the rest
+	os.Remove(notes)
+	if err := removeTorrentData(info, out); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(out); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("empty torrent directory is still there: %v", err)
+	}
+
+	// a single file torrent leaves its directory alone
+	dir := t.TempDir()
+	single := &Info{Name: "file.bin", Length: 1, PieceLength: 16, PiecesHash: []string{""}, Files: []FileInfo{{Length: 1, Path: []string{"file.bin"}}}}
+	if err := os.WriteFile(filepath.Join(dir, "file.bin"), []byte{1}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeTorrentData(single, filepath.Join(dir, "file.bin")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("directory of a single file torrent was removed: %v", err)
+	}
+}
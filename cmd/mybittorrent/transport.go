@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// transportPolicy decides which transports are used to reach a peer, and in which order
+type transportPolicy int
+
+const (
+	transportPreferTCP transportPolicy = iota
+	transportPreferUTP
+	transportTCPOnly
+	transportUTPOnly
+)
+
+func parseTransportPolicy(s string) (transportPolicy, error) {
+	switch s {
+	case "", "prefer-tcp":
+		return transportPreferTCP, nil
+	case "prefer-utp":
+		return transportPreferUTP, nil
+	case "tcp":
+		return transportTCPOnly, nil
+	case "utp":
+		return transportUTPOnly, nil
+	default:
+		return 0, fmt.Errorf("unknown transport %q, expected one of prefer-tcp, prefer-utp, tcp, utp", s)
+	}
+}
+
+const (
+	defaultDialTimeout = 5 * time.Second
+)
+
+// peerDialer opens connections to peers over TCP or uTP according to its policy
+type peerDialer struct {
+	policy transportPolicy
+
+	// how long a single attempt over one transport may take
+	timeout time.Duration
+
+	// connections go through the proxy when it's set, and only through it when proxyOnly
+	proxy     *socks5Proxy
+	proxyOnly bool
+
+	// uTP connections are multiplexed over a single socket, it's opened on first use
+	utpOnce sync.Once
+	utp     *utpSocket
+	utpErr  error
+}
+
+func newPeerDialer(policy transportPolicy) *peerDialer {
+	return &peerDialer{
+		policy:    policy,
+		timeout:   defaultDialTimeout,
+		proxy:     peerProxy,
+		proxyOnly: proxyOnly,
+	}
+}
+
+// newSocketDialer dials uTP from a socket that is also listening, so the peers we connect to see the port they can reach us on.
+// Behind a proxy the datagrams are relayed by the proxy instead.
+func newSocketDialer(policy transportPolicy, sock *utpSocket) *peerDialer {
+	d := newPeerDialer(policy)
+	if d.proxy != nil {
+		return d
+	}
+
+	d.utpOnce.Do(func() {
+		d.utp = sock
+	})
+
+	return d
+}
+
+// defaultDialer is used by peers that weren't given a dialer of their own
+var defaultDialer = newPeerDialer(transportPreferTCP)
+
+func (d *peerDialer) transports() []string {
+	switch d.policy {
+	case transportPreferUTP:
+		return []string{"utp", "tcp"}
+	case transportTCPOnly:
+		return []string{"tcp"}
+	case transportUTPOnly:
+		return []string{"utp"}
+	default:
+		return []string{"tcp", "utp"}
+	}
+}
+
+// DialContext tries the transports in the order of the policy and returns the first connection that succeeds
+func (d *peerDialer) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	var errs []error
+
+	for _, transport := range d.transports() {
+		conn, err := d.dial(ctx, transport, addr)
+		if err == nil {
+			return conn, nil
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w", transport, err))
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+func (d *peerDialer) dial(ctx context.Context, transport string, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	if transport == "tcp" {
+		return d.dialTCP(ctx, addr)
+	}
+
+	sock, err := d.utpSocket()
+	if err != nil {
+		return nil, err
+	}
+
+	return sock.DialContext(ctx, addr)
+}
+
+func (d *peerDialer) dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	if d.proxy != nil {
+		conn, err := d.proxy.DialContext(ctx, addr)
+		if err == nil || d.proxyOnly || ctx.Err() != nil {
+			return conn, err
+		}
+
+		slog.Debug("proxy failed, connecting directly", "addr", addr, "err", err)
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+func (d *peerDialer) utpSocket() (*utpSocket, error) {
+	d.utpOnce.Do(func() {
+		if d.proxy != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+			defer cancel()
+
+			pc, err := d.proxy.ListenPacket(ctx)
+			if err == nil {
+				d.utp = newUTPDialer(pc)
+				return
+			}
+
+			if d.proxyOnly {
+				d.utpErr = err
+				return
+			}
+
+			slog.Debug("proxy can't relay uTP, using a socket of our own", "err", err)
+		}
+
+		pc, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			d.utpErr = err
+			return
+		}
+
+		d.utp = newUTPDialer(pc)
+	})
+
+	return d.utp, d.utpErr
+}
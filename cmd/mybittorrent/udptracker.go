@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol
+// https://www.bittorrent.org/beps/bep_0015.html
+const (
+	udpTrackerProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	udpConnectSize  = 16
+	udpAnnounceSize = 98
+	udpScrapeSize   = 16
+
+	// the secret of the connection ids is replaced that often, an id is accepted until the secret after the next one
+	udpConnectionIDLifetime = 2 * time.Minute
+
+	// a scrape answer has to fit in a datagram
+	maxUDPScrapeHashes = 74
+
+	defaultUDPTrackerRate = 10.0
+)
+
+// the events of the UDP announces, by their number
+var udpEvents = []trackerEvent{eventNone, eventCompleted, eventStarted, eventStopped}
+
+var errInvalidConnectionID = errors.New("invalid connection id")
+
+// udpTrackerServer answers announces and scrapes over UDP, into the swarms of a store that
+// an HTTP tracker may share
+type udpTrackerServer struct {
+	store    *swarmStore
+	interval time.Duration
+
+	// the connection ids are a MAC of the address of the client, with the current or the previous secret
+	mu      sync.Mutex
+	secrets [2][]byte
+	rotated time.Time
+
+	limiter *addrRateLimiter
+}
+
+func newUDPTrackerServer(store *swarmStore, interval time.Duration, requestsPerSecond float64) *udpTrackerServer {
+	return &udpTrackerServer{
+		store:    store,
+		interval: interval,
+		limiter:  newAddrRateLimiter(requestsPerSecond),
+	}
+}
+
+// Serve answers the requests received on pc until the context is canceled, pc is closed then
+func (u *udpTrackerServer) Serve(ctx context.Context, pc net.PacketConn) error {
+	stop := context.AfterFunc(ctx, func() {
+		pc.Close()
+	})
+	defer stop()
+
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		remote := addr.AddrPort()
+		remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+
+		// answering a flood, even with errors, would make us the flood
+		if !u.limiter.Allow(remote.Addr(), time.Now()) {
+			continue
+		}
+
+		resp := u.handle(buf[:n], remote, time.Now())
+		if resp == nil {
+			continue
+		}
+
+		_, err = pc.WriteTo(resp, from)
+		if err != nil {
+			slog.Debug("failed to answer udp tracker request", "addr", remote, "err", err)
+		}
+	}
+}
+
+// handle returns the answer to a request, nil when it isn't worth one
+func (u *udpTrackerServer) handle(req []byte, remote netip.AddrPort, now time.Time) []byte {
+	if len(req) < udpConnectSize {
+		return nil
+	}
+
+	connectionID := binary.BigEndian.Uint64(req[0:8])
+	action := binary.BigEndian.Uint32(req[8:12])
+	transactionID := binary.BigEndian.Uint32(req[12:16])
+
+	if action == udpActionConnect {
+		if connectionID != udpTrackerProtocolID {
+			return nil
+		}
+
+		resp := binary.BigEndian.AppendUint32(nil, udpActionConnect)
+		resp = binary.BigEndian.AppendUint32(resp, transactionID)
+		return binary.BigEndian.AppendUint64(resp, u.connectionID(remote.Addr(), now))
+	}
+
+	if !u.validConnectionID(connectionID, remote.Addr(), now) {
+		return udpTrackerError(transactionID, errInvalidConnectionID)
+	}
+
+	var resp []byte
+	var err error
+
+	switch action {
+	case udpActionAnnounce:
+		resp, err = u.announce(req, remote, now)
+	case udpActionScrape:
+		resp, err = u.scrape(req)
+	default:
+		err = fmt.Errorf("unknown action %d", action)
+	}
+
+	if err != nil {
+		return udpTrackerError(transactionID, err)
+	}
+
+	return resp
+}
+
+func (u *udpTrackerServer) announce(req []byte, remote netip.AddrPort, now time.Time) ([]byte, error) {
+	if len(req) < udpAnnounceSize {
+		return nil, errors.New("announce too short")
+	}
+
+	event := binary.BigEndian.Uint32(req[80:84])
+	if event >= uint32(len(udpEvents)) {
+		return nil, fmt.Errorf("invalid event %d", event)
+	}
+
+	left := int64(binary.BigEndian.Uint64(req[64:72]))
+	if left < 0 {
+		return nil, errors.New("invalid left")
+	}
+
+	port := binary.BigEndian.Uint16(req[96:98])
+	if port == 0 {
+		return nil, errors.New("invalid port")
+	}
+
+	// like over HTTP, the ip field isn't trusted and the peer is reached on the address it sends from
+	announce := swarmAnnounce{
+		InfoHash: string(req[16:36]),
+		PeerID:   string(req[36:56]),
+		Key:      hex.EncodeToString(req[88:92]),
+		Event:    udpEvents[event],
+		Left:     left,
+		NumWant:  int(int32(binary.BigEndian.Uint32(req[92:96]))),
+	}
+
+	addr := netip.AddrPortFrom(remote.Addr(), port)
+	if addr.Addr().Is4() {
+		announce.V4 = addr
+	} else {
+		announce.V6 = addr
+	}
+
+	answer, err := u.store.Announce(announce, now)
+	if err != nil {
+		return nil, err
+	}
+
+	metricTrackerServerAnnounces.Inc(announce.Event.label(), "udp")
+
+	resp := binary.BigEndian.AppendUint32(nil, udpActionAnnounce)
+	resp = append(resp, req[12:16]...)
+	resp = binary.BigEndian.AppendUint32(resp, uint32(u.interval.Seconds()))
+	resp = binary.BigEndian.AppendUint32(resp, uint32(answer.Incomplete))
+	resp = binary.BigEndian.AppendUint32(resp, uint32(answer.Complete))
+
+	// the peers are of the family the request came over, the client knows their size from it
+	for _, peer := range answer.Peers {
+		peerAddr := peer.v4
+		if remote.Addr().Is6() {
+			peerAddr = peer.v6
+		}
+
+		if !peerAddr.IsValid() {
+			continue
+		}
+
+		resp = append(resp, peerAddr.Addr().AsSlice()...)
+		resp = binary.BigEndian.AppendUint16(resp, peerAddr.Port())
+	}
+
+	return resp, nil
+}
+
+func (u *udpTrackerServer) scrape(req []byte) ([]byte, error) {
+	hashes := req[udpScrapeSize:]
+	if len(hashes) == 0 || len(hashes)%20 != 0 {
+		return nil, errors.New("invalid info hashes")
+	}
+
+	if len(hashes)/20 > maxUDPScrapeHashes {
+		return nil, fmt.Errorf("at most %d info hashes per scrape", maxUDPScrapeHashes)
+	}
+
+	var infoHashes []string
+	for i := 0; i < len(hashes); i += 20 {
+		infoHashes = append(infoHashes, string(hashes[i:i+20]))
+	}
+
+	stats := u.store.Scrape(infoHashes)
+
+	resp := binary.BigEndian.AppendUint32(nil, udpActionScrape)
+	resp = append(resp, req[12:16]...)
+
+	// the answers are in the order of the request, so none can be left out
+	for _, infoHash := range infoHashes {
+		st, ok := stats[infoHash]
+		if !ok {
+			return nil, errTorrentNotAllowed
+		}
+
+		resp = binary.BigEndian.AppendUint32(resp, uint32(st.Complete))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(st.Downloaded))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(st.Incomplete))
+	}
+
+	return resp, nil
+}
+
+func udpTrackerError(transactionID uint32, err error) []byte {
+	resp := binary.BigEndian.AppendUint32(nil, udpActionError)
+	resp = binary.BigEndian.AppendUint32(resp, transactionID)
+	return append(resp, err.Error()...)
+}
+
+// connectionID proves the client received our answer at its address, without us keeping any state
+func (u *udpTrackerServer) connectionID(addr netip.Addr, now time.Time) uint64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.rotate(now)
+	return macConnectionID(u.secrets[0], addr)
+}
+
+func (u *udpTrackerServer) validConnectionID(id uint64, addr netip.Addr, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.rotate(now)
+	for _, secret := range u.secrets {
+		if secret != nil && macConnectionID(secret, addr) == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rotate replaces the secret when it's too old, the previous one stays valid for a while
+func (u *udpTrackerServer) rotate(now time.Time) {
+	if u.secrets[0] != nil && now.Sub(u.rotated) < udpConnectionIDLifetime {
+		return
+	}
+
+	// both are too old after a long pause
+	previous := u.secrets[0]
+	if now.Sub(u.rotated) >= 2*udpConnectionIDLifetime {
+		previous = nil
+	}
+
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+
+	u.secrets = [2][]byte{secret, previous}
+	u.rotated = now
+
+	u.limiter.Prune(now)
+}
+
+func macConnectionID(secret []byte, addr netip.Addr) uint64 {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(addr.AsSlice())
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// addrRateLimiter allows a number of requests per second from every address, with bursts of twice that
+type addrRateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	buckets map[netip.Addr]*addrBucket
+}
+
+type addrBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newAddrRateLimiter limits nothing when the rate isn't positive
+func newAddrRateLimiter(requestsPerSecond float64) *addrRateLimiter {
+	return &addrRateLimiter{
+		rate:    requestsPerSecond,
+		buckets: make(map[netip.Addr]*addrBucket),
+	}
+}
+
+func (l *addrRateLimiter) burst() float64 {
+	return max(2*l.rate, 1)
+}
+
+// Allow takes a token from the bucket of the address, if there is one
+func (l *addrRateLimiter) Allow(addr netip.Addr, now time.Time) bool {
+	if l.rate <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.buckets[addr]
+	if b == nil {
+		b = &addrBucket{tokens: l.burst(), last: now}
+		l.buckets[addr] = b
+	}
+
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*l.rate, l.burst())
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// Prune forgets the addresses whose bucket refilled, they are allowed a full burst anyway
+func (l *addrRateLimiter) Prune(now time.Time) {
+	if l.rate <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for addr, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst() {
+			delete(l.buckets, addr)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// udpRequest is the header of a request, the body follows
+func udpRequest(connectionID uint64, action, transactionID uint32, body ...[]byte) []byte {
+	req := binary.BigEndian.AppendUint64(nil, connectionID)
+	req = binary.BigEndian.AppendUint32(req, action)
+	req = binary.BigEndian.AppendUint32(req, transactionID)
+	for _, b := range body {
+		req = append(req, b...)
+	}
+	return req
+}
+
+// udpAnnounceBody is the rest of an announce of the peer with an id made of c
+func udpAnnounceBody(c byte, left int64, event uint32, port uint16) []byte {
+	body := []byte(testSwarmHash + strings.Repeat(string(c), peerIDSize))
+	body = binary.BigEndian.AppendUint64(body, 0)
+	body = binary.BigEndian.AppendUint64(body, uint64(left))
+	body = binary.BigEndian.AppendUint64(body, 0)
+	body = binary.BigEndian.AppendUint32(body, event)
+	body = binary.BigEndian.AppendUint32(body, 0)
+	body = append(body, c, c, c, c)
+	body = binary.BigEndian.AppendUint32(body, 0xffffffff)
+	return binary.BigEndian.AppendUint16(body, port)
+}
+
+// udpConnect gets a connection id for the address
+func udpConnect(t *testing.T, u *udpTrackerServer, remote netip.AddrPort, now time.Time) uint64 {
+	t.Helper()
+
+	resp := u.handle(udpRequest(udpTrackerProtocolID, udpActionConnect, 7), remote, now)
+	if len(resp) != 16 || binary.BigEndian.Uint32(resp[0:4]) != udpActionConnect || binary.BigEndian.Uint32(resp[4:8]) != 7 {
+		t.Fatalf("connect got %x", resp)
+	}
+
+	return binary.BigEndian.Uint64(resp[8:16])
+}
+
+// udpErrorMessage is the message of an error answer, empty when the answer isn't an error
+func udpErrorMessage(resp []byte) string {
+	if len(resp) < 8 || binary.BigEndian.Uint32(resp[0:4]) != udpActionError {
+		return ""
+	}
+	return string(resp[8:])
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	u := newUDPTrackerServer(newSwarmStore(time.Minute, nil), time.Minute, 0)
+	now := testSwarmStart
+
+	seeder := netip.MustParseAddrPort("10.0.0.1:50000")
+	leecher := netip.MustParseAddrPort("10.0.0.2:50000")
+
+	id := udpConnect(t, u, seeder, now)
+	resp := u.handle(udpRequest(id, udpActionAnnounce, 8, udpAnnounceBody('s', 0, 2, 6881)), seeder, now)
+	if msg := udpErrorMessage(resp); msg != "" || len(resp) != 20 {
+		t.Fatalf("seeder announce got %x %s", resp, msg)
+	}
+
+	id = udpConnect(t, u, leecher, now)
+	resp = u.handle(udpRequest(id, udpActionAnnounce, 9, udpAnnounceBody('l', 100, 2, 6882)), leecher, now)
+	if msg := udpErrorMessage(resp); msg != "" {
+		t.Fatal(msg)
+	}
+
+	// interval, leechers and seeders, then the seeder at the address it sent from with the port it gave
+	if binary.BigEndian.Uint32(resp[4:8]) != 9 || binary.BigEndian.Uint32(resp[8:12]) != 60 ||
+		binary.BigEndian.Uint32(resp[12:16]) != 1 || binary.BigEndian.Uint32(resp[16:20]) != 1 ||
+		string(resp[20:]) != "\x0a\x00\x00\x01\x1a\xe1" {
+		t.Fatalf("leecher announce got %x", resp)
+	}
+
+	// the ids are bound to the address they were given to
+	resp = u.handle(udpRequest(id, udpActionAnnounce, 10, udpAnnounceBody('l', 100, 0, 6882)), seeder, now)
+	if udpErrorMessage(resp) != errInvalidConnectionID.Error() {
+		t.Fatalf("announce with the id of another address got %x", resp)
+	}
+
+	for _, body := range [][]byte{
+		udpAnnounceBody('l', 100, 4, 6882),
+		udpAnnounceBody('l', -1, 0, 6882),
+		udpAnnounceBody('l', 100, 0, 0),
+		udpAnnounceBody('l', 100, 0, 6882)[:40],
+	} {
+		if udpErrorMessage(u.handle(udpRequest(id, udpActionAnnounce, 11, body), leecher, now)) == "" {
+			t.Errorf("invalid announce %x was accepted", body)
+		}
+	}
+
+	if udpErrorMessage(u.handle(udpRequest(id, 9, 12), leecher, now)) == "" {
+		t.Error("unknown action was accepted")
+	}
+
+	// connects must carry the protocol id, and requests shorter than a header get nothing
+	if resp := u.handle(udpRequest(0, udpActionConnect, 13), leecher, now); resp != nil {
+		t.Errorf("connect without the protocol id got %x", resp)
+	}
+	if resp := u.handle([]byte{1, 2, 3}, leecher, now); resp != nil {
+		t.Errorf("short request got %x", resp)
+	}
+}
+
+func TestUDPTrackerScrape(t *testing.T) {
+	store := newSwarmStore(time.Minute, [][]byte{[]byte(testSwarmHash), []byte(strings.Repeat("e", 20))})
+	u := newUDPTrackerServer(store, time.Minute, 0)
+	now := testSwarmStart
+
+	store.Announce(testSwarmPeer('s', 1, 0, eventCompleted), now)
+	store.Announce(testSwarmPeer('l', 2, 100, eventStarted), now)
+
+	remote := netip.MustParseAddrPort("10.0.0.3:50000")
+	id := udpConnect(t, u, remote, now)
+
+	// in the order of the request, with zeros for a swarm nobody announced
+	resp := u.handle(udpRequest(id, udpActionScrape, 5, []byte(strings.Repeat("e", 20)+testSwarmHash)), remote, now)
+	want := binary.BigEndian.AppendUint32(nil, udpActionScrape)
+	want = binary.BigEndian.AppendUint32(want, 5)
+	for _, n := range []uint32{0, 0, 0, 1, 1, 1} {
+		want = binary.BigEndian.AppendUint32(want, n)
+	}
+	if string(resp) != string(want) {
+		t.Fatalf("scrape got %x, want %x", resp, want)
+	}
+
+	for _, hashes := range []string{
+		"",
+		"short",
+		strings.Repeat("u", 20),
+		strings.Repeat(testSwarmHash, maxUDPScrapeHashes+1),
+	} {
+		if udpErrorMessage(u.handle(udpRequest(id, udpActionScrape, 6, []byte(hashes)), remote, now)) == "" {
+			t.Errorf("scrape of %d bytes of hashes was accepted", len(hashes))
+		}
+	}
+}
+
+func TestUDPTrackerConnectionIDRotation(t *testing.T) {
+	u := newUDPTrackerServer(newSwarmStore(time.Minute, nil), time.Minute, 0)
+	remote := netip.MustParseAddrPort("10.0.0.1:50000")
+
+	id := udpConnect(t, u, remote, testSwarmStart)
+
+	tests := []struct {
+		after time.Duration
+		valid bool
+	}{
+		{after: 0, valid: true},
+		{after: udpConnectionIDLifetime - time.Second, valid: true},
+
+		// the secret was replaced, the previous one is still accepted
+		{after: udpConnectionIDLifetime + time.Second, valid: true},
+
+		// and then replaced again
+		{after: 2*udpConnectionIDLifetime + 2*time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := u.validConnectionID(id, remote.Addr(), testSwarmStart.Add(tt.after)); got != tt.valid {
+			t.Errorf("id after %v valid: %v, want %v", tt.after, got, tt.valid)
+		}
+	}
+
+	// after a long pause both secrets are new
+	u = newUDPTrackerServer(newSwarmStore(time.Minute, nil), time.Minute, 0)
+	id = udpConnect(t, u, remote, testSwarmStart)
+	if u.validConnectionID(id, remote.Addr(), testSwarmStart.Add(2*udpConnectionIDLifetime)) {
+		t.Error("id was valid after a long pause")
+	}
+}
+
+func TestAddrRateLimiter(t *testing.T) {
+	l := newAddrRateLimiter(2)
+	now := testSwarmStart
+
+	a := netip.MustParseAddr("10.0.0.1")
+	b := netip.MustParseAddr("10.0.0.2")
+
+	// a burst of twice the rate, then nothing
+	for i := 0; i < 4; i++ {
+		if !l.Allow(a, now) {
+			t.Fatalf("request %d of the burst was refused", i)
+		}
+	}
+	if l.Allow(a, now) {
+		t.Fatal("request after the burst was allowed")
+	}
+
+	// other addresses have their own bucket
+	if !l.Allow(b, now) {
+		t.Fatal("another address was refused")
+	}
+
+	// the bucket refills at the rate
+	now = now.Add(500 * time.Millisecond)
+	if !l.Allow(a, now) || l.Allow(a, now) {
+		t.Fatal("bucket didn't refill one request in half a second")
+	}
+
+	// the full buckets are forgotten
+	l.Prune(now.Add(time.Second))
+	if len(l.buckets) != 1 {
+		t.Fatalf("got %d buckets after pruning, want the one of %s", len(l.buckets), a)
+	}
+	l.Prune(now.Add(2 * time.Second))
+	if len(l.buckets) != 0 {
+		t.Fatalf("got %d buckets after they refilled", len(l.buckets))
+	}
+
+	if unlimited := newAddrRateLimiter(0); !unlimited.Allow(a, now) || !unlimited.Allow(a, now) {
+		t.Fatal("limiter without a rate refused a request")
+	}
+}
+
+func TestUDPTrackerServe(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a burst of one request, the second one is dropped
+	u := newUDPTrackerServer(newSwarmStore(time.Minute, nil), time.Minute, 0.1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- u.Serve(ctx, pc)
+	}()
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 2048)
+	for i, wantAnswer := range []bool{true, false} {
+		if _, err := conn.Write(udpRequest(udpTrackerProtocolID, udpActionConnect, uint32(i))); err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if wantAnswer && (err != nil || n != 16) {
+			t.Fatalf("connect got %d bytes: %v", n, err)
+		}
+		if !wantAnswer && err == nil {
+			t.Fatal("request over the limit was answered")
+		}
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,1064 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// uTP - micro transport protocol
+// https://www.bittorrent.org/beps/bep_0029.html
+
+const (
+	utpTypeData = iota
+	utpTypeFin
+	utpTypeState
+	utpTypeReset
+	utpTypeSyn
+)
+
+const (
+	utpVersion    = 1
+	utpHeaderSize = 20
+
+	utpExtensionNone         = 0
+	utpExtensionSelectiveAck = 1
+
+	// keep the packets under the common path MTU so they are never fragmented
+	utpMaxPayload = 1200
+
+	// LEDBAT tries to keep the one way delay we add to the path at this level
+	utpTargetDelay = 100 * time.Millisecond
+
+	// how many bytes the window is allowed to grow per round trip
+	utpMaxCwndIncreasePerRTT = 3000
+
+	utpMinWindow     = utpMaxPayload
+	utpMaxWindow     = 1 << 20
+	utpRecvWindow    = 1 << 20
+	utpInitialWindow = 2 * utpMaxPayload
+
+	utpInitialTimeout = time.Second
+	utpMinTimeout     = 500 * time.Millisecond
+	utpMaxTimeout     = 30 * time.Second
+
+	// after that many transmissions of the same packet the connection is considered dead
+	utpMaxTransmissions = 8
+
+	// number of packets acked after an unacked one before we treat it as lost
+	utpDupAckThreshold = 3
+
+	// base delay history is kept for two minutes
+	utpBaseDelayHistory = 2 * time.Minute
+
+	utpTickInterval = 50 * time.Millisecond
+
+	// how far ahead of ack_nr we buffer out of order packets
+	utpMaxReorder = 2048
+)
+
+var (
+	errUTPReset   = errors.New("utp: connection reset by peer")
+	errUTPTimeout = errors.New("utp: connection timed out")
+)
+
+type utpHeader struct {
+	typ           uint8
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+
+	// selective ack bitmask, bit 0 of the first byte is ack_nr + 2
+	sack []byte
+}
+
+func (h *utpHeader) marshal(payload []byte) []byte {
+	buf := make([]byte, 0, utpHeaderSize+len(h.sack)+2+len(payload))
+
+	buf = append(buf, h.typ<<4|utpVersion)
+
+	if len(h.sack) > 0 {
+		buf = append(buf, utpExtensionSelectiveAck)
+	} else {
+		buf = append(buf, utpExtensionNone)
+	}
+
+	buf = binary.BigEndian.AppendUint16(buf, h.connID)
+	buf = binary.BigEndian.AppendUint32(buf, h.timestamp)
+	buf = binary.BigEndian.AppendUint32(buf, h.timestampDiff)
+	buf = binary.BigEndian.AppendUint32(buf, h.wndSize)
+	buf = binary.BigEndian.AppendUint16(buf, h.seqNr)
+	buf = binary.BigEndian.AppendUint16(buf, h.ackNr)
+
+	if len(h.sack) > 0 {
+		// no more extensions after this one
+		buf = append(buf, utpExtensionNone, byte(len(h.sack)))
+		buf = append(buf, h.sack...)
+	}
+
+	return append(buf, payload...)
+}
+
+func parseUTPPacket(buf []byte) (*utpHeader, []byte, error) {
+	if len(buf) < utpHeaderSize {
+		return nil, nil, fmt.Errorf("packet too short: %d bytes", len(buf))
+	}
+
+	if buf[0]&0x0f != utpVersion {
+		return nil, nil, fmt.Errorf("unsupported version %d", buf[0]&0x0f)
+	}
+
+	h := &utpHeader{
+		typ:           buf[0] >> 4,
+		connID:        binary.BigEndian.Uint16(buf[2:4]),
+		timestamp:     binary.BigEndian.Uint32(buf[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(buf[8:12]),
+		wndSize:       binary.BigEndian.Uint32(buf[12:16]),
+		seqNr:         binary.BigEndian.Uint16(buf[16:18]),
+		ackNr:         binary.BigEndian.Uint16(buf[18:20]),
+	}
+
+	if h.typ > utpTypeSyn {
+		return nil, nil, fmt.Errorf("unknown packet type %d", h.typ)
+	}
+
+	// walk the extension chain
+	ext := buf[1]
+	rest := buf[utpHeaderSize:]
+	for ext != utpExtensionNone {
+		if len(rest) < 2 {
+			return nil, nil, fmt.Errorf("truncated extension header")
+		}
+
+		next, size := rest[0], int(rest[1])
+		if len(rest) < 2+size {
+			return nil, nil, fmt.Errorf("truncated extension %d", ext)
+		}
+
+		if ext == utpExtensionSelectiveAck {
+			h.sack = rest[2 : 2+size]
+		}
+
+		ext = next
+		rest = rest[2+size:]
+	}
+
+	return h, rest, nil
+}
+
+// seqLess compares sequence numbers taking wrap around into account
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+func utpNow() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
+
+func randomUint16() uint16 {
+	var b [2]byte
+	_, _ = rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+type utpConnKey struct {
+	addr   string
+	recvID uint16
+}
+
+// utpSocket multiplexes any number of uTP connections over a single UDP socket.
+// It implements net.Listener for incoming connections.
+type utpSocket struct {
+	pc net.PacketConn
+
+	// false for a socket we only dial from, the syns of peers are refused as nobody accepts them
+	listening bool
+
+	mu    sync.Mutex
+	conns map[utpConnKey]*utpConn
+
+	acceptCh chan *utpConn
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// ListenUTP opens a UDP socket on addr and starts serving uTP on it.
+func ListenUTP(addr string) (*utpSocket, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewUTPSocket(pc), nil
+}
+
+// NewUTPSocket serves uTP over an existing packet connection, this makes it possible
+// to run it over a wrapped connection that simulates loss and delay.
+func NewUTPSocket(pc net.PacketConn) *utpSocket {
+	return newUTPSocket(pc, true)
+}
+
+// newUTPDialer serves the connections we dial over an existing packet connection, it never accepts any
+func newUTPDialer(pc net.PacketConn) *utpSocket {
+	return newUTPSocket(pc, false)
+}
+
+func newUTPSocket(pc net.PacketConn, listening bool) *utpSocket {
+	s := &utpSocket{
+		pc:        pc,
+		listening: listening,
+		conns:     make(map[utpConnKey]*utpConn),
+		acceptCh:  make(chan *utpConn, 32),
+		closed:    make(chan struct{}),
+	}
+
+	go s.readLoop()
+	go s.tickLoop()
+
+	return s
+}
+
+func (s *utpSocket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+func (s *utpSocket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.acceptCh:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *utpSocket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+
+		s.mu.Lock()
+		conns := make([]*utpConn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+
+		for _, c := range conns {
+			c.mu.Lock()
+			c.fail(net.ErrClosed)
+			c.mu.Unlock()
+		}
+
+		err = s.pc.Close()
+	})
+
+	return err
+}
+
+func (s *utpSocket) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+
+	// pick a connection id that isn't in use with this peer
+	var recvID uint16
+	for {
+		recvID = randomUint16()
+		if _, ok := s.conns[utpConnKey{raddr.String(), recvID}]; !ok {
+			break
+		}
+	}
+
+	c := newUTPConn(s, raddr, recvID, recvID+1)
+	c.state = utpStateSynSent
+	c.seqNr = 1
+	s.conns[utpConnKey{raddr.String(), recvID}] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	// the syn is addressed with our receive id, everything after it with the send id
+	c.sendPacket(utpTypeSyn, nil, recvID)
+	c.mu.Unlock()
+
+	select {
+	case <-c.connected:
+		c.mu.Lock()
+		err := c.err
+		c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		return c, nil
+
+	case <-ctx.Done():
+		c.mu.Lock()
+		c.fail(ctx.Err())
+		c.mu.Unlock()
+		return nil, ctx.Err()
+
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *utpSocket) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			s.Close()
+			return
+		}
+
+		h, payload, err := parseUTPPacket(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		// the payload is only valid until the next read
+		payload = append([]byte(nil), payload...)
+		if h.sack != nil {
+			h.sack = append([]byte(nil), h.sack...)
+		}
+
+		s.handlePacket(addr, h, payload)
+	}
+}
+
+func (s *utpSocket) handlePacket(addr net.Addr, h *utpHeader, payload []byte) {
+	s.mu.Lock()
+
+	if h.typ == utpTypeSyn {
+		// the peer's send id is one above the connection id in the syn
+		key := utpConnKey{addr.String(), h.connID + 1}
+		c, ok := s.conns[key]
+		if !ok && !s.listening {
+			s.mu.Unlock()
+			s.reset(addr, h)
+			return
+		}
+
+		if !ok {
+			c = newUTPConn(s, addr, h.connID+1, h.connID)
+			c.state = utpStateConnected
+			c.seqNr = randomUint16()
+			c.ackNr = h.seqNr
+			close(c.connected)
+			s.conns[key] = c
+			s.mu.Unlock()
+
+			select {
+			case s.acceptCh <- c:
+			default:
+				// nobody is accepting, refuse the connection
+				c.mu.Lock()
+				c.sendPacket(utpTypeReset, nil, c.sendID)
+				c.fail(errUTPReset)
+				c.mu.Unlock()
+				return
+			}
+		} else {
+			s.mu.Unlock()
+		}
+
+		// ack the syn, a duplicate syn means our state packet was lost
+		c.mu.Lock()
+		c.handleTimestamps(h)
+		c.sendState()
+		c.mu.Unlock()
+		return
+	}
+
+	c, ok := s.conns[utpConnKey{addr.String(), h.connID}]
+	s.mu.Unlock()
+
+	if !ok {
+		// let the other side know that we don't know this connection
+		if h.typ != utpTypeReset {
+			s.reset(addr, h)
+		}
+		return
+	}
+
+	c.mu.Lock()
+	c.handlePacket(h, payload)
+	c.mu.Unlock()
+}
+
+// reset answers a packet of a connection we don't have
+func (s *utpSocket) reset(addr net.Addr, h *utpHeader) {
+	reset := &utpHeader{
+		typ:       utpTypeReset,
+		connID:    h.connID,
+		timestamp: utpNow(),
+		ackNr:     h.seqNr,
+	}
+	_, _ = s.pc.WriteTo(reset.marshal(nil), addr)
+}
+
+func (s *utpSocket) tickLoop() {
+	ticker := time.NewTicker(utpTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*utpConn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+
+			for _, c := range conns {
+				c.mu.Lock()
+				c.tick(now)
+				c.mu.Unlock()
+			}
+		}
+	}
+}
+
+func (s *utpSocket) remove(c *utpConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := utpConnKey{c.raddr.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+type utpState int
+
+const (
+	utpStateSynSent utpState = iota
+	utpStateConnected
+	utpStateFinSent
+	utpStateClosed
+)
+
+type utpOutPacket struct {
+	typ     uint8
+	seqNr   uint16
+	payload []byte
+
+	sentAt        time.Time
+	transmissions int
+	acked         bool
+}
+
+type utpDelaySample struct {
+	at    time.Time
+	delay uint32
+}
+
+// utpConn is a single uTP connection, it implements net.Conn
+type utpConn struct {
+	sock  *utpSocket
+	raddr net.Addr
+
+	recvID uint16
+	sendID uint16
+
+	// everything below is protected by mu
+	mu sync.Mutex
+
+	state utpState
+	err   error
+
+	// the sequence number of the next packet we send
+	seqNr uint16
+
+	// the last sequence number we received in order
+	ackNr uint16
+
+	// packets waiting to be acked, in sequence order
+	outstanding []*utpOutPacket
+	curWindow   int
+	maxWindow   float64
+	peerWindow  int
+
+	lastAckNr   uint16
+	dupAcks     int
+	lastLossCut time.Time
+
+	rtt     time.Duration
+	rttVar  time.Duration
+	timeout time.Duration
+
+	// the delay the peer measured on our packets, used by LEDBAT
+	baseDelays []utpDelaySample
+
+	// what we measured on the peer's last packet, echoed back to it
+	replyMicro uint32
+
+	// out of order packets by sequence number
+	reorder map[uint16][]byte
+	readBuf []byte
+
+	// sequence number of the peer's fin packet if we got it
+	gotFin bool
+	finSeq uint16
+	eof    bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	connected chan struct{}
+	readable  chan struct{}
+	writable  chan struct{}
+	done      chan struct{}
+}
+
+func newUTPConn(s *utpSocket, raddr net.Addr, recvID, sendID uint16) *utpConn {
+	return &utpConn{
+		sock:       s,
+		raddr:      raddr,
+		recvID:     recvID,
+		sendID:     sendID,
+		maxWindow:  utpInitialWindow,
+		peerWindow: utpRecvWindow,
+		timeout:    utpInitialTimeout,
+		reorder:    make(map[uint16][]byte),
+		connected:  make(chan struct{}),
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// fail tears the connection down and wakes up everyone waiting on it. Must be called with mu held.
+func (c *utpConn) fail(err error) {
+	if c.state == utpStateClosed {
+		return
+	}
+
+	if c.state == utpStateSynSent {
+		close(c.connected)
+	}
+
+	c.state = utpStateClosed
+	if c.err == nil {
+		c.err = err
+	}
+
+	close(c.done)
+	c.sock.remove(c)
+}
+
+func (c *utpConn) recvWindow() uint32 {
+	if len(c.readBuf) >= utpRecvWindow {
+		return 0
+	}
+	return uint32(utpRecvWindow - len(c.readBuf))
+}
+
+func (c *utpConn) header(typ uint8, connID uint16, seqNr uint16) *utpHeader {
+	return &utpHeader{
+		typ:           typ,
+		connID:        connID,
+		timestamp:     utpNow(),
+		timestampDiff: c.replyMicro,
+		wndSize:       c.recvWindow(),
+		seqNr:         seqNr,
+		ackNr:         c.ackNr,
+	}
+}
+
+// sendPacket sends a packet that consumes a sequence number and has to be acked
+func (c *utpConn) sendPacket(typ uint8, payload []byte, connID uint16) {
+	pkt := &utpOutPacket{
+		typ:     typ,
+		seqNr:   c.seqNr,
+		payload: payload,
+	}
+	c.seqNr++
+
+	c.outstanding = append(c.outstanding, pkt)
+	c.curWindow += len(payload)
+	c.transmit(pkt, connID)
+}
+
+func (c *utpConn) transmit(pkt *utpOutPacket, connID uint16) {
+	pkt.sentAt = time.Now()
+	pkt.transmissions++
+
+	h := c.header(pkt.typ, connID, pkt.seqNr)
+	_, _ = c.sock.pc.WriteTo(h.marshal(pkt.payload), c.raddr)
+}
+
+// sendState sends an ack, state packets don't consume a sequence number
+func (c *utpConn) sendState() {
+	h := c.header(utpTypeState, c.sendID, c.seqNr)
+	h.sack = c.selectiveAck()
+	_, _ = c.sock.pc.WriteTo(h.marshal(nil), c.raddr)
+}
+
+// selectiveAck builds the bitmask of the packets we got past ack_nr + 1
+func (c *utpConn) selectiveAck() []byte {
+	if len(c.reorder) == 0 {
+		return nil
+	}
+
+	var highest uint16
+	for seq := range c.reorder {
+		if offset := seq - c.ackNr - 2; offset > highest && offset < 32*8 {
+			highest = offset
+		}
+	}
+
+	// the mask length must be a multiple of 4
+	size := (int(highest)/32 + 1) * 4
+	mask := make([]byte, size)
+	for seq := range c.reorder {
+		offset := int(seq - c.ackNr - 2)
+		if offset < size*8 {
+			mask[offset/8] |= 1 << (offset % 8)
+		}
+	}
+
+	return mask
+}
+
+func (c *utpConn) handleTimestamps(h *utpHeader) {
+	c.replyMicro = utpNow() - h.timestamp
+}
+
+func (c *utpConn) handlePacket(h *utpHeader, payload []byte) {
+	if c.state == utpStateClosed {
+		return
+	}
+
+	c.handleTimestamps(h)
+	c.peerWindow = int(h.wndSize)
+
+	if h.typ == utpTypeReset {
+		c.fail(errUTPReset)
+		return
+	}
+
+	if c.state == utpStateSynSent {
+		if h.typ != utpTypeState {
+			return
+		}
+
+		// the peer's first data packet will carry this sequence number
+		c.ackNr = h.seqNr - 1
+		c.state = utpStateConnected
+		close(c.connected)
+	}
+
+	c.handleAck(h)
+
+	switch h.typ {
+	case utpTypeData:
+		c.handleData(h.seqNr, payload)
+		c.sendState()
+
+	case utpTypeFin:
+		c.gotFin = true
+		c.finSeq = h.seqNr
+		c.deliverInOrder()
+		c.sendState()
+	}
+
+	if c.state == utpStateFinSent && len(c.outstanding) == 0 {
+		// our fin was acked
+		c.fail(net.ErrClosed)
+	}
+}
+
+func (c *utpConn) handleData(seqNr uint16, payload []byte) {
+	// a duplicate of something we already have, or too far ahead to buffer
+	if !seqLess(c.ackNr, seqNr) || seqNr-c.ackNr > utpMaxReorder {
+		return
+	}
+
+	c.reorder[seqNr] = payload
+	c.deliverInOrder()
+}
+
+// deliverInOrder moves the packets that follow ack_nr into the read buffer
+func (c *utpConn) deliverInOrder() {
+	for {
+		next := c.ackNr + 1
+
+		if c.gotFin && next == c.finSeq {
+			c.ackNr = next
+			c.eof = true
+			notify(c.readable)
+			return
+		}
+
+		payload, ok := c.reorder[next]
+		if !ok {
+			return
+		}
+
+		delete(c.reorder, next)
+		c.ackNr = next
+		c.readBuf = append(c.readBuf, payload...)
+		notify(c.readable)
+	}
+}
+
+func (c *utpConn) handleAck(h *utpHeader) {
+	now := time.Now()
+	var ackedBytes int
+	var progress bool
+
+	for _, pkt := range c.outstanding {
+		if pkt.acked {
+			continue
+		}
+
+		if seqLess(h.ackNr, pkt.seqNr) && !c.sackHas(h, pkt.seqNr) {
+			continue
+		}
+
+		pkt.acked = true
+		progress = true
+		ackedBytes += len(pkt.payload)
+		c.curWindow -= len(pkt.payload)
+
+		// retransmitted packets give ambiguous samples
+		if pkt.transmissions == 1 {
+			c.updateRTT(now.Sub(pkt.sentAt))
+		}
+	}
+
+	// drop the acked packets from the front of the queue
+	i := 0
+	for i < len(c.outstanding) && c.outstanding[i].acked {
+		i++
+	}
+	c.outstanding = c.outstanding[i:]
+
+	if h.timestampDiff != 0 {
+		c.addDelaySample(now, h.timestampDiff)
+	}
+
+	if ackedBytes > 0 {
+		c.updateWindow(ackedBytes)
+		notify(c.writable)
+	}
+
+	if len(c.outstanding) == 0 {
+		c.dupAcks = 0
+		c.lastAckNr = h.ackNr
+		return
+	}
+
+	if !progress && h.ackNr == c.lastAckNr && h.typ == utpTypeState {
+		c.dupAcks++
+	} else if h.ackNr != c.lastAckNr {
+		c.dupAcks = 0
+	}
+	c.lastAckNr = h.ackNr
+
+	if c.dupAcks >= utpDupAckThreshold {
+		c.dupAcks = 0
+		c.onLoss(now)
+		c.transmit(c.outstanding[0], c.sendID)
+		return
+	}
+
+	// a packet that has enough packets acked after it is considered lost
+	if h.sack != nil {
+		ackedAfter := 0
+		for i := len(c.outstanding) - 1; i >= 0; i-- {
+			pkt := c.outstanding[i]
+			if pkt.acked {
+				ackedAfter++
+				continue
+			}
+
+			if ackedAfter >= utpDupAckThreshold && now.Sub(pkt.sentAt) > c.rtt {
+				c.onLoss(now)
+				c.transmit(pkt, c.sendID)
+			}
+		}
+	}
+}
+
+func (c *utpConn) sackHas(h *utpHeader, seqNr uint16) bool {
+	offset := int(seqNr - h.ackNr - 2)
+	if offset < 0 || offset >= len(h.sack)*8 {
+		return false
+	}
+
+	return h.sack[offset/8]&(1<<(offset%8)) != 0
+}
+
+func (c *utpConn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+
+	c.timeout = max(c.rtt+4*c.rttVar, utpMinTimeout)
+}
+
+func (c *utpConn) addDelaySample(now time.Time, delay uint32) {
+	// forget samples that are older than the history window
+	i := 0
+	for i < len(c.baseDelays) && now.Sub(c.baseDelays[i].at) > utpBaseDelayHistory {
+		i++
+	}
+	c.baseDelays = c.baseDelays[i:]
+
+	// keep the samples sorted by time and increasing by delay, so the first one is the minimum
+	for len(c.baseDelays) > 0 && c.baseDelays[len(c.baseDelays)-1].delay >= delay {
+		c.baseDelays = c.baseDelays[:len(c.baseDelays)-1]
+	}
+	c.baseDelays = append(c.baseDelays, utpDelaySample{at: now, delay: delay})
+}
+
+// ourDelay is the queuing delay above the minimum delay we have seen on the path
+func (c *utpConn) ourDelay() time.Duration {
+	if len(c.baseDelays) == 0 {
+		return 0
+	}
+
+	last := c.baseDelays[len(c.baseDelays)-1].delay
+	return time.Duration(last-c.baseDelays[0].delay) * time.Microsecond
+}
+
+// updateWindow is the LEDBAT congestion controller
+func (c *utpConn) updateWindow(ackedBytes int) {
+	offTarget := float64(utpTargetDelay - c.ourDelay())
+	delayFactor := offTarget / float64(utpTargetDelay)
+	windowFactor := float64(ackedBytes) / c.maxWindow
+
+	c.maxWindow += utpMaxCwndIncreasePerRTT * delayFactor * windowFactor
+	c.maxWindow = min(max(c.maxWindow, utpMinWindow), utpMaxWindow)
+}
+
+func (c *utpConn) onLoss(now time.Time) {
+	// only cut the window once per round trip
+	if now.Sub(c.lastLossCut) < c.rtt {
+		return
+	}
+
+	c.lastLossCut = now
+	c.maxWindow = max(c.maxWindow/2, utpMinWindow)
+}
+
+func (c *utpConn) tick(now time.Time) {
+	if c.state == utpStateClosed || len(c.outstanding) == 0 {
+		return
+	}
+
+	oldest := c.outstanding[0]
+	if now.Sub(oldest.sentAt) < c.timeout {
+		return
+	}
+
+	if oldest.transmissions >= utpMaxTransmissions {
+		c.fail(errUTPTimeout)
+		return
+	}
+
+	c.maxWindow = utpMinWindow
+	c.timeout = min(c.timeout*2, utpMaxTimeout)
+
+	connID := c.sendID
+	if oldest.typ == utpTypeSyn {
+		connID = c.recvID
+	}
+
+	c.transmit(oldest, connID)
+}
+
+// canSend reports whether a packet with size bytes fits in the send window
+func (c *utpConn) canSend(size int) bool {
+	// always allow a single packet, that is also how a closed peer window gets probed
+	if c.curWindow == 0 {
+		return true
+	}
+
+	window := min(int(c.maxWindow), c.peerWindow)
+	return c.curWindow+size <= window
+}
+
+func deadlineTimer(deadline time.Time) (<-chan time.Time, func()) {
+	if deadline.IsZero() {
+		return nil, func() {}
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	return timer.C, func() { timer.Stop() }
+}
+
+func (c *utpConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+
+		if len(c.readBuf) > 0 {
+			wasFull := c.recvWindow() == 0
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if len(c.readBuf) == 0 {
+				c.readBuf = nil
+			}
+
+			// let the peer know it can send again
+			if wasFull && c.state != utpStateClosed {
+				c.sendState()
+			}
+
+			c.mu.Unlock()
+			return n, nil
+		}
+
+		if c.eof {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+
+		if c.state == utpStateClosed || c.state == utpStateFinSent {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+
+		deadline, done := c.readDeadline, c.done
+		c.mu.Unlock()
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		timeout, stop := deadlineTimer(deadline)
+		select {
+		case <-c.readable:
+		case <-done:
+		case <-timeout:
+		}
+		stop()
+	}
+}
+
+func (c *utpConn) Write(b []byte) (int, error) {
+	var written int
+
+	for written < len(b) {
+		c.mu.Lock()
+
+		if c.state != utpStateConnected {
+			err := c.err
+			if err == nil {
+				err = net.ErrClosed
+			}
+			c.mu.Unlock()
+			return written, err
+		}
+
+		size := min(len(b)-written, utpMaxPayload)
+		if c.canSend(size) {
+			payload := append([]byte(nil), b[written:written+size]...)
+			c.sendPacket(utpTypeData, payload, c.sendID)
+			written += size
+			c.mu.Unlock()
+			continue
+		}
+
+		deadline, done := c.writeDeadline, c.done
+		c.mu.Unlock()
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+
+		timeout, stop := deadlineTimer(deadline)
+		select {
+		case <-c.writable:
+		case <-done:
+		case <-timeout:
+		}
+		stop()
+	}
+
+	return written, nil
+}
+
+// Close sends a fin to the peer, the connection is removed from the socket once it's acked
+func (c *utpConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state != utpStateConnected {
+		return nil
+	}
+
+	c.sendPacket(utpTypeFin, nil, c.sendID)
+	c.state = utpStateFinSent
+
+	// wake up readers and writers
+	close(c.done)
+	c.done = make(chan struct{})
+	c.err = net.ErrClosed
+
+	return nil
+}
+
+func (c *utpConn) LocalAddr() net.Addr {
+	return c.sock.Addr()
+}
+
+func (c *utpConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *utpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *utpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.readable)
+	return nil
+}
+
+func (c *utpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.writable)
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	mathrand "math/rand/v2"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// lossyPacketConn drops a share of the packets it sends and delays the others, with a jitter
+// that reorders them, like a congested path would
+type lossyPacketConn struct {
+	net.PacketConn
+
+	loss   float64
+	delay  time.Duration
+	jitter time.Duration
+}
+
+func (c *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if mathrand.Float64() < c.loss {
+		return len(b), nil
+	}
+
+	delay := c.delay
+	if c.jitter > 0 {
+		delay += mathrand.N(c.jitter)
+	}
+
+	// the caller may reuse b once we return
+	pkt := append([]byte(nil), b...)
+	time.AfterFunc(delay, func() {
+		c.PacketConn.WriteTo(pkt, addr)
+	})
+
+	return len(b), nil
+}
+
+// utpPair connects two uTP sockets over loopback, both sending through the lossy wrapper
+func utpPair(t *testing.T, loss float64, delay, jitter time.Duration) (dialed, accepted net.Conn) {
+	t.Helper()
+
+	socket := func() *utpSocket {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := NewUTPSocket(&lossyPacketConn{PacketConn: pc, loss: loss, delay: delay, jitter: jitter})
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+
+	client, server := socket(), socket()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dialed, err := client.DialContext(ctx, server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted, err = server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dialed, accepted
+}
+
+// assertUTPTransfer sends size random bytes each way at once and checks they arrive intact
+func assertUTPTransfer(t *testing.T, a, b net.Conn, size int) {
+	t.Helper()
+
+	send := func(conn net.Conn) ([]byte, chan error) {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := conn.Write(data)
+			errs <- err
+		}()
+
+		return data, errs
+	}
+
+	receive := func(conn net.Conn, want []byte) {
+		conn.SetReadDeadline(time.Now().Add(time.Minute))
+
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Fatal("the data changed on the way")
+		}
+	}
+
+	fromA, errA := send(a)
+	fromB, errB := send(b)
+
+	receive(b, fromA)
+	receive(a, fromB)
+
+	for _, errs := range []chan error{errA, errB} {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUTPTransfer(t *testing.T) {
+	dialed, accepted := utpPair(t, 0, 0, 0)
+
+	assertUTPTransfer(t, dialed, accepted, 4<<20)
+}
+
+func TestUTPLossyTransfer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("recovering from the losses takes a few seconds")
+	}
+
+	// the syn and the fin can be lost too
+	dialed, accepted := utpPair(t, 0.05, 10*time.Millisecond, 20*time.Millisecond)
+
+	assertUTPTransfer(t, dialed, accepted, 512<<10)
+
+	dialed.Close()
+
+	accepted.SetReadDeadline(time.Now().Add(time.Minute))
+	if _, err := accepted.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after the peer closed: %v", err)
+	}
+}
+
+func TestUTPDeadline(t *testing.T) {
+	dialed, _ := utpPair(t, 0, 0, 0)
+
+	dialed.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	_, err := dialed.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past the deadline: %v", err)
+	}
+
+	// a deadline in the past fails at once
+	dialed.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := dialed.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past the deadline: %v", err)
+	}
+}
+
+func TestUTPDialUnreachable(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// everything is lost on the way
+	s := NewUTPSocket(&lossyPacketConn{PacketConn: pc, loss: 1})
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_, err = s.DialContext(ctx, "127.0.0.1:9")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("dial of a peer that doesn't answer: %v", err)
+	}
+
+	s.Close()
+	if _, err := s.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("accept on a closed socket: %v", err)
+	}
+}
+
+func TestUTPDialerRefusesSyns(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a socket we only dial from, nobody accepts on it
+	dialer := newUTPDialer(pc)
+	defer dialer.Close()
+
+	client, err := ListenUTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = client.DialContext(ctx, dialer.Addr().String())
+	if !errors.Is(err, errUTPReset) {
+		t.Fatalf("dial of a socket that doesn't listen: %v", err)
+	}
+
+	dialer.mu.Lock()
+	conns := len(dialer.conns)
+	dialer.mu.Unlock()
+
+	if conns != 0 {
+		t.Fatalf("socket that doesn't listen keeps %d connections", conns)
+	}
+}